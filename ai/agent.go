@@ -1,30 +1,56 @@
 package ai
 
 import (
+	"regexp"
 	"strings"
 )
 
-type Provider string
-
 var (
 	DefaultAgent = "chatgpt"
 
-	// alias to provider mapping
-	Agents = map[string]Provider{
-		"chatgpt": "openai",
+	// alias to model mapping, an empty model uses the chat model
+	Agents = map[string]string{
+		"chatgpt": "",
 	}
+
+	// @alias mentions at the start or after a space or punctuation, not in emails
+	mentionRegexp = regexp.MustCompile(`(?:^|[^\w.])@([A-Za-z0-9_\-]+)`)
 )
 
-// IsPrompt checks whether we were prompted with @alias
-func IsPrompt(p string, users int) (string, bool) {
-	p = strings.ToLower(p)
+// Mentions returns the aliases mentioned as @alias in order of appearance
+func Mentions(p string, aliases ...string) []string {
+	known := map[string]bool{}
+	for _, a := range aliases {
+		known[strings.ToLower(a)] = true
+	}
+
+	var found []string
+	seen := map[string]bool{}
 
-	for agent := range Agents {
-		if strings.Contains(p, "@"+agent) {
-			return agent, true
+	for _, m := range mentionRegexp.FindAllStringSubmatch(p, -1) {
+		alias := strings.ToLower(m[1])
+		if known[alias] && !seen[alias] {
+			found = append(found, alias)
+			seen[alias] = true
 		}
 	}
 
+	return found
+}
+
+// IsPrompt checks whether we were prompted with @alias using the given
+// aliases or the registered agents. A 1:1 chat is always a prompt.
+func IsPrompt(p string, users int, aliases ...string) (string, bool) {
+	if len(aliases) == 0 {
+		for agent := range Agents {
+			aliases = append(aliases, agent)
+		}
+	}
+
+	if m := Mentions(p, aliases...); len(m) > 0 {
+		return m[0], true
+	}
+
 	// 1:1 chat
 	return DefaultAgent, users <= 1
 }
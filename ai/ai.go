@@ -2,8 +2,7 @@ package ai
 
 import (
 	"context"
-	"errors"
-	"io"
+	"encoding/json"
 	"strings"
 
 	"github.com/asim/turbo/log"
@@ -13,179 +12,323 @@ import (
 var (
 	Client *openai.Client
 
+	// Upstreams of the default provider if set as a pool
+	Upstreams *Pool
+
 	// DefaultModel
 	DefaultModel = "gpt-3"
 
 	DefaultURL = "https://api.openai.com/v1"
 
-	// limit max tokens
+	// context window in tokens for unknown models
 	DefaultLimit = 4096
 )
 
 var (
-	// Supported models platform/model
-	Models = map[string]Model{
-		"gpt-4": &chatgpt{openai.GPT4},
-		"gpt-3": &chatgpt{openai.GPT3Dot5Turbo},
+	// Supported models by alias or provider/model
+	Models = map[string]Model{}
+
+	// Aliases for models of the default provider
+	Aliases = map[string]string{
+		"gpt-4": openai.GPT4,
+		"gpt-3": openai.GPT3Dot5Turbo,
 	}
 )
 
 // Model represents a model which can be sent a prompt
 type Model interface {
-	Complete(prompt, user string, ctx ...Context) (string, error)
-	Stream(prompt, user string, ctx ...Context) (chan string, error)
+	Complete(ctx context.Context, req *Request) (*Response, error)
+	Stream(ctx context.Context, req *Request) (chan *Response, error)
 	String() string
 }
 
+// Request is a prompt sent to a model
+type Request struct {
+	// The prompt to send
+	Prompt string
+	// The user making the request
+	User string
+	// System prompt prepended to every request
+	System string
+	// Summary of earlier context no longer sent
+	Summary string
+	// Past prompts and replies
+	Context []Context
+	// Tools the model can call
+	Tools []*Tool
+	// Tool calls made for this prompt with their results
+	Calls []ToolCall
+	// Generation parameters
+	Params *Params
+	// Images attached to the prompt
+	Images []Image
+	// JSON schema the reply must match
+	Schema json.RawMessage
+	// Bypass the completion cache
+	NoCache bool
+}
+
+// Response from a model. When streaming the reply is the next part.
+type Response struct {
+	// The reply from the model
+	Reply string
+	// Tool calls requested by the model
+	ToolCalls []ToolCall
+	// The model which answered when using fallbacks
+	Model string
+	// Tokens used, when streaming sent once at the end
+	Usage *Usage
+	// Served from the completion cache
+	Cached bool
+	// Why the reply finished e.g stop or length, when streaming sent once at the end
+	FinishReason string
+}
+
+// Reasons a reply finished
+const (
+	// FinishStop is a complete reply
+	FinishStop = "stop"
+	// FinishLength is a reply truncated by max tokens
+	FinishLength = "length"
+	// FinishFilter is a reply stopped by a content filter
+	FinishFilter = "content_filter"
+	// FinishToolCalls is a reply which called tools
+	FinishToolCalls = "tool_calls"
+	// FinishError is a reply which failed while streaming
+	FinishError = "error"
+	// FinishToolRounds is a streamed reply which still called tools after MaxToolRounds
+	FinishToolRounds = "tool_rounds"
+)
+
+// finishReason normalises the reasons of the providers
+func finishReason(reason string) string {
+	switch reason {
+	case "end_turn", "stop_sequence":
+		return FinishStop
+	case "max_tokens":
+		return FinishLength
+	case "tool_use", "function_call":
+		return FinishToolCalls
+	case "refusal":
+		return FinishFilter
+	}
+	return reason
+}
+
 // Context represents past prompts to a model
 type Context struct {
 	Prompt string
 	Reply  string
+	// Images attached to the prompt
+	Images []Image `json:",omitempty"`
 }
 
-// Set the api key for a given url
+// Message is a single message sent to a model
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Tool calls made by the assistant
+	ToolCalls []ToolCall `json:"-"`
+	// The tool call a tool message is the result of
+	ToolCallID string `json:"-"`
+	// Images attached by the user
+	Images []Image `json:"-"`
+}
+
+// Set the api key for a given url and register it as the default provider
 func Set(key, uri string) error {
 	if strings.Contains(uri, "openai.azure.com") {
-		// setup config
-		cfg := openai.DefaultAzureConfig(key, uri)
-		Client = openai.NewClientWithConfig(cfg)
-		return nil
-	} else if len(uri) > 0 {
-		// setup config
-		cfg := openai.DefaultConfig(key)
-		// set base uri
-		cfg.BaseURL = uri
-		// set client
-		Client = openai.NewClientWithConfig(cfg)
-		return nil
-	}
-
-	// default url
-	Client = openai.NewClient(key)
-	return nil
+		// setup azure
+		return setDefault(NewAzure(Config{Key: key, URL: uri}))
+	}
+
+	// default url or openai compatible url
+	return setDefault(NewOpenAI(Config{Key: key, URL: uri}))
 }
 
-// chatgpt models
-type chatgpt struct {
-	model string
+// SetPool registers the openai compatible upstreams of the pool as the default provider
+func SetPool(p *Pool) error {
+	if err := setDefault(NewOpenAI(Config{Pool: p})); err != nil {
+		return err
+	}
+	Upstreams = p
+	return nil
 }
 
-func (c *chatgpt) Complete(prompt, user string, ctx ...Context) (string, error) {
-	// create chat completion
-	resp, err := Client.CreateChatCompletion(
-		context.Background(),
-		complete(prompt, user, c.model, ctx...),
-	)
-	if err != nil {
-		return "", err
+// setDefault registers the provider and uses it as the default
+func setDefault(p Provider) error {
+	// set client
+	Client = p.(*openaiProvider).client
+
+	if err := Register(p); err != nil {
+		return err
 	}
-	return resp.Choices[0].Message.Content, nil
+
+	// use as the default provider
+	DefaultProvider = p.String()
+
+	// point the aliases at it
+	for alias, model := range Aliases {
+		md, err := p.Model(model)
+		if err != nil {
+			return err
+		}
+		providerMtx.Lock()
+		Models[alias] = md
+		providerMtx.Unlock()
+	}
+
+	return nil
 }
 
-func (c *chatgpt) Stream(prompt, user string, ctx ...Context) (chan string, error) {
-	req := complete(prompt, user, c.model, ctx...)
-	req.Stream = true
+// messages builds the list of messages to send to a model keeping
+// the newest context that fits within the model's token budget
+func messages(model string, req *Request) []Message {
+	limit := GetLimit(model)
 
-	stream, err := Client.CreateChatCompletionStream(context.TODO(), req)
-	if err != nil {
-		log.Printf("Error creating chat stream: %v\n", err)
-		return nil, err
+	// the actual next prompt
+	next := Message{
+		Role:    "user",
+		Content: req.Prompt,
+		Images:  req.Images,
 	}
 
-	ch := make(chan string, 100)
+	// tool calls and results for the prompt
+	var calls []Message
 
-	go func() {
-		defer stream.Close()
-
-		for {
-			response, err := stream.Recv()
-			if errors.Is(err, io.EOF) {
-				log.Printf("EOF in ai chat stream: %v\n", err)
-				close(ch)
-				return
-			}
+	if len(req.Calls) > 0 {
+		calls = append(calls, Message{
+			Role:      "assistant",
+			ToolCalls: req.Calls,
+		})
+	}
 
-			if err != nil {
-				log.Printf("Error in ai chat stream: %v\n", err)
-				close(ch)
-				return
-			}
+	for _, c := range req.Calls {
+		calls = append(calls, Message{
+			Role:       "tool",
+			Content:    c.Result,
+			ToolCallID: c.ID,
+		})
+	}
+
+	// context window less reserved output, the prompt and
+	// the 3 tokens priming the reply <|start|>assistant<|message|>
+	budget := limit.Context - req.Params.output(limit) - countTokens(model, next) - countTokens(model, calls...) - 3
+
+	var system []Message
+
+	// the system prompt always goes first
+	if len(req.System) > 0 {
+		system = append(system, Message{
+			Role:    "system",
+			Content: req.System,
+		})
+		budget -= countTokens(model, system...)
+	}
 
-			ch <- response.Choices[0].Delta.Content
+	// followed by the summary of older turns
+	if len(req.Summary) > 0 {
+		summary := Message{
+			Role:    "system",
+			Content: "Summary of the earlier conversation:\n" + req.Summary,
 		}
+		system = append(system, summary)
+		budget -= countTokens(model, summary)
+	}
 
-	}()
+	// and how to format the reply
+	if len(req.Schema) > 0 {
+		format := Message{
+			Role:    "system",
+			Content: schemaPrompt(req.Schema),
+		}
+		system = append(system, format)
+		budget -= countTokens(model, format)
+	}
 
-	return ch, nil
-}
+	var history []Message
 
-func (c *chatgpt) String() string {
-	return c.model
-}
+	// walk back from the newest turn
+	for i := len(req.Context) - 1; i >= 0; i-- {
+		c := req.Context[i]
 
-func complete(prompt, user, model string, ctx ...Context) openai.ChatCompletionRequest {
-	// we need to set a context limit
-	limit := DefaultLimit - len(prompt)
+		turn := []Message{
+			// the user message
+			{Role: "user", Content: c.Prompt},
+		}
 
-	message := []openai.ChatCompletionMessage{}
+		// earlier images if the model can see them
+		if limit.Vision {
+			turn[0].Images = loadedImages(c.Images)
+		}
+
+		// the assistant response unless between users
+		if len(c.Reply) > 0 {
+			turn = append(turn, Message{Role: "assistant", Content: c.Reply})
+		}
 
-	for _, c := range ctx {
-		// adjust the limit
-		limit -= (len(c.Prompt) + len(c.Reply))
+		// adjust the budget
+		budget -= countTokens(model, turn...)
 
 		// we're hitting the limit
-		if limit < 0 {
+		if budget < 0 {
 			break
 		}
 
-		// set the user message
-		message = append(message, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: c.Prompt,
-		})
-		// set the assistant response
-		message = append(message, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleAssistant,
-			Content: c.Reply,
-		})
+		history = append(turn, history...)
 	}
 
-	// append the actual next prompt
-	message = append(message, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: prompt,
-	})
+	msgs := append(append(system, history...), next)
 
-	return openai.ChatCompletionRequest{
-		Model:    model,
-		Messages: message,
-		User:     user,
-	}
+	return append(msgs, calls...)
 }
 
 // Complete a request
 func Complete(prompt, user string, ctx ...Context) (string, error) {
-	md, ok := Models[DefaultModel]
-	if !ok {
-		return "", errors.New("Unsupported model")
+	md, err := GetModel(DefaultModel)
+	if err != nil {
+		return "", err
 	}
-	resp, err := md.Complete(prompt, user, ctx...)
+	resp, err := Run(context.Background(), md, &Request{
+		Prompt:  prompt,
+		User:    user,
+		Context: ctx,
+		Tools:   ListTools(),
+	})
 	if err != nil {
 		return "", err
 	}
-	return resp, nil
+	return resp.Reply, nil
 }
 
 // Stream a request
 func Stream(prompt, user string, ctx ...Context) (chan string, error) {
-	md, ok := Models[DefaultModel]
-	if !ok {
-		return nil, errors.New("Unsupported model")
+	md, err := GetModel(DefaultModel)
+	if err != nil {
+		return nil, err
 	}
-	ch, err := md.Stream(prompt, user, ctx...)
+	stream, err := RunStream(context.Background(), md, &Request{
+		Prompt:  prompt,
+		User:    user,
+		Context: ctx,
+		Tools:   ListTools(),
+	})
 	if err != nil {
 		log.Printf("Error creating chat stream: %v\n", err)
 		return nil, err
 	}
+
+	ch := make(chan string, 100)
+
+	go func() {
+		defer close(ch)
+
+		for rsp := range stream {
+			if len(rsp.Reply) > 0 {
+				ch <- rsp.Reply
+			}
+		}
+	}()
+
 	return ch, nil
 }
@@ -1,9 +1,17 @@
 package ai
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/asim/turbo/cache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -46,3 +54,1002 @@ func TestStream(t *testing.T) {
 		}
 	}
 }
+
+func TestGetModel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if !req.Stream {
+			json.NewEncoder(w).Encode(ollamaResponse{
+				Model:   req.Model,
+				Message: ollamaMessage{Role: "assistant", Content: "hello from " + req.Model},
+				Done:    true,
+			})
+			return
+		}
+
+		for _, word := range []string{"hello ", "from ", req.Model} {
+			json.NewEncoder(w).Encode(ollamaResponse{
+				Model:   req.Model,
+				Message: ollamaMessage{Role: "assistant", Content: word},
+			})
+		}
+		json.NewEncoder(w).Encode(ollamaResponse{Model: req.Model, Done: true})
+	}))
+	defer srv.Close()
+
+	err := Register(NewOllama(Config{
+		URL:    srv.URL,
+		Models: []string{"llama3"},
+	}))
+	assert.NoError(t, err)
+
+	// registered model
+	md, err := GetModel("ollama/llama3")
+	assert.NoError(t, err)
+	assert.Equal(t, "llama3", md.String())
+
+	resp, err := md.Complete(context.TODO(), &Request{Prompt: "Hello", User: "User"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello from llama3", resp.Reply)
+
+	// unlisted model of a registered provider
+	md, err = GetModel("ollama/mistral")
+	assert.NoError(t, err)
+
+	ch, err := md.Stream(context.TODO(), &Request{Prompt: "Hello", User: "User"})
+	assert.NoError(t, err)
+
+	var reply string
+	for rsp := range ch {
+		reply += rsp.Reply
+	}
+	assert.Equal(t, "hello from mistral", reply)
+
+	// unknown provider
+	_, err = GetModel("foobar/llama3")
+	assert.Equal(t, ErrUnsupportedModel, err)
+}
+
+func TestTokens(t *testing.T) {
+	// BPE token count rather than characters
+	assert.Equal(t, 2, Tokens("gpt-4", "hello world"))
+	assert.Equal(t, 2, Tokens("gpt-4o", "hello world"))
+
+	// longest prefix wins
+	assert.Equal(t, 32768, GetLimit("gpt-4-32k-0613").Context)
+	assert.Equal(t, 8192, GetLimit("gpt-4-0613").Context)
+	assert.Equal(t, DefaultLimit, GetLimit("unknown").Context)
+}
+
+func TestMessages(t *testing.T) {
+	Limits["test-model"] = Limit{Context: 100, Output: 20, Encoding: DefaultEncoding}
+	defer delete(Limits, "test-model")
+
+	var ctx []Context
+	for i := 0; i < 10; i++ {
+		ctx = append(ctx, Context{
+			Prompt: fmt.Sprintf("prompt %d", i),
+			Reply:  fmt.Sprintf("reply %d", i),
+		})
+	}
+
+	msgs := messages("test-model", &Request{
+		Prompt:  "next prompt",
+		System:  "You are a helpful assistant",
+		Context: ctx,
+	})
+
+	// trimmed to fit the budget
+	assert.Less(t, len(msgs), 21)
+	assert.LessOrEqual(t, countTokens("test-model", msgs...)+3, 80)
+
+	// system prompt is first
+	assert.Equal(t, "system", msgs[0].Role)
+	assert.Equal(t, "You are a helpful assistant", msgs[0].Content)
+
+	// newest turns are kept
+	assert.Equal(t, "next prompt", msgs[len(msgs)-1].Content)
+	assert.Equal(t, "reply 9", msgs[len(msgs)-2].Content)
+	assert.Equal(t, "prompt 9", msgs[len(msgs)-3].Content)
+
+	// summary follows the system prompt
+	msgs = messages("test-model", &Request{
+		Prompt:  "next prompt",
+		System:  "You are a helpful assistant",
+		Summary: "We agreed on Go",
+		Context: ctx,
+	})
+	assert.Equal(t, "system", msgs[1].Role)
+	assert.Contains(t, msgs[1].Content, "We agreed on Go")
+	assert.LessOrEqual(t, countTokens("test-model", msgs...)+3, 80)
+}
+
+func TestTools(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		last := req.Messages[len(req.Messages)-1]
+
+		// reply with the tool result
+		if last.Role == "tool" {
+			json.NewEncoder(w).Encode(ollamaResponse{
+				Message: ollamaMessage{Role: "assistant", Content: "It's " + last.Content},
+				Done:    true,
+			})
+			return
+		}
+
+		// call the tool
+		var call ollamaToolCall
+		call.Function.Name = req.Tools[0].Function.Name
+		call.Function.Arguments = json.RawMessage(`{"city":"London"}`)
+
+		json.NewEncoder(w).Encode(ollamaResponse{
+			Message: ollamaMessage{Role: "assistant", ToolCalls: []ollamaToolCall{call}},
+			Done:    true,
+		})
+	}))
+	defer srv.Close()
+
+	err := RegisterTool(&Tool{
+		Name:        "weather",
+		Description: "Get the weather for a city",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}}}`),
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			var v struct {
+				City string `json:"city"`
+			}
+			if err := json.Unmarshal(args, &v); err != nil {
+				return "", err
+			}
+			return "raining in " + v.City, nil
+		},
+	})
+	assert.NoError(t, err)
+	defer delete(Tools, "weather")
+
+	md, err := NewOllama(Config{URL: srv.URL}).Model("llama3")
+	assert.NoError(t, err)
+
+	rsp, err := Run(context.TODO(), md, &Request{Prompt: "What's the weather?", Tools: ListTools()})
+	assert.NoError(t, err)
+	assert.Equal(t, "It's raining in London", rsp.Reply)
+	assert.Len(t, rsp.ToolCalls, 1)
+	assert.Equal(t, "raining in London", rsp.ToolCalls[0].Result)
+
+	ch, err := RunStream(context.TODO(), md, &Request{Prompt: "What's the weather?", Tools: ListTools()})
+	assert.NoError(t, err)
+
+	var calls []ToolCall
+	var reply string
+	for rsp := range ch {
+		calls = append(calls, rsp.ToolCalls...)
+		reply += rsp.Reply
+	}
+	assert.Equal(t, "It's raining in London", reply)
+	assert.Len(t, calls, 1)
+
+	// the request isn't changed
+	req := &Request{Prompt: "What's the weather?", Tools: ListTools()}
+	_, err = Run(context.TODO(), md, req)
+	assert.NoError(t, err)
+	assert.Empty(t, req.Calls)
+
+	// a model which keeps calling tools
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call ollamaToolCall
+		call.Function.Name = "weather"
+		call.Function.Arguments = json.RawMessage(`{"city":"London"}`)
+
+		json.NewEncoder(w).Encode(ollamaResponse{
+			Message: ollamaMessage{Role: "assistant", ToolCalls: []ollamaToolCall{call}},
+			Done:    true,
+		})
+	}))
+	defer loop.Close()
+
+	defer func(n int) {
+		MaxToolRounds = n
+	}(MaxToolRounds)
+
+	MaxToolRounds = 1
+
+	md, err = NewOllama(Config{URL: loop.URL}).Model("llama3")
+	assert.NoError(t, err)
+
+	_, err = Run(context.TODO(), md, req)
+	assert.Equal(t, ErrToolRounds, err)
+	assert.Empty(t, req.Calls)
+
+	ch, err = RunStream(context.TODO(), md, req)
+	assert.NoError(t, err)
+
+	var finish string
+	for rsp := range ch {
+		if len(rsp.FinishReason) > 0 {
+			finish = rsp.FinishReason
+		}
+	}
+	assert.Equal(t, FinishToolRounds, finish)
+	assert.Empty(t, req.Calls)
+}
+
+func TestRetry(t *testing.T) {
+	var calls int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		// rate limited twice
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+
+		var req ollamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		json.NewEncoder(w).Encode(ollamaResponse{
+			Model:   req.Model,
+			Message: ollamaMessage{Role: "assistant", Content: req.Messages[0].Content},
+			Done:    true,
+		})
+	}))
+	defer srv.Close()
+
+	md, err := NewOllama(Config{URL: srv.URL}).Model("llama3")
+	assert.NoError(t, err)
+
+	resp, err := md.Complete(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", resp.Reply)
+	assert.Equal(t, 3, calls)
+
+	// jittered backoff stays within the cap
+	for i := 0; i < 10; i++ {
+		d := backoff(i, nil)
+		assert.True(t, d >= 0 && d <= MaxBackoff)
+	}
+
+	// retry after in seconds
+	rsp := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	assert.Equal(t, 2*time.Second, backoff(0, rsp))
+}
+
+func TestFallback(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		json.NewEncoder(w).Encode(ollamaResponse{
+			Model:   req.Model,
+			Message: ollamaMessage{Role: "assistant", Content: "hello from " + req.Model},
+			Done:    true,
+		})
+	}))
+	defer up.Close()
+
+	retries := Retries
+	Retries = 0
+	defer func() { Retries = retries }()
+
+	primary, _ := NewOllama(Config{URL: down.URL}).Model("big")
+	secondary, _ := NewOllama(Config{URL: up.URL}).Model("small")
+
+	providerMtx.Lock()
+	Models["test-primary"] = primary
+	Models["test-secondary"] = secondary
+	providerMtx.Unlock()
+
+	SetFallbacks("test-primary", "test-missing", "test-secondary")
+	defer SetFallbacks("test-primary")
+
+	defer func() {
+		providerMtx.Lock()
+		delete(Models, "test-vision")
+		providerMtx.Unlock()
+	}()
+
+	md, err := GetModel("test-primary")
+	assert.NoError(t, err)
+	assert.Equal(t, "big", md.String())
+
+	resp, err := md.Complete(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello from small", resp.Reply)
+	assert.Equal(t, "test-secondary", resp.Model)
+
+	ch, err := md.Stream(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+
+	var reply, model string
+	for rsp := range ch {
+		reply += rsp.Reply
+		model = rsp.Model
+	}
+	assert.Equal(t, "hello from small", reply)
+	assert.Equal(t, "test-secondary", model)
+
+	// fallbacks without vision are skipped for images
+	vision, _ := NewOllama(Config{URL: up.URL}).Model("llava")
+
+	providerMtx.Lock()
+	Models["test-vision"] = vision
+	providerMtx.Unlock()
+
+	SetFallbacks("test-primary", "test-secondary", "test-vision")
+
+	md, err = GetModel("test-primary")
+	assert.NoError(t, err)
+
+	resp, err = md.Complete(context.TODO(), &Request{Prompt: "Hello", Images: []Image{{MimeType: "image/png", Data: []byte{1}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello from llava", resp.Reply)
+	assert.Equal(t, "test-vision", resp.Model)
+
+	// no fallbacks fails as is
+	md, err = GetModel("test-secondary")
+	assert.NoError(t, err)
+	assert.Equal(t, "small", md.String())
+}
+
+func TestEmbed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/embed", r.URL.Path)
+
+		var req ollamaEmbedRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var rsp ollamaEmbedResponse
+		for _, in := range req.Input {
+			rsp.Embeddings = append(rsp.Embeddings, []float32{float32(len(in)), 1})
+		}
+		json.NewEncoder(w).Encode(rsp)
+	}))
+	defer srv.Close()
+
+	err := Register(NewOllama(Config{URL: srv.URL}))
+	assert.NoError(t, err)
+
+	vecs, err := Embed(context.TODO(), "ollama/nomic-embed-text", "a", "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 1}, {3, 1}}, vecs)
+
+	// anthropic doesn't do embeddings
+	err = Register(NewAnthropic(Config{}))
+	assert.NoError(t, err)
+
+	_, err = Embed(context.TODO(), "anthropic/claude", "a")
+	assert.Equal(t, ErrUnsupportedEmbeddings, err)
+}
+
+func TestChunk(t *testing.T) {
+	text := "First paragraph.\n\nSecond paragraph.\n\n" + strings.Repeat("word ", 50)
+
+	// paragraphs fit in one chunk
+	chunks := Chunk(text, 100)
+	assert.Len(t, chunks, 1)
+	assert.True(t, strings.HasPrefix(chunks[0], "First paragraph.\n\nSecond paragraph."))
+
+	// long paragraphs are split by words
+	chunks = Chunk(text, 20)
+	assert.Equal(t, "First paragraph.\n\nSecond paragraph.", chunks[0])
+	for _, c := range chunks {
+		assert.True(t, Tokens(DefaultEmbedModel, c) <= 20)
+	}
+	assert.Equal(t, 50, strings.Count(strings.Join(chunks[1:], " "), "word"))
+
+	assert.Empty(t, Chunk("  \n\n ", 10))
+}
+
+func TestIsPrompt(t *testing.T) {
+	// 1:1 chats are always prompted
+	agent, ok := IsPrompt("hello", 1)
+	assert.True(t, ok)
+	assert.Equal(t, DefaultAgent, agent)
+
+	// group chats need a mention
+	_, ok = IsPrompt("hello everyone", 3)
+	assert.False(t, ok)
+
+	agent, ok = IsPrompt("hey @ChatGPT what's up", 3)
+	assert.True(t, ok)
+	assert.Equal(t, "chatgpt", agent)
+
+	// whole aliases only
+	_, ok = IsPrompt("ping @chatgpt4", 3)
+	assert.False(t, ok)
+
+	// first mentioned wins
+	agent, ok = IsPrompt("@reviewer and @coder please look", 3, "coder", "reviewer")
+	assert.True(t, ok)
+	assert.Equal(t, "reviewer", agent)
+
+	assert.Equal(t, []string{"reviewer", "coder"}, Mentions("@reviewer @coder @reviewer @nobody", "coder", "reviewer"))
+}
+
+func TestParams(t *testing.T) {
+	temp := float32(0)
+	hot := float32(1.5)
+	tokens := 100
+	seed := 42
+
+	chat := Params{Temperature: &hot, Seed: &seed}
+	prompt := Params{Temperature: &temp, MaxTokens: &tokens}
+
+	// prompt overrides the chat
+	p := chat.Merge(prompt)
+	assert.Equal(t, float32(0), *p.Temperature)
+	assert.Equal(t, 100, *p.MaxTokens)
+	assert.Equal(t, 42, *p.Seed)
+
+	assert.NoError(t, p.Validate("gpt-4"))
+
+	// per model limits
+	assert.NoError(t, Params{Temperature: &hot}.Validate("gpt-4"))
+	assert.Error(t, Params{Temperature: &hot}.Validate("claude-3-opus"))
+
+	tokens = 10000
+	assert.Error(t, Params{MaxTokens: &tokens}.Validate("gpt-4"))
+	assert.NoError(t, Params{MaxTokens: &tokens}.Validate("gpt-4o"))
+
+	assert.Error(t, Params{Stop: []string{"a", "b", "c", "d", "e"}}.Validate("gpt-4"))
+
+	// zero temperature is still sent
+	tokens = 100
+	creq := complete("gpt-4", &Request{Prompt: "hi", Params: &p})
+	assert.True(t, creq.Temperature > 0 && creq.Temperature < 1e-30)
+	assert.Equal(t, 100, creq.MaxTokens)
+	assert.Equal(t, 42, *creq.Seed)
+
+	// max tokens are reserved from the budget
+	areq := (&anthropicModel{model: "claude-3"}).request(&Request{Prompt: "hi", Params: &p})
+	assert.Equal(t, 100, areq.MaxTokens)
+	assert.Equal(t, float32(0), *areq.Temperature)
+}
+
+func TestMock(t *testing.T) {
+	model := DefaultModel
+	DefaultModel = "mock"
+	defer func() { DefaultModel = model }()
+
+	// echo through the top level funcs
+	resp, err := Complete("Hello", "User")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", resp)
+
+	ch, err := Stream("Hello there world", "User")
+	assert.NoError(t, err)
+
+	var words []string
+	for word := range ch {
+		words = append(words, word)
+	}
+	assert.Equal(t, []string{"Hello ", "there ", "world"}, words)
+
+	// scripted replies in order
+	MockScript(
+		MockReply{Reply: "first"},
+		MockReply{Err: fmt.Errorf("upstream error")},
+	)
+	defer MockReset()
+
+	resp, err = Complete("Hello", "User")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", resp)
+
+	_, err = Complete("Hello", "User")
+	assert.EqualError(t, err, "upstream error")
+
+	// deterministic lorem text
+	md, err := GetModel("mock/lorem")
+	assert.NoError(t, err)
+
+	seed := 1
+	words10 := 10
+	r1, _ := md.Complete(context.TODO(), &Request{Prompt: "Hi"})
+	r2, _ := md.Complete(context.TODO(), &Request{Prompt: "Hi"})
+	r3, _ := md.Complete(context.TODO(), &Request{Prompt: "Hi", Params: &Params{Seed: &seed, MaxTokens: &words10}})
+	assert.Equal(t, r1.Reply, r2.Reply)
+	assert.Len(t, strings.Fields(r1.Reply), MockWords)
+	assert.Len(t, strings.Fields(r3.Reply), 10)
+	assert.NotEqual(t, r1.Reply, r3.Reply)
+
+	// delayed streams stop when cancelled
+	MockDelay = 50 * time.Millisecond
+	defer func() { MockDelay = 0 }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch2, err := md.Stream(ctx, &Request{Prompt: "Hi"})
+	assert.NoError(t, err)
+
+	<-ch2
+	cancel()
+
+	var n int
+	for range ch2 {
+		n++
+	}
+	assert.Less(t, n, MockWords-1)
+
+	// scripted tool calls run through the tool loop
+	RegisterTool(&Tool{
+		Name: "add",
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			return "3", nil
+		},
+	})
+	defer func() {
+		toolMtx.Lock()
+		delete(Tools, "add")
+		toolMtx.Unlock()
+	}()
+
+	MockScript(MockReply{ToolCalls: []ToolCall{{ID: "1", Name: "add", Arguments: `{"a":1,"b":2}`}}})
+
+	rsp, err := Run(context.TODO(), md, &Request{Prompt: "1+2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "3", rsp.Reply)
+	assert.Len(t, rsp.ToolCalls, 1)
+}
+
+func TestUsage(t *testing.T) {
+	// priced by the longest model prefix
+	p, ok := GetPrice("gpt-4o-mini-2024-07-18")
+	assert.True(t, ok)
+	assert.Equal(t, Prices["gpt-4o-mini"], p)
+
+	_, ok = GetPrice("llama3")
+	assert.False(t, ok)
+
+	SetPrice("test-model", Price{Prompt: 1, Completion: 2})
+	defer delete(Prices, "test-model")
+
+	u := Usage{PromptTokens: 1000000, CompletionTokens: 500000}
+	assert.Equal(t, 2.0, Cost("test-model", u))
+	assert.Equal(t, 0.0, Cost("llama3", u))
+
+	md, err := GetModel("mock")
+	assert.NoError(t, err)
+
+	r1, err := md.Complete(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.NotNil(t, r1.Usage)
+	assert.True(t, r1.Usage.PromptTokens > 0)
+	assert.Equal(t, r1.Usage.PromptTokens+r1.Usage.CompletionTokens, r1.Usage.TotalTokens)
+
+	// summed across tool rounds
+	MockScript(
+		MockReply{ToolCalls: []ToolCall{{ID: "1", Name: "missing"}}},
+		MockReply{Reply: "done"},
+	)
+	defer MockReset()
+
+	rsp, err := Run(context.TODO(), md, &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "done", rsp.Reply)
+	assert.True(t, rsp.Usage.PromptTokens > r1.Usage.PromptTokens)
+
+	// sent at the end of a stream
+	ch, err := md.Stream(context.TODO(), &Request{Prompt: "Hello world"})
+	assert.NoError(t, err)
+
+	var usage *Usage
+	for rsp := range ch {
+		if rsp.Usage != nil {
+			usage = rsp.Usage
+		}
+	}
+	assert.NotNil(t, usage)
+	assert.Equal(t, Tokens("mock-echo", "Hello world"), usage.CompletionTokens)
+}
+
+func TestImages(t *testing.T) {
+	img := Image{ID: "file-1", MimeType: "image/png", Data: []byte("png")}
+
+	// images of the context are only sent once loaded
+	req := &Request{
+		Prompt: "what is this",
+		Images: []Image{img},
+		Context: []Context{
+			{Prompt: "first", Reply: "ok", Images: []Image{{ID: "file-0"}}},
+			{Prompt: "second", Reply: "ok", Images: []Image{img}},
+		},
+	}
+
+	msgs := messages("gpt-4o", req)
+	assert.Empty(t, msgs[len(msgs)-5].Images)
+	assert.Len(t, msgs[len(msgs)-3].Images, 1)
+	assert.Len(t, msgs[len(msgs)-1].Images, 1)
+
+	// no images for models without vision
+	msgs = messages("gpt-3.5-turbo", req)
+	assert.Empty(t, msgs[len(msgs)-3].Images)
+
+	// openai multi part content
+	cr := complete("gpt-4o", req)
+	last := cr.Messages[len(cr.Messages)-1]
+	assert.Empty(t, last.Content)
+	assert.Len(t, last.MultiContent, 2)
+	assert.Equal(t, "what is this", last.MultiContent[0].Text)
+	assert.Equal(t, "data:image/png;base64,cG5n", last.MultiContent[1].ImageURL.URL)
+
+	// the cached context doesn't hold the data
+	b, err := json.Marshal(req.Context[1])
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "cG5n")
+
+	// rejected by models without vision
+	assert.True(t, SupportsVision("mock"))
+	assert.False(t, SupportsVision("gpt-3.5-turbo"))
+
+	md, err := NewOllama(Config{URL: "http://localhost:11434"}).Model("llama3")
+	assert.NoError(t, err)
+
+	_, err = Run(context.Background(), md, &Request{Prompt: "what is this", Images: []Image{img}})
+	assert.ErrorIs(t, err, ErrNoVision)
+
+	// the mock sees the images
+	md, err = GetModel("mock")
+	assert.NoError(t, err)
+
+	rsp, err := Run(context.Background(), md, &Request{Prompt: "what is this", Images: []Image{img}})
+	assert.NoError(t, err)
+	assert.Contains(t, rsp.Reply, "[image image/png]")
+}
+
+func TestSchema(t *testing.T) {
+	type Item struct {
+		Name  string `json:"name"`
+		Price int    `json:"price"`
+	}
+	type Order struct {
+		ID     string `json:"id"`
+		Status string `json:"status" enum:"open,closed"`
+		Items  []Item `json:"items"`
+	}
+
+	schema, err := SchemaFor(&Order{})
+	assert.NoError(t, err)
+	assert.NoError(t, ParseSchema(schema))
+	assert.Error(t, ParseSchema(json.RawMessage(`[1`)))
+
+	valid := `{"id":"1","status":"open","items":[{"name":"tea","price":2}]}`
+	assert.Empty(t, ValidateSchema(schema, []byte(valid)))
+
+	errs := ValidateSchema(schema, []byte(`{"id":1,"status":"lost","items":[{"name":"tea","price":2.5,"size":"L"}]}`))
+	assert.Equal(t, []string{
+		"$.id: expected string got number",
+		"$.items[0].price: expected integer got number",
+		"$.items[0]: unexpected property size",
+		"$.status: must be one of [open closed]",
+	}, errs)
+
+	errs = ValidateSchema(schema, []byte(`{"id":"1"}`))
+	assert.Contains(t, errs, "$: missing required property items")
+	assert.Contains(t, ValidateSchema(schema, []byte(`not json`))[0], "invalid JSON")
+
+	// refs, bounds and code fences
+	ref := json.RawMessage(`{"$defs":{"n":{"type":"number","minimum":1,"maximum":5}},"type":"array","maxItems":2,"items":{"$ref":"#/$defs/n"}}`)
+	assert.Empty(t, ValidateSchema(ref, []byte(trimJSON("```json\n[1, 5]\n```"))))
+	assert.Len(t, ValidateSchema(ref, []byte(`[0, 6, 3]`)), 3)
+
+	// the schema is in the system prompt and openai json mode is used
+	req := &Request{Prompt: "latest order", Schema: schema}
+	msgs := messages("gpt-4o", req)
+	assert.Equal(t, "system", msgs[0].Role)
+	assert.Contains(t, msgs[0].Content, string(schema))
+	assert.Equal(t, "json_object", string(complete("gpt-4o", req).ResponseFormat.Type))
+
+	md, err := GetModel("mock")
+	assert.NoError(t, err)
+
+	// fixed after the validation errors
+	MockScript(
+		MockReply{Reply: `{"id":"1","status":"lost","items":[]}`},
+		MockReply{Reply: "```json\n" + valid + "\n```"},
+	)
+	defer MockReset()
+
+	var order Order
+	rsp, err := RunJSON(context.Background(), md, &Request{Prompt: "latest order"}, &order)
+	assert.NoError(t, err)
+	assert.Equal(t, valid, rsp.Reply)
+	assert.Equal(t, "open", order.Status)
+	assert.Equal(t, []Item{{Name: "tea", Price: 2}}, order.Items)
+	assert.Greater(t, rsp.Usage.PromptTokens, 0)
+
+	// gives up after the retries
+	MockScript(MockReply{Reply: "no"}, MockReply{Reply: "no"}, MockReply{Reply: "no"})
+
+	_, err = Run(context.Background(), md, &Request{Prompt: "latest order", Schema: schema})
+	assert.ErrorIs(t, err, ErrSchema)
+
+	// streamed once valid
+	MockScript(MockReply{Reply: "{}"}, MockReply{Reply: valid})
+
+	ch, err := RunStream(context.Background(), md, &Request{Prompt: "latest order", Schema: schema})
+	assert.NoError(t, err)
+
+	var reply string
+	var usage *Usage
+	for rsp := range ch {
+		reply += rsp.Reply
+		if rsp.Usage != nil {
+			usage = rsp.Usage
+		}
+	}
+	assert.Equal(t, valid, reply)
+	assert.NotNil(t, usage)
+}
+
+func TestCache(t *testing.T) {
+	cache.Init("")
+
+	CacheTTL = time.Minute
+	defer func() { CacheTTL = 0 }()
+
+	ResetCacheStats()
+	defer MockReset()
+
+	md, err := GetModel("mock")
+	assert.NoError(t, err)
+
+	zero := float32(0)
+	req := func(prompt string) *Request {
+		return &Request{Prompt: prompt, Params: &Params{Temperature: &zero}}
+	}
+
+	// cached once answered
+	MockScript(MockReply{Reply: "first answer"}, MockReply{Reply: "second answer"})
+
+	rsp, err := md.Complete(context.Background(), req("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first answer", rsp.Reply)
+	assert.False(t, rsp.Cached)
+
+	rsp, err = md.Complete(context.Background(), req("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first answer", rsp.Reply)
+	assert.True(t, rsp.Cached)
+	assert.Nil(t, rsp.Usage)
+
+	// replayed as a stream
+	ch, err := md.Stream(context.Background(), req("hello"))
+	assert.NoError(t, err)
+
+	var words []string
+	var reason string
+	for rsp := range ch {
+		assert.True(t, rsp.Cached)
+		if len(rsp.FinishReason) > 0 {
+			reason = rsp.FinishReason
+			continue
+		}
+		words = append(words, rsp.Reply)
+	}
+	assert.Equal(t, []string{"first ", "answer"}, words)
+	assert.Equal(t, FinishStop, reason)
+
+	// streamed replies are cached too
+	ch, err = md.Stream(context.Background(), req("hello there"))
+	assert.NoError(t, err)
+	for range ch {
+	}
+
+	rsp, err = md.Complete(context.Background(), req("hello there"))
+	assert.NoError(t, err)
+	assert.Equal(t, "second answer", rsp.Reply)
+	assert.True(t, rsp.Cached)
+
+	// other params are another key
+	one := float32(1)
+	seed := 7
+	rsp, err = md.Complete(context.Background(), &Request{Prompt: "hello", Params: &Params{Temperature: &one, Seed: &seed}})
+	assert.NoError(t, err)
+	assert.False(t, rsp.Cached)
+
+	// non-deterministic or opted out requests aren't cached
+	rsp, err = md.Complete(context.Background(), &Request{Prompt: "hello"})
+	assert.NoError(t, err)
+	assert.False(t, rsp.Cached)
+
+	r := req("hello")
+	r.NoCache = true
+	rsp, err = md.Complete(context.Background(), r)
+	assert.NoError(t, err)
+	assert.False(t, rsp.Cached)
+
+	stats := GetCacheStats()
+	assert.Equal(t, int64(3), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, int64(2), stats.Bypassed)
+	assert.Greater(t, stats.Saved.TotalTokens, 0)
+}
+
+func TestFinishReason(t *testing.T) {
+	assert.Equal(t, FinishStop, finishReason("end_turn"))
+	assert.Equal(t, FinishLength, finishReason("max_tokens"))
+	assert.Equal(t, FinishToolCalls, finishReason("tool_use"))
+	assert.Equal(t, FinishLength, finishReason("length"))
+
+	md, err := GetModel("mock")
+	assert.NoError(t, err)
+
+	rsp, err := md.Complete(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, FinishStop, rsp.FinishReason)
+
+	// sent at the end of a stream
+	last := func(ch chan *Response) (reason string) {
+		for rsp := range ch {
+			if len(rsp.FinishReason) > 0 {
+				reason = rsp.FinishReason
+			}
+		}
+		return
+	}
+
+	ch, err := md.Stream(context.TODO(), &Request{Prompt: "Hello world"})
+	assert.NoError(t, err)
+	assert.Equal(t, FinishStop, last(ch))
+
+	// truncated ollama reply
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Hello"}}`)
+		fmt.Fprintln(w, `{"done":true,"done_reason":"length","eval_count":1}`)
+	}))
+	defer srv.Close()
+
+	md, err = NewOllama(Config{URL: srv.URL}).Model("llama3")
+	assert.NoError(t, err)
+
+	ch, err = md.Stream(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, FinishLength, last(ch))
+
+	// anthropic stop reason of the message delta
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"Hello"}}`)
+		fmt.Fprintln(w, `data: {"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":1}}`)
+		fmt.Fprintln(w, `data: {"type":"message_stop"}`)
+	}))
+	defer srv2.Close()
+
+	md, err = NewAnthropic(Config{URL: srv2.URL, Key: "key"}).Model("claude-3-haiku")
+	assert.NoError(t, err)
+
+	ch, err = md.Stream(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, FinishLength, last(ch))
+}
+
+// a provider registered under another name
+type namedProvider struct {
+	*ollamaProvider
+	name string
+}
+
+func (p *namedProvider) String() string {
+	return p.name
+}
+
+func TestDiscover(t *testing.T) {
+	tags := `{"models":[{"name":"llama3:latest"},{"name":"mistral:7b"},{"name":"nomic-embed-text:latest"}]}`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/tags" {
+			fmt.Fprint(w, tags)
+			return
+		}
+		var req ollamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(ollamaResponse{
+			Message: ollamaMessage{Role: "assistant", Content: req.Model},
+			Done:    true,
+		})
+	}))
+	defer srv.Close()
+
+	p := &namedProvider{NewOllama(Config{URL: srv.URL, Models: []string{"phi3"}}).(*ollamaProvider), "local"}
+	assert.NoError(t, Register(p))
+
+	defer func() {
+		SetRules(nil, nil)
+		SetAliases(nil)
+
+		providerMtx.Lock()
+		delete(Providers, "local")
+		delete(discovered, "local")
+		for name := range Models {
+			if strings.HasPrefix(name, "local/") {
+				delete(Models, name)
+			}
+		}
+		providerMtx.Unlock()
+	}()
+
+	// any model until discovered
+	_, err := GetModel("local/other")
+	assert.NoError(t, err)
+
+	names, err := p.ListModels(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"llama3", "mistral:7b", "nomic-embed-text"}, names)
+	assert.NoError(t, setDiscovered(p, names))
+
+	// only the chat models
+	_, err = GetModel("local/nomic-embed-text")
+	assert.Equal(t, ErrUnsupportedModel, err)
+	assert.False(t, isChatModel("text-embedding-3-small"))
+	assert.False(t, isChatModel("tts-1"))
+	assert.False(t, isChatModel("whisper-1"))
+	assert.False(t, isChatModel("dall-e-3"))
+	assert.False(t, isChatModel("omni-moderation-latest"))
+	assert.True(t, isChatModel("gpt-4o"))
+
+	md, err := GetModel("local/mistral:7b")
+	assert.NoError(t, err)
+	assert.Equal(t, "mistral:7b", md.String())
+
+	// configured models are kept
+	_, err = GetModel("local/phi3")
+	assert.NoError(t, err)
+
+	_, err = GetModel("local/other")
+	assert.Equal(t, ErrUnsupportedModel, err)
+
+	// removed once no longer listed
+	assert.NoError(t, setDiscovered(p, []string{"llama3"}))
+	_, err = GetModel("local/mistral:7b")
+	assert.Equal(t, ErrUnsupportedModel, err)
+
+	// denied by pattern
+	SetRules(nil, []string{"local/llama*"})
+	_, err = GetModel("local/llama3")
+	assert.Equal(t, ErrModelNotAllowed, err)
+
+	// only those allowed
+	SetRules([]string{"local/*"}, nil)
+	_, err = GetModel("local/llama3")
+	assert.NoError(t, err)
+	_, err = GetModel("mock")
+	assert.Equal(t, ErrModelNotAllowed, err)
+
+	// aliased by the admin
+	SetAliases(map[string]string{"fast": "local/llama3"})
+
+	md, err = GetModel("fast")
+	assert.NoError(t, err)
+
+	rsp, err := md.Complete(context.TODO(), &Request{Prompt: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "llama3", rsp.Reply)
+
+	var found bool
+	for _, info := range ListModels() {
+		switch info.Name {
+		case "fast":
+			found = true
+			assert.Equal(t, "local/llama3", info.Alias)
+			assert.True(t, info.Allowed)
+		case "mock":
+			assert.False(t, info.Allowed)
+		}
+	}
+	assert.True(t, found)
+
+	// the alias is denied with its model
+	SetRules(nil, []string{"local/llama3"})
+	_, err = GetModel("fast")
+	assert.Equal(t, ErrModelNotAllowed, err)
+}
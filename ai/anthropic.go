@@ -0,0 +1,429 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// DefaultAnthropicURL is the url of the anthropic messages api
+	DefaultAnthropicURL = "https://api.anthropic.com"
+
+	// AnthropicVersion sent as the anthropic-version header
+	AnthropicVersion = "2023-06-01"
+)
+
+// anthropic style messages api
+type anthropicProvider struct {
+	key    string
+	url    string
+	client *http.Client
+	models []string
+}
+
+type anthropicModel struct {
+	provider *anthropicProvider
+	model    string
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	Messages  []anthropicMessage `json:"messages"`
+	System    string             `json:"system,omitempty"`
+	MaxTokens int                `json:"max_tokens"`
+	Stream    bool               `json:"stream,omitempty"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+
+	Temperature   *float32 `json:"temperature,omitempty"`
+	TopP          *float32 `json:"top_p,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+type anthropicContent struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	Source    *anthropicImage `json:"source,omitempty"`
+}
+
+type anthropicImage struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicContent `json:"content"`
+	StopReason string             `json:"stop_reason"`
+	Usage      anthropicUsage     `json:"usage"`
+}
+
+type anthropicEvent struct {
+	Type         string           `json:"type"`
+	Index        int              `json:"index"`
+	ContentBlock anthropicContent `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+	// input tokens are sent at the start, output tokens at the end
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+// NewAnthropic returns a provider for an anthropic style messages api
+func NewAnthropic(cfg Config) Provider {
+	if len(cfg.URL) == 0 {
+		cfg.URL = DefaultAnthropicURL
+	}
+	return &anthropicProvider{
+		key:    cfg.Key,
+		url:    strings.TrimSuffix(cfg.URL, "/"),
+		client: newClient(),
+		models: cfg.Models,
+	}
+}
+
+func (p *anthropicProvider) Models() []string {
+	return p.models
+}
+
+// ListModels returns the models of the upstream /v1/models
+func (p *anthropicProvider) ListModels(ctx context.Context) ([]string, error) {
+	hreq, err := http.NewRequestWithContext(ctx, "GET", p.url+"/v1/models?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("x-api-key", p.key)
+	hreq.Header.Set("anthropic-version", AnthropicVersion)
+
+	rsp, err := p.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("anthropic error %d: %s", rsp.StatusCode, string(b))
+	}
+
+	var r struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, m := range r.Data {
+		names = append(names, m.ID)
+	}
+
+	return names, nil
+}
+
+func (p *anthropicProvider) Model(name string) (Model, error) {
+	return &anthropicModel{provider: p, model: name}, nil
+}
+
+func (p *anthropicProvider) String() string {
+	return "anthropic"
+}
+
+func (p *anthropicProvider) do(ctx context.Context, req *anthropicRequest) (*http.Response, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, "POST", p.url+"/v1/messages", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("x-api-key", p.key)
+	hreq.Header.Set("anthropic-version", AnthropicVersion)
+
+	rsp, err := p.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		b, _ := io.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("anthropic error %d: %s", rsp.StatusCode, string(b))
+	}
+
+	return rsp, nil
+}
+
+func (m *anthropicModel) request(req *Request) *anthropicRequest {
+	areq := &anthropicRequest{
+		Model:     m.model,
+		MaxTokens: req.Params.output(GetLimit(m.model)),
+	}
+
+	// penalties and seed aren't supported
+	if p := req.Params; p != nil {
+		areq.Temperature = p.Temperature
+		areq.TopP = p.TopP
+		areq.StopSequences = p.Stop
+	}
+
+	for _, msg := range messages(m.model, req) {
+		var content []anthropicContent
+
+		switch msg.Role {
+		case "system":
+			// the system prompt is a top level field
+			if len(areq.System) > 0 {
+				areq.System += "\n\n"
+			}
+			areq.System += msg.Content
+			continue
+		case "tool":
+			// tool results are sent by the user
+			content = append(content, anthropicContent{
+				Type:      "tool_result",
+				ToolUseID: msg.ToolCallID,
+				Content:   msg.Content,
+			})
+
+			// combine with the previous results
+			if last := len(areq.Messages) - 1; last >= 0 && areq.Messages[last].Content[0].Type == "tool_result" {
+				areq.Messages[last].Content = append(areq.Messages[last].Content, content...)
+				continue
+			}
+
+			areq.Messages = append(areq.Messages, anthropicMessage{Role: "user", Content: content})
+			continue
+		}
+
+		// images go before the text
+		for _, img := range msg.Images {
+			src := &anthropicImage{Type: "url", URL: img.URL}
+			if len(img.Data) > 0 {
+				src = &anthropicImage{Type: "base64", MediaType: img.MimeType, Data: img.base64()}
+			}
+			content = append(content, anthropicContent{
+				Type:   "image",
+				Source: src,
+			})
+		}
+
+		// text blocks must be non empty
+		if len(msg.Content) > 0 {
+			content = append(content, anthropicContent{
+				Type: "text",
+				Text: msg.Content,
+			})
+		}
+
+		for _, tc := range msg.ToolCalls {
+			input := json.RawMessage(tc.Arguments)
+			if len(input) == 0 {
+				input = json.RawMessage(`{}`)
+			}
+			content = append(content, anthropicContent{
+				Type:  "tool_use",
+				ID:    tc.ID,
+				Name:  tc.Name,
+				Input: input,
+			})
+		}
+
+		if len(content) == 0 {
+			continue
+		}
+
+		areq.Messages = append(areq.Messages, anthropicMessage{
+			Role:    msg.Role,
+			Content: content,
+		})
+	}
+
+	for _, t := range req.Tools {
+		areq.Tools = append(areq.Tools, anthropicTool{
+			Name:        t.Name,
+			Description: t.Description,
+			InputSchema: t.schema(),
+		})
+	}
+
+	return areq
+}
+
+func (m *anthropicModel) Complete(ctx context.Context, req *Request) (*Response, error) {
+	rsp, err := m.provider.do(ctx, m.request(req))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var r anthropicResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	res := &Response{
+		Usage:        newUsage(r.Usage.InputTokens, r.Usage.OutputTokens),
+		FinishReason: finishReason(r.StopReason),
+	}
+
+	for _, c := range r.Content {
+		switch c.Type {
+		case "text":
+			res.Reply += c.Text
+		case "tool_use":
+			res.ToolCalls = append(res.ToolCalls, ToolCall{
+				ID:        c.ID,
+				Name:      c.Name,
+				Arguments: string(c.Input),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func (m *anthropicModel) Stream(ctx context.Context, req *Request) (chan *Response, error) {
+	areq := m.request(req)
+	areq.Stream = true
+
+	rsp, err := m.provider.do(ctx, areq)
+	if err != nil {
+		log.Printf("Error creating anthropic stream: %v\n", err)
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer rsp.Body.Close()
+		defer close(ch)
+
+		// tool calls by content block index
+		calls := map[int]*ToolCall{}
+		var order []int
+
+		// tokens used
+		var usage anthropicUsage
+
+		// sent with the message delta
+		var reason string
+
+		// send any tool calls once the message is done
+		flush := func() {
+			var tcs []ToolCall
+			for _, i := range order {
+				tcs = append(tcs, *calls[i])
+			}
+			if len(tcs) > 0 {
+				ch <- &Response{ToolCalls: tcs}
+			}
+		}
+
+		// server sent events
+		scanner := bufio.NewScanner(rsp.Body)
+
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			var ev anthropicEvent
+			if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &ev); err != nil {
+				log.Printf("Error in anthropic stream: %v\n", err)
+				ch <- &Response{FinishReason: FinishError}
+				return
+			}
+
+			switch ev.Type {
+			case "message_start":
+				usage.InputTokens = ev.Message.Usage.InputTokens
+			case "message_delta":
+				usage.OutputTokens = ev.Usage.OutputTokens
+				reason = finishReason(ev.Delta.StopReason)
+			case "content_block_start":
+				if ev.ContentBlock.Type == "tool_use" {
+					calls[ev.Index] = &ToolCall{
+						ID:   ev.ContentBlock.ID,
+						Name: ev.ContentBlock.Name,
+					}
+					order = append(order, ev.Index)
+				}
+			case "content_block_delta":
+				if len(ev.Delta.Text) > 0 {
+					ch <- &Response{Reply: ev.Delta.Text}
+				}
+				if c, ok := calls[ev.Index]; ok {
+					c.Arguments += ev.Delta.PartialJSON
+				}
+			case "error":
+				log.Printf("Error in anthropic stream: %v\n", ev.Error.Message)
+				ch <- &Response{FinishReason: FinishError}
+				return
+			case "message_stop":
+				flush()
+				ch <- &Response{
+					Usage:        newUsage(usage.InputTokens, usage.OutputTokens),
+					FinishReason: reason,
+				}
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			log.Printf("Error in anthropic stream: %v\n", err)
+			ch <- &Response{FinishReason: FinishError}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (m *anthropicModel) String() string {
+	return m.model
+}
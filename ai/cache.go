@@ -0,0 +1,311 @@
+package ai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// CacheTTL enables caching of completions for the duration, 0 is disabled
+	CacheTTL time.Duration
+
+	// CachePrefix of the keys in the cache
+	CachePrefix = "ai:completion:"
+
+	stats    CacheStats
+	statsMtx sync.Mutex
+)
+
+// CacheStats are the hits and misses of the completion cache
+type CacheStats struct {
+	// Hits served from the cache
+	Hits int64 `json:"hits"`
+	// Misses sent to the model and cached
+	Misses int64 `json:"misses"`
+	// Bypassed are non-deterministic requests which aren't cached
+	Bypassed int64 `json:"bypassed"`
+	// Saved tokens by the hits
+	Saved Usage `json:"saved"`
+	// SavedCost is the estimated cost of the saved tokens
+	SavedCost float64 `json:"saved_cost"`
+}
+
+// cached model serves identical requests from the cache
+type cached struct {
+	model Model
+	ttl   time.Duration
+}
+
+// cachedResponse is what we store in the cache
+type cachedResponse struct {
+	Reply     string     `json:"reply"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Model     string     `json:"model,omitempty"`
+	Usage     *Usage     `json:"usage,omitempty"`
+	// why the reply finished
+	FinishReason string `json:"finish_reason,omitempty"`
+}
+
+// cacheKey is hashed from everything which changes the reply
+type cacheKey struct {
+	Model    string          `json:"model"`
+	Params   *Params         `json:"params,omitempty"`
+	Messages []cacheMessage  `json:"messages"`
+	Tools    []cacheTool     `json:"tools,omitempty"`
+	Schema   json.RawMessage `json:"schema,omitempty"`
+}
+
+type cacheMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	// hashes of the image data or urls
+	Images []string `json:"images,omitempty"`
+}
+
+type cacheTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// GetCacheStats returns the stats of the completion cache
+func GetCacheStats() CacheStats {
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	return stats
+}
+
+// ResetCacheStats sets the stats back to zero
+func ResetCacheStats() {
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	stats = CacheStats{}
+}
+
+func hit(model string, u *Usage) {
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	stats.Hits++
+	stats.Saved.Add(u)
+	if u != nil {
+		stats.SavedCost += Cost(model, *u)
+	}
+}
+
+func miss() {
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	stats.Misses++
+}
+
+func bypass() {
+	statsMtx.Lock()
+	defer statsMtx.Unlock()
+	stats.Bypassed++
+}
+
+// newCached wraps the model with the cache
+func newCached(md Model, ttl time.Duration) Model {
+	return &cached{model: md, ttl: ttl}
+}
+
+// cacheable requests are deterministic, a temperature of 0 or a seed
+func cacheable(req *Request) bool {
+	if req.NoCache || req.Params == nil {
+		return false
+	}
+	if t := req.Params.Temperature; t != nil && *t == 0 {
+		return true
+	}
+	return req.Params.Seed != nil
+}
+
+// key hashes the model, params, messages, tools and schema
+func (c *cached) key(req *Request) string {
+	model := c.model.String()
+
+	k := cacheKey{
+		Model:  model,
+		Params: req.Params,
+		Schema: req.Schema,
+	}
+
+	for _, m := range messages(model, req) {
+		cm := cacheMessage{
+			Role:       m.Role,
+			Content:    m.Content,
+			ToolCalls:  m.ToolCalls,
+			ToolCallID: m.ToolCallID,
+		}
+		for _, img := range m.Images {
+			sum := sha256.Sum256(append([]byte(img.URL), img.Data...))
+			cm.Images = append(cm.Images, hex.EncodeToString(sum[:]))
+		}
+		k.Messages = append(k.Messages, cm)
+	}
+
+	for _, t := range req.Tools {
+		k.Tools = append(k.Tools, cacheTool{
+			Name:        t.Name,
+			Description: t.Description,
+			Parameters:  t.Parameters,
+		})
+	}
+
+	b, _ := json.Marshal(k)
+	sum := sha256.Sum256(b)
+	return CachePrefix + hex.EncodeToString(sum[:])
+}
+
+// get a cached response
+func (c *cached) get(key string) (*cachedResponse, bool) {
+	var rsp cachedResponse
+	if err := cache.Get(key, &rsp); err != nil {
+		return nil, false
+	}
+	return &rsp, true
+}
+
+// set the response in the cache
+func (c *cached) set(key string, rsp *cachedResponse) {
+	if err := cache.SetTTL(key, rsp, c.ttl); err != nil {
+		log.Printf("Error caching completion: %v\n", err)
+	}
+}
+
+func (c *cached) Complete(ctx context.Context, req *Request) (*Response, error) {
+	if !cacheable(req) {
+		bypass()
+		return c.model.Complete(ctx, req)
+	}
+
+	key := c.key(req)
+
+	if rsp, ok := c.get(key); ok {
+		hit(c.model.String(), rsp.Usage)
+		return &Response{
+			Reply:        rsp.Reply,
+			ToolCalls:    rsp.ToolCalls,
+			Model:        rsp.Model,
+			Cached:       true,
+			FinishReason: rsp.FinishReason,
+		}, nil
+	}
+
+	miss()
+
+	rsp, err := c.model.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(key, &cachedResponse{
+		Reply:        rsp.Reply,
+		ToolCalls:    rsp.ToolCalls,
+		Model:        rsp.Model,
+		Usage:        rsp.Usage,
+		FinishReason: rsp.FinishReason,
+	})
+
+	return rsp, nil
+}
+
+func (c *cached) Stream(ctx context.Context, req *Request) (chan *Response, error) {
+	if !cacheable(req) {
+		bypass()
+		return c.model.Stream(ctx, req)
+	}
+
+	key := c.key(req)
+
+	// replay the cached reply
+	if rsp, ok := c.get(key); ok {
+		hit(c.model.String(), rsp.Usage)
+		return replay(ctx, rsp), nil
+	}
+
+	miss()
+
+	stream, err := c.model.Stream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer close(ch)
+
+		var reply strings.Builder
+		var rsp cachedResponse
+
+		for r := range stream {
+			reply.WriteString(r.Reply)
+			rsp.ToolCalls = append(rsp.ToolCalls, r.ToolCalls...)
+			if len(r.Model) > 0 {
+				rsp.Model = r.Model
+			}
+			if r.Usage != nil {
+				rsp.Usage = r.Usage
+			}
+			if len(r.FinishReason) > 0 {
+				rsp.FinishReason = r.FinishReason
+			}
+			ch <- r
+		}
+
+		// only complete replies are cached
+		if ctx.Err() != nil || rsp.FinishReason == FinishError || (reply.Len() == 0 && len(rsp.ToolCalls) == 0) {
+			return
+		}
+
+		rsp.Reply = reply.String()
+		c.set(key, &rsp)
+	}()
+
+	return ch, nil
+}
+
+func (c *cached) String() string {
+	return c.model.String()
+}
+
+// replay streams a cached reply word by word
+func replay(ctx context.Context, rsp *cachedResponse) chan *Response {
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer close(ch)
+
+		if len(rsp.ToolCalls) > 0 {
+			ch <- &Response{ToolCalls: rsp.ToolCalls, Model: rsp.Model, Cached: true}
+		}
+
+		for _, word := range strings.SplitAfter(rsp.Reply, " ") {
+			if len(word) == 0 {
+				continue
+			}
+			select {
+			case ch <- &Response{Reply: word, Model: rsp.Model, Cached: true}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(rsp.FinishReason) > 0 {
+			ch <- &Response{FinishReason: rsp.FinishReason, Model: rsp.Model, Cached: true}
+		}
+	}()
+
+	return ch
+}
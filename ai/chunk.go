@@ -0,0 +1,92 @@
+package ai
+
+import (
+	"strings"
+)
+
+var (
+	// ChunkSize is the max number of tokens in a chunk of a document
+	ChunkSize = 400
+)
+
+// Chunk splits text into chunks of at most size tokens for embedding.
+// Paragraphs are kept together where possible and long ones split by words.
+func Chunk(text string, size int) []string {
+	if size <= 0 {
+		size = ChunkSize
+	}
+
+	var chunks []string
+	var current []string
+	var tokens int
+
+	flush := func() {
+		if len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, "\n\n"))
+		}
+		current = nil
+		tokens = 0
+	}
+
+	for _, para := range paragraphs(text) {
+		n := Tokens(DefaultEmbedModel, para)
+
+		// paragraph too big on its own
+		if n > size {
+			flush()
+			chunks = append(chunks, splitWords(para, size)...)
+			continue
+		}
+
+		if tokens+n > size {
+			flush()
+		}
+
+		current = append(current, para)
+		tokens += n
+	}
+
+	flush()
+
+	return chunks
+}
+
+// paragraphs splits text on blank lines
+func paragraphs(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var paras []string
+	for _, p := range strings.Split(text, "\n\n") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			paras = append(paras, p)
+		}
+	}
+	return paras
+}
+
+// splitWords splits text into chunks of at most size tokens on word boundaries
+func splitWords(text string, size int) []string {
+	var chunks []string
+	var current []string
+	var tokens int
+
+	for _, word := range strings.Fields(text) {
+		// leading space is usually part of the token
+		n := Tokens(DefaultEmbedModel, " "+word)
+
+		if tokens+n > size && len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, " "))
+			current = nil
+			tokens = 0
+		}
+
+		current = append(current, word)
+		tokens += n
+	}
+
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, " "))
+	}
+
+	return chunks
+}
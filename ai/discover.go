@@ -0,0 +1,310 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// DiscoverInterval is how often the models of the providers are listed, 0 only at startup
+	DiscoverInterval time.Duration
+
+	// DiscoverTimeout is the time allowed to list the models of all the providers
+	DiscoverTimeout = 10 * time.Second
+
+	// NonChatModels are parts of the names of listed models which can't chat e.g text-embedding-3-small
+	NonChatModels = []string{"embed", "tts", "whisper", "transcribe", "dall-e", "image", "moderation", "realtime", "babbage", "davinci"}
+
+	// ErrModelNotAllowed is returned for models denied by the admin
+	ErrModelNotAllowed = errors.New("Model not allowed")
+
+	// models listed by each provider
+	discovered = map[string][]string{}
+
+	// aliases set by the admin e.g fast=ollama/llama3
+	aliases = map[string]string{}
+
+	// allow and deny patterns e.g ollama/*
+	allowList []string
+	denyList  []string
+
+	ruleMtx sync.RWMutex
+)
+
+// Lister is a provider which can list the models of its upstream
+type Lister interface {
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// ModelInfo describes a model which can be picked
+type ModelInfo struct {
+	// Name of the model e.g gpt-4 or ollama/llama3
+	Name string `json:"name"`
+	// The model an alias points at
+	Alias string `json:"alias,omitempty"`
+	// Context window in tokens
+	Context int `json:"context"`
+	// Whether it accepts images
+	Vision bool `json:"vision"`
+	// Whether it's allowed by the admin rules
+	Allowed bool `json:"allowed"`
+}
+
+// Discover lists the models of every provider which supports it and registers them
+// as provider/model. Models no longer listed are removed, configured models are kept.
+func Discover(ctx context.Context) error {
+	providerMtx.RLock()
+	var listers []Provider
+	for _, p := range Providers {
+		if _, ok := p.(Lister); ok {
+			listers = append(listers, p)
+		}
+	}
+	providerMtx.RUnlock()
+
+	var errs []string
+
+	for _, p := range listers {
+		names, err := p.(Lister).ListModels(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p.String(), err))
+			continue
+		}
+		if err := setDiscovered(p, names); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p.String(), err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("error discovering models: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// setDiscovered replaces the listed models of the provider
+func setDiscovered(p Provider, names []string) error {
+	// keep what we had if there's nothing listed
+	if len(names) == 0 {
+		return nil
+	}
+
+	name := p.String()
+
+	// only the chat models
+	var chat []string
+	for _, n := range names {
+		if isChatModel(n) {
+			chat = append(chat, n)
+		}
+	}
+	names = chat
+
+	// load the models before taking the lock
+	models := map[string]Model{}
+	for _, n := range names {
+		md, err := p.Model(n)
+		if err != nil {
+			return err
+		}
+		models[name+"/"+n] = md
+	}
+
+	configured := map[string]bool{}
+	for _, m := range p.Models() {
+		configured[m] = true
+	}
+
+	providerMtx.Lock()
+	defer providerMtx.Unlock()
+
+	for _, m := range discovered[name] {
+		if !configured[m] {
+			delete(Models, name+"/"+m)
+		}
+	}
+
+	for k, md := range models {
+		Models[k] = md
+	}
+
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	discovered[name] = sorted
+
+	return nil
+}
+
+// isChatModel returns whether a listed model can be used to chat
+func isChatModel(name string) bool {
+	name = strings.ToLower(name)
+	for _, n := range NonChatModels {
+		if strings.Contains(name, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDiscovered returns whether the provider has listed its models
+func isDiscovered(provider string) bool {
+	providerMtx.RLock()
+	defer providerMtx.RUnlock()
+	_, ok := discovered[provider]
+	return ok
+}
+
+// StartDiscovery lists the models of the providers in the background, now and
+// then every DiscoverInterval. Any model is accepted until its provider is listed.
+func StartDiscovery() {
+	discover := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DiscoverTimeout)
+		defer cancel()
+
+		if err := Discover(ctx); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+
+	go func() {
+		discover()
+
+		if DiscoverInterval <= 0 {
+			return
+		}
+
+		for range time.Tick(DiscoverInterval) {
+			discover()
+		}
+	}()
+}
+
+// SetAliases replaces the aliases set by the admin, an alias points at provider/model
+func SetAliases(vals map[string]string) {
+	ruleMtx.Lock()
+	defer ruleMtx.Unlock()
+
+	aliases = map[string]string{}
+	for k, v := range vals {
+		aliases[k] = v
+	}
+}
+
+// SetRules replaces the allow and deny patterns. A pattern is a model name or a
+// prefix ending in * e.g ollama/*. Deny wins and an empty allow list allows all.
+func SetRules(allow, deny []string) {
+	ruleMtx.Lock()
+	defer ruleMtx.Unlock()
+
+	allowList = append([]string{}, allow...)
+	denyList = append([]string{}, deny...)
+}
+
+// Allowed returns whether the model or the model it's an alias of is allowed
+func Allowed(name string) bool {
+	names := []string{name}
+	if target := aliasOf(name); len(target) > 0 {
+		names = append(names, target)
+	}
+
+	ruleMtx.RLock()
+	defer ruleMtx.RUnlock()
+
+	for _, n := range names {
+		if matchAny(denyList, n) {
+			return false
+		}
+	}
+
+	if len(allowList) == 0 {
+		return true
+	}
+
+	for _, n := range names {
+		if matchAny(allowList, n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aliasOf returns the provider/model an alias points at
+func aliasOf(name string) string {
+	ruleMtx.RLock()
+	target, ok := aliases[name]
+	ruleMtx.RUnlock()
+
+	if ok {
+		return target
+	}
+
+	// aliases of the default provider e.g gpt-4
+	if model, ok := Aliases[name]; ok {
+		return DefaultProvider + "/" + model
+	}
+
+	return ""
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == name {
+			return true
+		}
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListModels returns the registered models, aliases included, sorted by name
+func ListModels() []ModelInfo {
+	seen := map[string]bool{}
+
+	providerMtx.RLock()
+	for name := range Models {
+		seen[name] = true
+	}
+	providerMtx.RUnlock()
+
+	ruleMtx.RLock()
+	for name := range aliases {
+		seen[name] = true
+	}
+	ruleMtx.RUnlock()
+
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var infos []ModelInfo
+
+	for _, name := range names {
+		md, err := resolveModel(name)
+		if err != nil {
+			continue
+		}
+
+		// limits are by the model name
+		infos = append(infos, ModelInfo{
+			Name:    name,
+			Alias:   aliasOf(name),
+			Context: GetLimit(md.String()).Context,
+			Vision:  SupportsVision(md.String()),
+			Allowed: Allowed(name),
+		})
+	}
+
+	return infos
+}
@@ -0,0 +1,54 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// DefaultEmbedModel is used to create embeddings when no model is specified
+	DefaultEmbedModel = "text-embedding-3-small"
+
+	// ErrUnsupportedEmbeddings is returned when a provider can't create embeddings
+	ErrUnsupportedEmbeddings = errors.New("Unsupported embeddings")
+)
+
+// Embedder is a provider which can create embeddings
+type Embedder interface {
+	// Embed returns a vector for each input
+	Embed(ctx context.Context, model string, input []string) ([][]float32, error)
+}
+
+// Embed returns the embeddings for the input using a model referenced as
+// provider/model e.g ollama/nomic-embed-text or the default provider
+func Embed(ctx context.Context, model string, input ...string) ([][]float32, error) {
+	if len(model) == 0 {
+		model = DefaultEmbedModel
+	}
+
+	name := DefaultProvider
+
+	// split provider/model
+	if parts := strings.SplitN(model, "/", 2); len(parts) == 2 {
+		if _, ok := GetProvider(parts[0]); ok {
+			name, model = parts[0], parts[1]
+		}
+	}
+
+	p, ok := GetProvider(name)
+	if !ok {
+		return nil, ErrUnsupportedModel
+	}
+
+	e, ok := p.(Embedder)
+	if !ok {
+		return nil, ErrUnsupportedEmbeddings
+	}
+
+	if len(input) == 0 {
+		return nil, nil
+	}
+
+	return e.Embed(ctx, model, input)
+}
@@ -0,0 +1,126 @@
+package ai
+
+import (
+	"context"
+	"sync"
+
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// Fallbacks are the models tried in order when a model fails e.g gpt-4: gpt-3, ollama/llama3
+	Fallbacks = map[string][]string{}
+
+	fallbackMtx sync.RWMutex
+)
+
+// chain of models tried in order until one answers
+type chain struct {
+	name   string
+	model  Model
+	chains []string
+}
+
+// SetFallbacks sets the models to fall back to when a model fails
+func SetFallbacks(model string, fallbacks ...string) {
+	fallbackMtx.Lock()
+	defer fallbackMtx.Unlock()
+
+	if len(fallbacks) == 0 {
+		delete(Fallbacks, model)
+		return
+	}
+
+	Fallbacks[model] = fallbacks
+}
+
+func newChain(name string, md Model, fallbacks []string) Model {
+	return &chain{name: name, model: md, chains: fallbacks}
+}
+
+// each calls fn with the model and its fallbacks until it succeeds.
+// Fallbacks which can't see the images of the request are skipped.
+func (c *chain) each(ctx context.Context, req *Request, fn func(name string, md Model) error) error {
+	err := fn(c.name, c.model)
+	if err == nil {
+		return nil
+	}
+
+	for _, name := range c.chains {
+		// don't fall back if the caller is gone
+		if ctx.Err() != nil {
+			return err
+		}
+
+		md, gerr := getModel(name)
+		if gerr != nil {
+			log.Printf("Error getting fallback model %v: %v\n", name, gerr)
+			continue
+		}
+
+		if verr := checkVision(md, req); verr != nil {
+			log.Printf("Skipping fallback model %v: %v\n", name, verr)
+			continue
+		}
+
+		log.Printf("Falling back to model %v: %v\n", name, err)
+
+		if err = fn(name, md); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (c *chain) Complete(ctx context.Context, req *Request) (*Response, error) {
+	var rsp *Response
+
+	err := c.each(ctx, req, func(name string, md Model) error {
+		r, err := md.Complete(ctx, req)
+		if err != nil {
+			return err
+		}
+		r.Model = name
+		rsp = r
+		return nil
+	})
+
+	return rsp, err
+}
+
+func (c *chain) Stream(ctx context.Context, req *Request) (chan *Response, error) {
+	var stream chan *Response
+	var model string
+
+	err := c.each(ctx, req, func(name string, md Model) error {
+		s, err := md.Stream(ctx, req)
+		if err != nil {
+			return err
+		}
+		stream = s
+		model = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer close(ch)
+
+		// tag each part with the model answering
+		for rsp := range stream {
+			rsp.Model = model
+			ch <- rsp
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c *chain) String() string {
+	return c.model.String()
+}
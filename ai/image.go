@@ -0,0 +1,69 @@
+package ai
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ImageTokens is the estimated number of tokens used by an image
+	ImageTokens = 765
+
+	// ErrNoVision is returned when images are sent to a model without vision support
+	ErrNoVision = errors.New("model does not support images")
+)
+
+// Image attached to a prompt either as data or a url
+type Image struct {
+	// ID of the stored file
+	ID string `json:"id,omitempty"`
+	// Mime type e.g image/png
+	MimeType string `json:"mime_type,omitempty"`
+	// Raw image data, not cached with the context
+	Data []byte `json:"-"`
+	// URL of an image which isn't sent as data
+	URL string `json:"url,omitempty"`
+}
+
+// SupportsVision returns whether the model accepts images
+func SupportsVision(model string) bool {
+	return GetLimit(model).Vision
+}
+
+// loaded returns whether the image has data or a url to send
+func (i Image) loaded() bool {
+	return len(i.Data) > 0 || len(i.URL) > 0
+}
+
+// base64 encoded data
+func (i Image) base64() string {
+	return base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// dataURL returns the url or the data as a data url
+func (i Image) dataURL() string {
+	if len(i.Data) == 0 {
+		return i.URL
+	}
+	return fmt.Sprintf("data:%s;base64,%s", i.MimeType, i.base64())
+}
+
+// loadedImages returns the images which can be sent
+func loadedImages(images []Image) []Image {
+	var list []Image
+	for _, i := range images {
+		if i.loaded() {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// checkVision returns ErrNoVision if the prompt has images the model can't see
+func checkVision(md Model, req *Request) error {
+	if len(req.Images) == 0 || SupportsVision(md.String()) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNoVision, md.String())
+}
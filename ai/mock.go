@@ -0,0 +1,236 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// MockDelay is the delay between tokens streamed by the mock models
+	MockDelay time.Duration
+
+	// MockWords is the number of words of lorem text generated by default
+	MockWords = 50
+
+	// the built-in mock provider
+	mock = &mockProvider{}
+
+	lorem = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor
+		incididunt ut labore et dolore magna aliqua ut enim ad minim veniam quis nostrud exercitation ullamco
+		laboris nisi ut aliquip ex ea commodo consequat duis aute irure dolor in reprehenderit in voluptate
+		velit esse cillum dolore eu fugiat nulla pariatur excepteur sint occaecat cupidatat non proident sunt
+		in culpa qui officia deserunt mollit anim id est laborum`)
+)
+
+// MockReply is a scripted reply of the mock models
+type MockReply struct {
+	// The reply to send
+	Reply string
+	// Tool calls to request
+	ToolCalls []ToolCall
+	// Error returned instead of a reply
+	Err error
+	// Delay before replying
+	Delay time.Duration
+}
+
+// mock provider for offline development and testing
+type mockProvider struct {
+	sync.Mutex
+	script []MockReply
+}
+
+// mock model which echoes the prompt or generates lorem text
+type mockModel struct {
+	model string
+}
+
+func init() {
+	Register(mock)
+
+	// the default mock model
+	Models["mock"] = &mockModel{model: "echo"}
+}
+
+// MockScript queues replies returned in order by the mock models before
+// falling back to echo or lorem text
+func MockScript(replies ...MockReply) {
+	mock.Lock()
+	mock.script = append(mock.script, replies...)
+	mock.Unlock()
+}
+
+// MockReset clears any scripted replies
+func MockReset() {
+	mock.Lock()
+	mock.script = nil
+	mock.Unlock()
+}
+
+func (p *mockProvider) next() (MockReply, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.script) == 0 {
+		return MockReply{}, false
+	}
+
+	r := p.script[0]
+	p.script = p.script[1:]
+	return r, true
+}
+
+func (p *mockProvider) Models() []string {
+	return []string{"echo", "lorem"}
+}
+
+func (p *mockProvider) Model(name string) (Model, error) {
+	switch name {
+	case "echo", "lorem":
+		return &mockModel{model: name}, nil
+	}
+	return nil, ErrUnsupportedModel
+}
+
+func (p *mockProvider) String() string {
+	return "mock"
+}
+
+// reply returns the scripted reply or generates one
+func (m *mockModel) reply(ctx context.Context, req *Request) (*Response, error) {
+	r, ok := mock.next()
+	if !ok {
+		r = MockReply{Reply: m.generate(req)}
+	}
+
+	if r.Delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(r.Delay):
+		}
+	}
+
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	// estimated as the real models would count
+	prompt := countTokens(m.String(), messages(m.String(), req)...)
+	completion := Tokens(m.String(), r.Reply)
+
+	reason := FinishStop
+	if len(r.ToolCalls) > 0 {
+		reason = FinishToolCalls
+	}
+
+	return &Response{
+		Reply:        r.Reply,
+		ToolCalls:    r.ToolCalls,
+		Usage:        newUsage(prompt, completion),
+		FinishReason: reason,
+	}, nil
+}
+
+// generate a deterministic reply for the request
+func (m *mockModel) generate(req *Request) string {
+	// reply with the results of any tools called
+	if len(req.Calls) > 0 {
+		var results []string
+		for _, c := range req.Calls {
+			results = append(results, c.Result)
+		}
+		return strings.Join(results, "\n")
+	}
+
+	if m.model == "echo" {
+		// note what was seen
+		var images []string
+		for _, img := range req.Images {
+			images = append(images, fmt.Sprintf("[image %s]", img.MimeType))
+		}
+		return strings.Join(append([]string{req.Prompt}, images...), " ")
+	}
+
+	// seeded by the prompt and seed param
+	h := fnv.New64a()
+	h.Write([]byte(req.Prompt))
+	seed := int64(h.Sum64())
+
+	words := MockWords
+
+	if p := req.Params; p != nil {
+		if p.Seed != nil {
+			seed += int64(*p.Seed)
+		}
+		if p.MaxTokens != nil && *p.MaxTokens < words {
+			words = *p.MaxTokens
+		}
+	}
+
+	r := rand.New(rand.NewSource(seed))
+
+	text := make([]string, words)
+	for i := range text {
+		text[i] = lorem[r.Intn(len(lorem))]
+	}
+
+	return strings.Join(text, " ")
+}
+
+func (m *mockModel) Complete(ctx context.Context, req *Request) (*Response, error) {
+	return m.reply(ctx, req)
+}
+
+func (m *mockModel) Stream(ctx context.Context, req *Request) (chan *Response, error) {
+	rsp, err := m.reply(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer close(ch)
+
+		// send word by word keeping the spaces
+		words := strings.SplitAfter(rsp.Reply, " ")
+
+		for i, word := range words {
+			if len(word) == 0 {
+				continue
+			}
+
+			if i > 0 && MockDelay > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(MockDelay):
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- &Response{Reply: word}:
+			}
+		}
+
+		if len(rsp.ToolCalls) > 0 {
+			ch <- &Response{ToolCalls: rsp.ToolCalls}
+		}
+
+		ch <- &Response{Usage: rsp.Usage, FinishReason: rsp.FinishReason}
+	}()
+
+	return ch, nil
+}
+
+func (m *mockModel) String() string {
+	return fmt.Sprintf("mock-%s", m.model)
+}
@@ -0,0 +1,355 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/asim/turbo/log"
+	"github.com/google/uuid"
+)
+
+var (
+	// DefaultOllamaURL is the address of a local ollama server
+	DefaultOllamaURL = "http://localhost:11434"
+)
+
+// ollama style local http server
+type ollamaProvider struct {
+	url    string
+	client *http.Client
+	models []string
+}
+
+type ollamaModel struct {
+	provider *ollamaProvider
+	model    string
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	// json schema of the reply
+	Format json.RawMessage `json:"format,omitempty"`
+	// generation parameters e.g temperature, num_predict
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	Images    []string         `json:"images,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+type ollamaResponse struct {
+	Model   string        `json:"model"`
+	Message ollamaMessage `json:"message"`
+	Done    bool          `json:"done"`
+	// why it's done e.g stop or length
+	DoneReason string `json:"done_reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// token counts sent when done
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// NewOllama returns a provider for an ollama style local http server
+func NewOllama(cfg Config) Provider {
+	if len(cfg.URL) == 0 {
+		cfg.URL = DefaultOllamaURL
+	}
+	return &ollamaProvider{
+		url:    strings.TrimSuffix(cfg.URL, "/"),
+		client: newClient(),
+		models: cfg.Models,
+	}
+}
+
+func (p *ollamaProvider) Models() []string {
+	return p.models
+}
+
+// ListModels returns the models pulled by the server
+func (p *ollamaProvider) ListModels(ctx context.Context) ([]string, error) {
+	hreq, err := http.NewRequestWithContext(ctx, "GET", p.url+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := p.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("ollama error %d: %s", rsp.StatusCode, string(b))
+	}
+
+	var r ollamaTagsResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, m := range r.Models {
+		// llama3:latest is served as llama3
+		names = append(names, strings.TrimSuffix(m.Name, ":latest"))
+	}
+
+	return names, nil
+}
+
+func (p *ollamaProvider) Model(name string) (Model, error) {
+	return &ollamaModel{provider: p, model: name}, nil
+}
+
+func (p *ollamaProvider) String() string {
+	return "ollama"
+}
+
+func (p *ollamaProvider) do(ctx context.Context, path string, req interface{}) (*http.Response, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, "POST", p.url+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	rsp, err := p.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		b, _ := io.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("ollama error %d: %s", rsp.StatusCode, string(b))
+	}
+
+	return rsp, nil
+}
+
+func (p *ollamaProvider) Embed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	rsp, err := p.do(ctx, "/api/embed", &ollamaEmbedRequest{Model: model, Input: input})
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var r ollamaEmbedResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	return r.Embeddings, nil
+}
+
+func (m *ollamaModel) request(req *Request) *ollamaRequest {
+	oreq := &ollamaRequest{
+		Model:  m.model,
+		Format: req.Schema,
+	}
+
+	if p := req.Params; p != nil {
+		opts := map[string]interface{}{}
+		if p.Temperature != nil {
+			opts["temperature"] = *p.Temperature
+		}
+		if p.TopP != nil {
+			opts["top_p"] = *p.TopP
+		}
+		if p.MaxTokens != nil {
+			opts["num_predict"] = *p.MaxTokens
+		}
+		if len(p.Stop) > 0 {
+			opts["stop"] = p.Stop
+		}
+		if p.PresencePenalty != nil {
+			opts["presence_penalty"] = *p.PresencePenalty
+		}
+		if p.FrequencyPenalty != nil {
+			opts["frequency_penalty"] = *p.FrequencyPenalty
+		}
+		if p.Seed != nil {
+			opts["seed"] = *p.Seed
+		}
+		if len(opts) > 0 {
+			oreq.Options = opts
+		}
+	}
+
+	for _, msg := range messages(m.model, req) {
+		omsg := ollamaMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		}
+		// only base64 images are supported
+		for _, img := range msg.Images {
+			if len(img.Data) > 0 {
+				omsg.Images = append(omsg.Images, img.base64())
+			}
+		}
+		for _, tc := range msg.ToolCalls {
+			var call ollamaToolCall
+			call.Function.Name = tc.Name
+			call.Function.Arguments = json.RawMessage(tc.Arguments)
+			omsg.ToolCalls = append(omsg.ToolCalls, call)
+		}
+		oreq.Messages = append(oreq.Messages, omsg)
+	}
+
+	for _, t := range req.Tools {
+		tool := ollamaTool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		tool.Function.Parameters = t.schema()
+		oreq.Tools = append(oreq.Tools, tool)
+	}
+
+	return oreq
+}
+
+// toolCalls converts ollama tool calls which have no id
+func (m *ollamaModel) toolCalls(calls []ollamaToolCall) []ToolCall {
+	var tcs []ToolCall
+	for _, c := range calls {
+		tcs = append(tcs, ToolCall{
+			ID:        uuid.New().String(),
+			Name:      c.Function.Name,
+			Arguments: string(c.Function.Arguments),
+		})
+	}
+	return tcs
+}
+
+func (m *ollamaModel) Complete(ctx context.Context, req *Request) (*Response, error) {
+	rsp, err := m.provider.do(ctx, "/api/chat", m.request(req))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var r ollamaResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if len(r.Error) > 0 {
+		return nil, fmt.Errorf("ollama error: %s", r.Error)
+	}
+
+	return &Response{
+		Reply:     r.Message.Content,
+		ToolCalls: m.toolCalls(r.Message.ToolCalls),
+		Usage:     newUsage(r.PromptEvalCount, r.EvalCount),
+
+		FinishReason: finishReason(r.DoneReason),
+	}, nil
+}
+
+func (m *ollamaModel) Stream(ctx context.Context, req *Request) (chan *Response, error) {
+	oreq := m.request(req)
+	oreq.Stream = true
+
+	rsp, err := m.provider.do(ctx, "/api/chat", oreq)
+	if err != nil {
+		log.Printf("Error creating ollama stream: %v\n", err)
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer rsp.Body.Close()
+		defer close(ch)
+
+		// responses are newline delimited json
+		scanner := bufio.NewScanner(rsp.Body)
+
+		for scanner.Scan() {
+			var r ollamaResponse
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				log.Printf("Error in ollama stream: %v\n", err)
+				ch <- &Response{FinishReason: FinishError}
+				return
+			}
+
+			if len(r.Error) > 0 {
+				log.Printf("Error in ollama stream: %v\n", r.Error)
+				ch <- &Response{FinishReason: FinishError}
+				return
+			}
+
+			if len(r.Message.Content) > 0 {
+				ch <- &Response{Reply: r.Message.Content}
+			}
+
+			if len(r.Message.ToolCalls) > 0 {
+				ch <- &Response{ToolCalls: m.toolCalls(r.Message.ToolCalls)}
+			}
+
+			if r.Done {
+				ch <- &Response{
+					Usage:        newUsage(r.PromptEvalCount, r.EvalCount),
+					FinishReason: finishReason(r.DoneReason),
+				}
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			log.Printf("Error in ollama stream: %v\n", err)
+			ch <- &Response{FinishReason: FinishError}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (m *ollamaModel) String() string {
+	return m.model
+}
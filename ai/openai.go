@@ -0,0 +1,326 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/asim/turbo/log"
+	"github.com/sashabaranov/go-openai"
+)
+
+// openai compatible provider
+type openaiProvider struct {
+	name   string
+	client *openai.Client
+	models []string
+}
+
+// chatgpt models
+type chatgpt struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAI returns a provider for the OpenAI API or any OpenAI compatible API
+func NewOpenAI(cfg Config) Provider {
+	c := openai.DefaultConfig(cfg.Key)
+	if len(cfg.URL) > 0 {
+		c.BaseURL = cfg.URL
+	}
+	c.HTTPClient = newClient()
+	// the pool picks the url and key of each request
+	if cfg.Pool != nil {
+		c.BaseURL = poolURL
+		c.HTTPClient = newPoolClient(cfg.Pool)
+	}
+	if len(cfg.Models) == 0 {
+		cfg.Models = []string{openai.GPT3Dot5Turbo, openai.GPT4}
+	}
+	return &openaiProvider{
+		name:   "openai",
+		client: openai.NewClientWithConfig(c),
+		models: cfg.Models,
+	}
+}
+
+// NewAzure returns a provider for the Azure OpenAI service
+func NewAzure(cfg Config) Provider {
+	c := openai.DefaultAzureConfig(cfg.Key, cfg.URL)
+	c.HTTPClient = newClient()
+	if len(cfg.Models) == 0 {
+		cfg.Models = []string{openai.GPT3Dot5Turbo, openai.GPT4}
+	}
+	return &openaiProvider{
+		name:   "azure",
+		client: openai.NewClientWithConfig(c),
+		models: cfg.Models,
+	}
+}
+
+func (p *openaiProvider) Models() []string {
+	return p.models
+}
+
+// ListModels returns the models of the upstream /v1/models
+func (p *openaiProvider) ListModels(ctx context.Context) ([]string, error) {
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, m := range list.Models {
+		names = append(names, m.ID)
+	}
+
+	return names, nil
+}
+
+func (p *openaiProvider) Model(name string) (Model, error) {
+	return &chatgpt{client: p.client, model: name}, nil
+}
+
+func (p *openaiProvider) String() string {
+	return p.name
+}
+
+func (p *openaiProvider) Embed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	resp, err := p.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: input,
+		Model: openai.EmbeddingModel(model),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vecs := make([][]float32, len(input))
+	for _, d := range resp.Data {
+		if d.Index < len(vecs) {
+			vecs[d.Index] = d.Embedding
+		}
+	}
+
+	return vecs, nil
+}
+
+func (c *chatgpt) Complete(ctx context.Context, req *Request) (*Response, error) {
+	// create chat completion
+	resp, err := c.client.CreateChatCompletion(
+		ctx,
+		complete(c.model, req),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("no choices in response")
+	}
+
+	msg := resp.Choices[0].Message
+
+	rsp := &Response{
+		Reply:        msg.Content,
+		Usage:        newUsage(resp.Usage.PromptTokens, resp.Usage.CompletionTokens),
+		FinishReason: finishReason(string(resp.Choices[0].FinishReason)),
+	}
+
+	for _, tc := range msg.ToolCalls {
+		rsp.ToolCalls = append(rsp.ToolCalls, ToolCall{
+			ID:        tc.ID,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+		})
+	}
+
+	return rsp, nil
+}
+
+func (c *chatgpt) Stream(ctx context.Context, req *Request) (chan *Response, error) {
+	creq := complete(c.model, req)
+	creq.Stream = true
+	// usage is sent in the last chunk
+	creq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	stream, err := c.client.CreateChatCompletionStream(ctx, creq)
+	if err != nil {
+		log.Printf("Error creating chat stream: %v\n", err)
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer stream.Close()
+		defer close(ch)
+
+		// tool calls are streamed in parts by index
+		var calls []ToolCall
+
+		// sent in the last choice
+		var reason string
+
+		for {
+			response, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				log.Printf("EOF in ai chat stream: %v\n", err)
+				break
+			}
+
+			if err != nil {
+				log.Printf("Error in ai chat stream: %v\n", err)
+				ch <- &Response{FinishReason: FinishError}
+				return
+			}
+
+			if response.Usage != nil {
+				ch <- &Response{Usage: newUsage(response.Usage.PromptTokens, response.Usage.CompletionTokens)}
+			}
+
+			if len(response.Choices) == 0 {
+				continue
+			}
+
+			delta := response.Choices[0].Delta
+
+			if r := response.Choices[0].FinishReason; len(r) > 0 {
+				reason = finishReason(string(r))
+			}
+
+			for _, tc := range delta.ToolCalls {
+				i := len(calls)
+				if tc.Index != nil {
+					i = *tc.Index
+				}
+				for len(calls) <= i {
+					calls = append(calls, ToolCall{})
+				}
+				if len(tc.ID) > 0 {
+					calls[i].ID = tc.ID
+				}
+				calls[i].Name += tc.Function.Name
+				calls[i].Arguments += tc.Function.Arguments
+			}
+
+			if len(delta.Content) > 0 {
+				ch <- &Response{Reply: delta.Content}
+			}
+		}
+
+		if len(calls) > 0 {
+			ch <- &Response{ToolCalls: calls}
+		}
+
+		if len(reason) > 0 {
+			ch <- &Response{FinishReason: reason}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c *chatgpt) String() string {
+	return c.model
+}
+
+func complete(model string, req *Request) openai.ChatCompletionRequest {
+	message := []openai.ChatCompletionMessage{}
+
+	for _, m := range messages(model, req) {
+		msg := openai.ChatCompletionMessage{
+			Role:       m.Role,
+			Content:    m.Content,
+			ToolCallID: m.ToolCallID,
+		}
+
+		// images are sent as multi part content
+		if len(m.Images) > 0 {
+			msg.Content = ""
+			msg.MultiContent = []openai.ChatMessagePart{{
+				Type: openai.ChatMessagePartTypeText,
+				Text: m.Content,
+			}}
+
+			for _, img := range m.Images {
+				msg.MultiContent = append(msg.MultiContent, openai.ChatMessagePart{
+					Type: openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{
+						URL:    img.dataURL(),
+						Detail: openai.ImageURLDetailAuto,
+					},
+				})
+			}
+		}
+
+		for _, tc := range m.ToolCalls {
+			msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{
+				ID:   tc.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      tc.Name,
+					Arguments: tc.Arguments,
+				},
+			})
+		}
+
+		message = append(message, msg)
+	}
+
+	var tools []openai.Tool
+
+	for _, t := range req.Tools {
+		tools = append(tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.schema(),
+			},
+		})
+	}
+
+	creq := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: message,
+		User:     req.User,
+		Tools:    tools,
+	}
+
+	// json mode, the schema is in the system prompt
+	if len(req.Schema) > 0 {
+		creq.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+		}
+	}
+
+	if p := req.Params; p != nil {
+		if p.Temperature != nil {
+			creq.Temperature = nonZero(*p.Temperature)
+		}
+		if p.TopP != nil {
+			creq.TopP = nonZero(*p.TopP)
+		}
+		if p.MaxTokens != nil {
+			creq.MaxTokens = *p.MaxTokens
+		}
+		if p.PresencePenalty != nil {
+			creq.PresencePenalty = *p.PresencePenalty
+		}
+		if p.FrequencyPenalty != nil {
+			creq.FrequencyPenalty = *p.FrequencyPenalty
+		}
+		creq.Stop = p.Stop
+		creq.Seed = p.Seed
+	}
+
+	return creq
+}
+
+// nonZero returns the smallest float for 0 since zero values are omitted from the request
+func nonZero(f float32) float32 {
+	if f == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return f
+}
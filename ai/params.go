@@ -0,0 +1,99 @@
+package ai
+
+import (
+	"fmt"
+)
+
+var (
+	// MaxStop is the max number of stop sequences
+	MaxStop = 4
+
+	// DefaultMaxTemperature is the max temperature for models without a limit
+	DefaultMaxTemperature float32 = 2
+)
+
+// Params are the generation parameters for a request. Unset values use the model default.
+type Params struct {
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+}
+
+// Merge returns the params overridden by any values set in o
+func (p Params) Merge(o Params) Params {
+	if o.Temperature != nil {
+		p.Temperature = o.Temperature
+	}
+	if o.TopP != nil {
+		p.TopP = o.TopP
+	}
+	if o.MaxTokens != nil {
+		p.MaxTokens = o.MaxTokens
+	}
+	if o.Stop != nil {
+		p.Stop = o.Stop
+	}
+	if o.PresencePenalty != nil {
+		p.PresencePenalty = o.PresencePenalty
+	}
+	if o.FrequencyPenalty != nil {
+		p.FrequencyPenalty = o.FrequencyPenalty
+	}
+	if o.Seed != nil {
+		p.Seed = o.Seed
+	}
+	return p
+}
+
+// Validate checks the params against the limits of the model
+func (p Params) Validate(model string) error {
+	limit := GetLimit(model)
+
+	maxTemp := limit.MaxTemperature
+	if maxTemp == 0 {
+		maxTemp = DefaultMaxTemperature
+	}
+
+	maxOutput := limit.MaxOutput
+	if maxOutput == 0 {
+		maxOutput = limit.Context
+	}
+
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > maxTemp) {
+		return fmt.Errorf("temperature must be between 0 and %v for %s", maxTemp, model)
+	}
+	if p.TopP != nil && (*p.TopP < 0 || *p.TopP > 1) {
+		return fmt.Errorf("top_p must be between 0 and 1")
+	}
+	if p.MaxTokens != nil && (*p.MaxTokens < 1 || *p.MaxTokens > maxOutput) {
+		return fmt.Errorf("max_tokens must be between 1 and %d for %s", maxOutput, model)
+	}
+	if len(p.Stop) > MaxStop {
+		return fmt.Errorf("at most %d stop sequences", MaxStop)
+	}
+	for _, s := range p.Stop {
+		if len(s) == 0 {
+			return fmt.Errorf("stop sequences can't be empty")
+		}
+	}
+	if p.PresencePenalty != nil && (*p.PresencePenalty < -2 || *p.PresencePenalty > 2) {
+		return fmt.Errorf("presence_penalty must be between -2 and 2")
+	}
+	if p.FrequencyPenalty != nil && (*p.FrequencyPenalty < -2 || *p.FrequencyPenalty > 2) {
+		return fmt.Errorf("frequency_penalty must be between -2 and 2")
+	}
+
+	return nil
+}
+
+// output returns the tokens to reserve for the reply
+func (p *Params) output(limit Limit) int {
+	if p != nil && p.MaxTokens != nil {
+		return *p.MaxTokens
+	}
+	return limit.Output
+}
@@ -0,0 +1,327 @@
+package ai
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// EjectTime is how long a failing upstream is taken out of the pool, doubled on each failure in a row
+	EjectTime = 10 * time.Second
+
+	// MaxEjectTime caps the time an upstream is taken out of the pool
+	MaxEjectTime = 5 * time.Minute
+
+	// ErrNoUpstream is returned for a pool without upstreams
+	ErrNoUpstream = errors.New("no upstream")
+
+	// poolURL is the base url of clients using a pool, the host is replaced by the upstream
+	poolURL = "http://upstream/v1"
+)
+
+// Upstream is an openai compatible api and key
+type Upstream struct {
+	// Base url e.g https://api.openai.com/v1
+	URL string `json:"url"`
+	// API key sent as the bearer token
+	Key string `json:"-"`
+	// Weight relative to the other upstreams, defaults to 1
+	Weight int `json:"weight"`
+}
+
+// UpstreamStatus is the health of an upstream in the pool
+type UpstreamStatus struct {
+	URL string `json:"url"`
+	// last 4 characters of the key
+	Key      string `json:"key"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+	// status of the last response, 0 for a network error
+	LastStatus   int        `json:"last_status"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+}
+
+// Pool balances requests over upstreams with weighted round robin. Upstreams
+// returning 401, 429 or 5xx are ejected for a while and requests fail over.
+type Pool struct {
+	mtx       sync.Mutex
+	upstreams []*upstream
+}
+
+type upstream struct {
+	Upstream
+	url *url.URL
+
+	// smooth weighted round robin
+	current int
+
+	// failures in a row
+	fails      int
+	ejected    time.Time
+	requests   int64
+	failures   int64
+	lastStatus int
+}
+
+// NewPool returns a pool of the upstreams
+func NewPool(ups ...Upstream) (*Pool, error) {
+	if len(ups) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	p := new(Pool)
+
+	for _, u := range ups {
+		if len(u.URL) == 0 {
+			u.URL = DefaultURL
+		}
+		if u.Weight <= 0 {
+			u.Weight = 1
+		}
+		uri, err := url.Parse(u.URL)
+		if err != nil {
+			return nil, err
+		}
+		if len(uri.Scheme) == 0 || len(uri.Host) == 0 {
+			return nil, errors.New("invalid upstream url " + u.URL)
+		}
+		p.upstreams = append(p.upstreams, &upstream{Upstream: u, url: uri})
+	}
+
+	return p, nil
+}
+
+// ParseUpstreams parses a comma separated list of url|key|weight, the key and weight are optional
+func ParseUpstreams(v string) ([]Upstream, error) {
+	var ups []Upstream
+
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) == 0 {
+			continue
+		}
+
+		parts := strings.Split(s, "|")
+		if len(parts) > 3 {
+			return nil, errors.New("upstream must be url|key|weight")
+		}
+
+		u := Upstream{URL: parts[0]}
+		if len(parts) > 1 {
+			u.Key = parts[1]
+		}
+		if len(parts) > 2 {
+			w, err := strconv.Atoi(parts[2])
+			if err != nil || w <= 0 {
+				return nil, errors.New("invalid weight " + parts[2])
+			}
+			u.Weight = w
+		}
+
+		ups = append(ups, u)
+	}
+
+	return ups, nil
+}
+
+// next picks an upstream not yet tried, the healthy ones by weight
+// otherwise the one back the soonest rather than failing outright
+func (p *Pool) next(tried map[*upstream]bool) *upstream {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+
+	var best, soonest *upstream
+	total := 0
+
+	for _, u := range p.upstreams {
+		if tried[u] {
+			continue
+		}
+		if now.Before(u.ejected) {
+			if soonest == nil || u.ejected.Before(soonest.ejected) {
+				soonest = u
+			}
+			continue
+		}
+		u.current += u.Weight
+		total += u.Weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+
+	if best == nil {
+		best = soonest
+	} else {
+		best.current -= total
+	}
+
+	if best != nil {
+		best.requests++
+	}
+
+	return best
+}
+
+// failed returns whether the upstream should be ejected for the response
+func failed(rsp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch {
+	case rsp.StatusCode == http.StatusUnauthorized,
+		rsp.StatusCode == http.StatusTooManyRequests,
+		rsp.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// done records the result of a request to the upstream
+func (p *Pool) done(u *upstream, rsp *http.Response, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	u.lastStatus = 0
+	if rsp != nil {
+		u.lastStatus = rsp.StatusCode
+	}
+
+	if !failed(rsp, err) {
+		u.fails = 0
+		u.ejected = time.Time{}
+		return
+	}
+
+	u.failures++
+	u.fails++
+
+	eject := EjectTime << uint(u.fails-1)
+	if eject > MaxEjectTime || eject <= 0 {
+		eject = MaxEjectTime
+	}
+
+	// wait as long as the upstream asks
+	if d, ok := retryAfter(rsp); ok && d > eject {
+		eject = d
+		if eject > MaxEjectTime {
+			eject = MaxEjectTime
+		}
+	}
+
+	u.ejected = time.Now().Add(eject)
+}
+
+// Status returns the health of the upstreams
+func (p *Pool) Status() []UpstreamStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+
+	var status []UpstreamStatus
+
+	for _, u := range p.upstreams {
+		s := UpstreamStatus{
+			URL:        u.URL,
+			Weight:     u.Weight,
+			Healthy:    !now.Before(u.ejected),
+			Requests:   u.requests,
+			Failures:   u.failures,
+			LastStatus: u.lastStatus,
+		}
+		if len(u.Key) > 4 {
+			s.Key = "..." + u.Key[len(u.Key)-4:]
+		}
+		if !s.Healthy {
+			t := u.ejected
+			s.EjectedUntil = &t
+		}
+		status = append(status, s)
+	}
+
+	return status
+}
+
+// Transport returns a http transport sending each request to an upstream of the pool
+// and failing over to the next. The request path is joined to the upstream url.
+func (p *Pool) Transport(transport http.RoundTripper) http.RoundTripper {
+	return &poolTransport{pool: p, transport: transport}
+}
+
+// poolTransport sends requests to the upstreams of the pool
+type poolTransport struct {
+	pool      *Pool
+	transport http.RoundTripper
+}
+
+// upstreamPath joins the request path to the path of the upstream
+// without repeating /v1 e.g https://api.openai.com/v1 and /v1/models
+func upstreamPath(base, path string) string {
+	base = strings.TrimSuffix(base, "/")
+	if strings.HasSuffix(base, "/v1") && (path == "/v1" || strings.HasPrefix(path, "/v1/")) {
+		path = path[3:]
+	}
+	return base + path
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	tried := map[*upstream]bool{}
+
+	for attempt := 0; ; attempt++ {
+		u := t.pool.next(tried)
+		tried[u] = true
+
+		r := req.Clone(ctx)
+		r.Host = ""
+		r.URL.Scheme = u.url.Scheme
+		r.URL.Host = u.url.Host
+		r.URL.User = u.url.User
+		r.URL.Path = upstreamPath(u.url.Path, req.URL.Path)
+		r.URL.RawPath = ""
+
+		if len(u.Key) > 0 {
+			r.Header.Set("Authorization", "Bearer "+u.Key)
+		}
+
+		// replay the body on fail over
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		rsp, err := t.transport.RoundTrip(r)
+		t.pool.done(u, rsp, err)
+
+		// fail over while there's an upstream left which hasn't been tried
+		if !failed(rsp, err) || ctx.Err() != nil || len(tried) == len(t.pool.upstreams) {
+			return rsp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return rsp, err
+		}
+
+		if rsp != nil {
+			log.Printf("Failing over %v from %v after status %d\n", req.URL.Path, u.URL, rsp.StatusCode)
+			io.Copy(io.Discard, rsp.Body)
+			rsp.Body.Close()
+		} else {
+			log.Printf("Failing over %v from %v after error: %v\n", req.URL.Path, u.URL, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package ai
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	ups, err := ParseUpstreams("https://a.com/v1|sk-1|2, https://b.com/v1|sk-2,http://localhost:8000")
+	assert.NoError(t, err)
+	assert.Equal(t, []Upstream{
+		{URL: "https://a.com/v1", Key: "sk-1", Weight: 2},
+		{URL: "https://b.com/v1", Key: "sk-2"},
+		{URL: "http://localhost:8000"},
+	}, ups)
+
+	_, err = ParseUpstreams("https://a.com|sk-1|x")
+	assert.Error(t, err)
+
+	_, err = NewPool()
+	assert.Equal(t, ErrNoUpstream, err)
+
+	_, err = NewPool(Upstream{URL: "localhost"})
+	assert.Error(t, err)
+
+	assert.Equal(t, "/v1/models", upstreamPath("/v1", "/v1/models"))
+	assert.Equal(t, "/openai/v1/models", upstreamPath("/openai/v1/", "/v1/models"))
+	assert.Equal(t, "/v1/models", upstreamPath("", "/v1/models"))
+}
+
+func TestPool(t *testing.T) {
+	defer func(d time.Duration) {
+		EjectTime = d
+	}(EjectTime)
+
+	EjectTime = time.Minute
+
+	p, err := NewPool(
+		Upstream{URL: "http://a.com", Weight: 2},
+		Upstream{URL: "http://b.com"},
+	)
+	assert.NoError(t, err)
+
+	// weighted round robin
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, p.next(nil).URL)
+	}
+	assert.Equal(t, []string{
+		"http://a.com", "http://b.com", "http://a.com",
+		"http://a.com", "http://b.com", "http://a.com",
+	}, picked)
+
+	// ejected after a 429
+	a := p.upstreams[0]
+	p.done(a, &http.Response{StatusCode: 429, Header: http.Header{}}, nil)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "http://b.com", p.next(nil).URL)
+	}
+
+	// still used when nothing else is left
+	b := p.upstreams[1]
+	assert.Equal(t, a, p.next(map[*upstream]bool{b: true}))
+
+	status := p.Status()
+	assert.False(t, status[0].Healthy)
+	assert.NotNil(t, status[0].EjectedUntil)
+	assert.Equal(t, 429, status[0].LastStatus)
+	assert.Equal(t, int64(1), status[0].Failures)
+	assert.True(t, status[1].Healthy)
+
+	// back once it succeeds
+	p.done(a, &http.Response{StatusCode: 200}, nil)
+	assert.True(t, p.Status()[0].Healthy)
+}
+
+func TestPoolTransport(t *testing.T) {
+	var calls []string
+
+	upstream := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			calls = append(calls, name+" "+r.URL.Path+" "+r.Header.Get("Authorization")+" "+string(b))
+			w.WriteHeader(status)
+			w.Write([]byte(name))
+		}))
+	}
+
+	down := upstream("down", http.StatusUnauthorized)
+	defer down.Close()
+	up := upstream("up", http.StatusOK)
+	defer up.Close()
+
+	p, err := NewPool(
+		Upstream{URL: down.URL + "/v1", Key: "sk-1"},
+		Upstream{URL: up.URL + "/v1", Key: "sk-2"},
+	)
+	assert.NoError(t, err)
+
+	client := &http.Client{Transport: p.Transport(http.DefaultTransport)}
+
+	// fails over with the body
+	req, _ := http.NewRequestWithContext(context.Background(), "POST", poolURL+"/chat/completions", strings.NewReader(`{}`))
+	rsp, err := client.Do(req)
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	assert.Equal(t, 200, rsp.StatusCode)
+	assert.Equal(t, "up", string(b))
+	assert.Equal(t, []string{
+		"down /v1/chat/completions Bearer sk-1 {}",
+		"up /v1/chat/completions Bearer sk-2 {}",
+	}, calls)
+
+	// the ejected upstream is skipped
+	calls = nil
+
+	rsp, err = client.Get(poolURL + "/models")
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, []string{"up /v1/models Bearer sk-2 "}, calls)
+
+	// the last response is returned when all fail
+	p, _ = NewPool(Upstream{URL: down.URL})
+	client = &http.Client{Transport: p.Transport(http.DefaultTransport)}
+
+	rsp, err = client.Get(poolURL + "/models")
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+}
@@ -0,0 +1,136 @@
+package ai
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultProvider is used for models without a provider prefix
+	DefaultProvider = "openai"
+
+	// registered providers by name
+	Providers = map[string]Provider{}
+
+	// ErrUnsupportedModel is returned when a model can't be resolved
+	ErrUnsupportedModel = errors.New("Unsupported model")
+
+	providerMtx sync.RWMutex
+)
+
+// Provider is a LLM backend e.g openai, azure, ollama, anthropic
+type Provider interface {
+	// Models returns the list of models advertised by the provider
+	Models() []string
+	// Model returns a model served by the provider
+	Model(name string) (Model, error)
+	// String is the name of the provider
+	String() string
+}
+
+// Config for a provider
+type Config struct {
+	// API key for the provider
+	Key string
+	// Base url of the provider api
+	URL string
+	// Models supported by the provider
+	Models []string
+	// Pool of upstreams used instead of the key and url
+	Pool *Pool
+}
+
+// Register a provider and its models as provider/model
+func Register(p Provider) error {
+	providerMtx.Lock()
+	defer providerMtx.Unlock()
+
+	name := p.String()
+	Providers[name] = p
+
+	for _, m := range p.Models() {
+		md, err := p.Model(m)
+		if err != nil {
+			return err
+		}
+		Models[name+"/"+m] = md
+	}
+
+	return nil
+}
+
+// GetProvider returns a registered provider by name
+func GetProvider(name string) (Provider, bool) {
+	providerMtx.RLock()
+	defer providerMtx.RUnlock()
+	p, ok := Providers[name]
+	return p, ok
+}
+
+// GetModel resolves a model by alias e.g gpt-4 or as provider/model e.g ollama/llama3.
+// Models with fallbacks are returned as a chain which tries each in turn.
+// With a CacheTTL deterministic requests are served from the completion cache.
+func GetModel(name string) (Model, error) {
+	md, err := getModel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackMtx.RLock()
+	names := Fallbacks[name]
+	fallbackMtx.RUnlock()
+
+	if len(names) > 0 {
+		md = newChain(name, md, names)
+	}
+
+	if CacheTTL > 0 {
+		md = newCached(md, CacheTTL)
+	}
+
+	return md, nil
+}
+
+func getModel(name string) (Model, error) {
+	if !Allowed(name) {
+		return nil, ErrModelNotAllowed
+	}
+	return resolveModel(name)
+}
+
+// resolveModel looks up the model regardless of the admin rules
+func resolveModel(name string) (Model, error) {
+	// aliases set by the admin
+	ruleMtx.RLock()
+	if target, ok := aliases[name]; ok {
+		name = target
+	}
+	ruleMtx.RUnlock()
+
+	providerMtx.RLock()
+	md, ok := Models[name]
+	providerMtx.RUnlock()
+
+	if ok {
+		return md, nil
+	}
+
+	// split provider/model
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, ErrUnsupportedModel
+	}
+
+	p, ok := GetProvider(parts[0])
+	if !ok {
+		return nil, ErrUnsupportedModel
+	}
+
+	// only the models listed by the upstream once discovered
+	if isDiscovered(parts[0]) {
+		return nil, ErrUnsupportedModel
+	}
+
+	return p.Model(parts[1])
+}
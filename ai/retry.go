@@ -0,0 +1,148 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// Retries is the number of times a failed request is retried
+	Retries = 3
+
+	// Backoff is the initial delay between retries, doubled on each attempt
+	Backoff = 500 * time.Millisecond
+
+	// MaxBackoff caps the delay between retries including Retry-After
+	MaxBackoff = 30 * time.Second
+)
+
+// retryTransport retries requests which fail with 429, 5xx or a network error
+type retryTransport struct {
+	transport http.RoundTripper
+}
+
+// newClient returns a http client which retries failed requests
+func newClient() *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{http.DefaultTransport},
+	}
+}
+
+// newPoolClient returns a http client which fails over the upstreams of the pool then retries
+func newPoolClient(p *Pool) *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{p.Transport(http.DefaultTransport)},
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		r := req
+
+		// replay the body on retry
+		if attempt > 0 {
+			r = req.Clone(ctx)
+			if req.Body != nil {
+				if req.GetBody == nil {
+					return nil, errors.New("request body can't be retried")
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+
+		rsp, err := t.transport.RoundTrip(r)
+		if !retryable(ctx, rsp, err) || attempt >= Retries {
+			return rsp, err
+		}
+
+		delay := backoff(attempt, rsp)
+
+		if rsp != nil {
+			log.Printf("Retrying %v in %v after status %d\n", req.URL.Path, delay, rsp.StatusCode)
+			io.Copy(io.Discard, rsp.Body)
+			rsp.Body.Close()
+		} else {
+			log.Printf("Retrying %v in %v after error: %v\n", req.URL.Path, delay, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryable checks whether a request should be retried
+func retryable(ctx context.Context, rsp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500
+}
+
+// backoff returns the delay before the next attempt using Retry-After
+// if set by the upstream otherwise exponential backoff with full jitter
+func backoff(attempt int, rsp *http.Response) time.Duration {
+	if d, ok := retryAfter(rsp); ok {
+		if d > MaxBackoff {
+			return MaxBackoff
+		}
+		return d
+	}
+
+	max := Backoff << uint(attempt)
+	if max > MaxBackoff || max <= 0 {
+		max = MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// retryAfter parses the Retry-After header as seconds or a http date
+func retryAfter(rsp *http.Response) (time.Duration, bool) {
+	if rsp == nil {
+		return 0, false
+	}
+
+	// openai specific milliseconds header
+	if v := rsp.Header.Get("Retry-After-Ms"); len(v) > 0 {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+
+	v := rsp.Header.Get("Retry-After")
+	if len(v) == 0 {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
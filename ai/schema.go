@@ -0,0 +1,329 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+var (
+	// MaxSchemaRetries is the number of times the model is asked to fix a reply which doesn't match the schema
+	MaxSchemaRetries = 2
+
+	// ErrSchema is returned when the reply doesn't match the schema after retrying
+	ErrSchema = errors.New("reply does not match the schema")
+)
+
+// SchemaFor generates a JSON schema for a Go type using the json tags
+func SchemaFor(v interface{}) (json.RawMessage, error) {
+	def, err := jsonschema.GenerateSchemaForType(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(def)
+}
+
+// ParseSchema checks the schema is a JSON object
+func ParseSchema(schema json.RawMessage) error {
+	var s map[string]interface{}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	return nil
+}
+
+// ValidateSchema returns the errors of the data against the schema. Supports type, properties,
+// required, additionalProperties, items, enum, const, anyOf, the min/max keywords and local $ref.
+func ValidateSchema(schema json.RawMessage, data []byte) []string {
+	var root map[string]interface{}
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return []string{fmt.Sprintf("invalid schema: %v", err)}
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+
+	return validate(root, root, v, "$")
+}
+
+func validate(root, s map[string]interface{}, v interface{}, path string) []string {
+	// resolve references e.g #/$defs/Item
+	if ref, ok := s["$ref"].(string); ok {
+		def := resolveRef(root, ref)
+		if def == nil {
+			return []string{fmt.Sprintf("%s: unknown reference %s", path, ref)}
+		}
+		return validate(root, def, v, path)
+	}
+
+	if opts, ok := s["anyOf"].([]interface{}); ok {
+		for _, o := range opts {
+			if os, ok := o.(map[string]interface{}); ok && len(validate(root, os, v, path)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: does not match any of the schemas", path)}
+	}
+
+	var errs []string
+
+	if t, ok := s["type"]; ok && !isType(v, t) {
+		return []string{fmt.Sprintf("%s: expected %v got %s", path, t, typeOf(v))}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok && !contains(enum, v) {
+		errs = append(errs, fmt.Sprintf("%s: must be one of %v", path, enum))
+	}
+
+	if c, ok := s["const"]; ok && !equal(c, v) {
+		errs = append(errs, fmt.Sprintf("%s: must be %v", path, c))
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+
+		if req, ok := s["required"].([]interface{}); ok {
+			for _, r := range req {
+				if name, ok := r.(string); ok {
+					if _, ok := val[name]; !ok {
+						errs = append(errs, fmt.Sprintf("%s: missing required property %s", path, name))
+					}
+				}
+			}
+		}
+
+		// stable order of errors
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if ps, ok := props[k].(map[string]interface{}); ok {
+				errs = append(errs, validate(root, ps, val[k], path+"."+k)...)
+				continue
+			}
+			if ap, ok := s["additionalProperties"].(bool); ok && !ap {
+				errs = append(errs, fmt.Sprintf("%s: unexpected property %s", path, k))
+			} else if ap, ok := s["additionalProperties"].(map[string]interface{}); ok {
+				errs = append(errs, validate(root, ap, val[k], path+"."+k)...)
+			}
+		}
+	case []interface{}:
+		if n, ok := number(s["minItems"]); ok && float64(len(val)) < n {
+			errs = append(errs, fmt.Sprintf("%s: must have at least %v items", path, n))
+		}
+		if n, ok := number(s["maxItems"]); ok && float64(len(val)) > n {
+			errs = append(errs, fmt.Sprintf("%s: must have at most %v items", path, n))
+		}
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				errs = append(errs, validate(root, items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		if n, ok := number(s["minLength"]); ok && float64(len([]rune(val))) < n {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %v characters", path, n))
+		}
+		if n, ok := number(s["maxLength"]); ok && float64(len([]rune(val))) > n {
+			errs = append(errs, fmt.Sprintf("%s: must be at most %v characters", path, n))
+		}
+	case float64:
+		if n, ok := number(s["minimum"]); ok && val < n {
+			errs = append(errs, fmt.Sprintf("%s: must be >= %v", path, n))
+		}
+		if n, ok := number(s["maximum"]); ok && val > n {
+			errs = append(errs, fmt.Sprintf("%s: must be <= %v", path, n))
+		}
+	}
+
+	return errs
+}
+
+// resolveRef finds a local reference e.g #/$defs/Item or #/definitions/Item
+func resolveRef(root map[string]interface{}, ref string) map[string]interface{} {
+	if ref == "#" {
+		return root
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+
+	var node interface{} = root
+	for _, part := range strings.Split(ref[2:], "/") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[part]
+	}
+
+	def, _ := node.(map[string]interface{})
+	return def
+}
+
+// isType checks the value against a type or list of types
+func isType(v interface{}, t interface{}) bool {
+	switch tt := t.(type) {
+	case []interface{}:
+		for _, t := range tt {
+			if isType(v, t) {
+				return true
+			}
+		}
+		return false
+	case string:
+		switch tt {
+		case "integer":
+			f, ok := v.(float64)
+			return ok && f == math.Trunc(f)
+		case "number":
+			_, ok := v.(float64)
+			return ok
+		default:
+			return typeOf(v) == tt
+		}
+	}
+	return true
+}
+
+// typeOf returns the JSON type of a decoded value
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func number(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func equal(a, b interface{}) bool {
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return string(ab) == string(bb)
+}
+
+func contains(list []interface{}, v interface{}) bool {
+	for _, l := range list {
+		if equal(l, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimJSON removes markdown code fences around a JSON reply
+func trimJSON(reply string) string {
+	s := strings.TrimSpace(reply)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimPrefix(s, "json")
+	s = strings.TrimSuffix(s, "```")
+	return strings.TrimSpace(s)
+}
+
+// schemaPrompt instructs the model to reply with JSON
+func schemaPrompt(schema json.RawMessage) string {
+	return "Reply only with a JSON object which matches this JSON schema:\n" + string(schema)
+}
+
+// runSchema completes the request and validates the reply against the schema,
+// the model is re-prompted with the errors until the reply is valid
+func runSchema(ctx context.Context, md Model, req *Request) (*Response, error) {
+	next := *req
+	usage := new(Usage)
+
+	for i := 0; ; i++ {
+		rsp, err := runTools(ctx, md, &next)
+		if err != nil {
+			return nil, err
+		}
+
+		usage.Add(rsp.Usage)
+		rsp.Usage = usage
+		rsp.Reply = trimJSON(rsp.Reply)
+
+		errs := ValidateSchema(req.Schema, []byte(rsp.Reply))
+		if len(errs) == 0 {
+			return rsp, nil
+		}
+
+		if i >= MaxSchemaRetries {
+			return nil, fmt.Errorf("%w: %s", ErrSchema, strings.Join(errs, "; "))
+		}
+
+		// ask the model to fix the reply
+		next.Context = append(append([]Context{}, next.Context...), Context{
+			Prompt: next.Prompt,
+			Reply:  rsp.Reply,
+		})
+		next.Prompt = "The reply does not match the JSON schema:\n- " + strings.Join(errs, "\n- ") +
+			"\nReply again with only the corrected JSON."
+		next.Calls = nil
+		next.Images = nil
+	}
+}
+
+// RunJSON completes the request with a reply matching the schema and decodes it into v.
+// The schema is generated from v if the request has none.
+func RunJSON(ctx context.Context, md Model, req *Request, v interface{}) (*Response, error) {
+	if len(req.Schema) == 0 {
+		schema, err := SchemaFor(v)
+		if err != nil {
+			return nil, err
+		}
+		req.Schema = schema
+	}
+
+	rsp, err := Run(ctx, md, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(rsp.Reply), v); err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// CompleteJSON completes the prompt with the default model and decodes the reply into v
+func CompleteJSON(prompt, user string, v interface{}, ctx ...Context) error {
+	md, err := GetModel(DefaultModel)
+	if err != nil {
+		return err
+	}
+	_, err = RunJSON(context.Background(), md, &Request{
+		Prompt:  prompt,
+		User:    user,
+		Context: ctx,
+		Tools:   ListTools(),
+	}, v)
+	return err
+}
@@ -0,0 +1,126 @@
+package ai
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/asim/turbo/log"
+	"github.com/pkoukk/tiktoken-go"
+	loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+var (
+	// DefaultOutput is the number of tokens reserved for the reply
+	DefaultOutput = 1024
+
+	// DefaultEncoding is the BPE encoding used for unknown model families
+	DefaultEncoding = tiktoken.MODEL_CL100K_BASE
+
+	// Limits for model families matched by the longest prefix of the model name
+	Limits = map[string]Limit{
+		"gpt-3.5-turbo":     {Context: 16385, Output: 1024, MaxOutput: 4096, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"gpt-3.5-turbo-16k": {Context: 16384, Output: 2048, MaxOutput: 4096, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"gpt-4":             {Context: 8192, Output: 1024, MaxOutput: 8192, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"gpt-4-32k":         {Context: 32768, Output: 2048, MaxOutput: 32768, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"gpt-4-turbo":       {Context: 128000, Output: 4096, MaxOutput: 4096, Vision: true, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"gpt-4o":            {Context: 128000, Output: 4096, MaxOutput: 16384, Vision: true, Encoding: tiktoken.MODEL_O200K_BASE},
+		"claude":            {Context: 200000, Output: 4096, MaxOutput: 8192, MaxTemperature: 1, Vision: true, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"llama3":            {Context: 8192, Output: 1024, MaxOutput: 8192, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"llama3.2-vision":   {Context: 131072, Output: 1024, MaxOutput: 8192, Vision: true, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"llava":             {Context: 4096, Output: 1024, MaxOutput: 4096, Vision: true, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"mistral":           {Context: 32768, Output: 1024, MaxOutput: 32768, Encoding: tiktoken.MODEL_CL100K_BASE},
+		"mock":              {Context: 8192, Output: 1024, MaxOutput: 8192, Vision: true, Encoding: tiktoken.MODEL_CL100K_BASE},
+	}
+
+	// loaded encoders by encoding name
+	encMtx   sync.Mutex
+	encoders = map[string]*tiktoken.Tiktoken{}
+)
+
+// Limit is the token budget for a model
+type Limit struct {
+	// Context window in tokens
+	Context int
+	// Tokens reserved for the output
+	Output int
+	// Max tokens the model can output, defaults to the context window
+	MaxOutput int
+	// Max sampling temperature, defaults to 2
+	MaxTemperature float32
+	// BPE encoding used to count tokens
+	Encoding string
+	// Whether images can be sent
+	Vision bool
+}
+
+func init() {
+	// use the embedded BPE files rather than downloading them
+	tiktoken.SetBpeLoader(loader.NewOfflineLoader())
+}
+
+// GetLimit returns the token limit for a model
+func GetLimit(model string) Limit {
+	var match string
+
+	for prefix := range Limits {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+
+	if len(match) > 0 {
+		return Limits[match]
+	}
+
+	return Limit{
+		Context:  DefaultLimit,
+		Output:   DefaultOutput,
+		Encoding: DefaultEncoding,
+	}
+}
+
+func encoder(encoding string) *tiktoken.Tiktoken {
+	encMtx.Lock()
+	defer encMtx.Unlock()
+
+	if enc, ok := encoders[encoding]; ok {
+		return enc
+	}
+
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		log.Printf("Failed to load encoding %v: %v\n", encoding, err)
+		return nil
+	}
+
+	encoders[encoding] = enc
+	return enc
+}
+
+// Tokens returns the number of tokens in the text for a given model
+func Tokens(model, text string) int {
+	enc := encoder(GetLimit(model).Encoding)
+	if enc == nil {
+		// rough estimate of 4 chars per token
+		return (len(text) + 3) / 4
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// countTokens counts the tokens for a list of messages including the per message overhead
+func countTokens(model string, msgs ...Message) int {
+	var count int
+
+	for _, m := range msgs {
+		// every message has <|start|>{role}<|message|>...<|end|>
+		count += 3 + Tokens(model, m.Role) + Tokens(model, m.Content)
+
+		for _, c := range m.ToolCalls {
+			count += Tokens(model, c.Name) + Tokens(model, c.Arguments)
+		}
+
+		count += len(m.Images) * ImageTokens
+	}
+
+	return count
+}
@@ -0,0 +1,266 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/asim/turbo/log"
+)
+
+var (
+	// MaxToolRounds is the max number of times the model can call tools for a prompt
+	MaxToolRounds = 10
+
+	// ErrToolRounds is returned when the model still calls tools after MaxToolRounds
+	ErrToolRounds = errors.New("too many tool rounds")
+
+	// registered tools by name
+	Tools = map[string]*Tool{}
+
+	toolMtx sync.RWMutex
+)
+
+// Tool is a Go function the model can call
+type Tool struct {
+	// Name of the tool
+	Name string
+	// Description of what the tool does
+	Description string
+	// JSON schema of the parameters
+	Parameters json.RawMessage
+	// Handler called with the JSON arguments returns the result
+	Handler func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// ToolCall is a call to a tool made by the model
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+}
+
+// RegisterTool makes a tool available to the model
+func RegisterTool(t *Tool) error {
+	if len(t.Name) == 0 {
+		return errors.New("tool name required")
+	}
+	if t.Handler == nil {
+		return errors.New("tool handler required")
+	}
+
+	toolMtx.Lock()
+	Tools[t.Name] = t
+	toolMtx.Unlock()
+	return nil
+}
+
+// ListTools returns the registered tools
+func ListTools() []*Tool {
+	toolMtx.RLock()
+	defer toolMtx.RUnlock()
+
+	var tools []*Tool
+	for _, t := range Tools {
+		tools = append(tools, t)
+	}
+
+	// stable order
+	sort.Slice(tools, func(i, j int) bool {
+		return tools[i].Name < tools[j].Name
+	})
+
+	return tools
+}
+
+// schema returns the parameters or an empty object schema
+func (t *Tool) schema() json.RawMessage {
+	if len(t.Parameters) == 0 {
+		return json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	return t.Parameters
+}
+
+// Call the tool handler and set the result, errors are returned to the model
+func Call(ctx context.Context, call ToolCall) ToolCall {
+	toolMtx.RLock()
+	t, ok := Tools[call.Name]
+	toolMtx.RUnlock()
+
+	if !ok {
+		call.Result = fmt.Sprintf("error: unknown tool %s", call.Name)
+		return call
+	}
+
+	args := json.RawMessage(call.Arguments)
+	if len(args) == 0 {
+		args = json.RawMessage(`{}`)
+	}
+
+	res, err := t.Handler(ctx, args)
+	if err != nil {
+		log.Printf("Error calling tool %v: %v\n", call.Name, err)
+		call.Result = fmt.Sprintf("error: %v", err)
+		return call
+	}
+
+	call.Result = res
+	return call
+}
+
+// Run completes a request calling tools until the model replies with an answer.
+// The response includes the tool calls made along the way.
+// Replies to requests with a schema are validated and the model is asked to fix them.
+func Run(ctx context.Context, md Model, req *Request) (*Response, error) {
+	if err := checkVision(md, req); err != nil {
+		return nil, err
+	}
+
+	if len(req.Schema) > 0 {
+		return runSchema(ctx, md, req)
+	}
+
+	return runTools(ctx, md, req)
+}
+
+// withCalls copies the request so the tool calls aren't added to the caller's
+func withCalls(req *Request) *Request {
+	next := *req
+	next.Calls = append([]ToolCall{}, req.Calls...)
+	return &next
+}
+
+// runTools completes the request calling tools until there's an answer
+func runTools(ctx context.Context, md Model, req *Request) (*Response, error) {
+	var calls []ToolCall
+
+	req = withCalls(req)
+
+	// tokens used across all rounds
+	usage := new(Usage)
+
+	for i := 0; ; i++ {
+		rsp, err := md.Complete(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		usage.Add(rsp.Usage)
+
+		// final answer
+		if len(rsp.ToolCalls) == 0 {
+			rsp.ToolCalls = calls
+			rsp.Usage = usage
+			return rsp, nil
+		}
+
+		if i >= MaxToolRounds {
+			return nil, ErrToolRounds
+		}
+
+		// call the tools and feed back the results
+		for _, c := range rsp.ToolCalls {
+			c = Call(ctx, c)
+			calls = append(calls, c)
+			req.Calls = append(req.Calls, c)
+		}
+	}
+}
+
+// RunStream streams a request calling tools until the model replies with an answer.
+// Tool calls are sent on the channel along with their result once called. If the
+// model still calls tools after MaxToolRounds the stream ends with FinishToolRounds.
+// The usage of each round is sent as it's reported by the model.
+// The channel is closed when done or the context is cancelled. Replies to requests
+// with a schema are only sent once validated.
+func RunStream(ctx context.Context, md Model, req *Request) (chan *Response, error) {
+	if err := checkVision(md, req); err != nil {
+		return nil, err
+	}
+
+	if len(req.Schema) > 0 {
+		return streamSchema(ctx, md, req), nil
+	}
+
+	req = withCalls(req)
+
+	stream, err := md.Stream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer close(ch)
+
+		for i := 0; ; i++ {
+			var calls []ToolCall
+
+			for rsp := range stream {
+				if len(rsp.ToolCalls) > 0 {
+					calls = append(calls, rsp.ToolCalls...)
+					continue
+				}
+				ch <- rsp
+			}
+
+			// final answer or cancelled
+			if len(calls) == 0 || ctx.Err() != nil {
+				return
+			}
+
+			// the tools asked for aren't called
+			if i >= MaxToolRounds {
+				log.Printf("Error streaming chat: %v\n", ErrToolRounds)
+				ch <- &Response{FinishReason: FinishToolRounds}
+				return
+			}
+
+			// call the tools and feed back the results
+			for _, c := range calls {
+				c = Call(ctx, c)
+				req.Calls = append(req.Calls, c)
+				ch <- &Response{ToolCalls: []ToolCall{c}}
+			}
+
+			stream, err = md.Stream(ctx, req)
+			if err != nil {
+				log.Printf("Error creating chat stream: %v\n", err)
+				ch <- &Response{FinishReason: FinishError}
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// streamSchema runs the request with a schema and sends the validated reply
+func streamSchema(ctx context.Context, md Model, req *Request) chan *Response {
+	ch := make(chan *Response, 100)
+
+	go func() {
+		defer close(ch)
+
+		rsp, err := runSchema(ctx, md, req)
+		if err != nil {
+			log.Printf("Error running schema request: %v\n", err)
+			ch <- &Response{FinishReason: FinishError}
+			return
+		}
+
+		for _, c := range rsp.ToolCalls {
+			ch <- &Response{ToolCalls: []ToolCall{c}}
+		}
+
+		ch <- &Response{Reply: rsp.Reply, Model: rsp.Model}
+		ch <- &Response{Usage: rsp.Usage, FinishReason: rsp.FinishReason}
+	}()
+
+	return ch
+}
@@ -0,0 +1,92 @@
+package ai
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	// Prices per million tokens by model in USD used to estimate cost
+	Prices = map[string]Price{
+		"gpt-3":                  {Prompt: 0.5, Completion: 1.5},
+		"gpt-4":                  {Prompt: 30, Completion: 60},
+		"gpt-3.5-turbo":          {Prompt: 0.5, Completion: 1.5},
+		"gpt-4o":                 {Prompt: 2.5, Completion: 10},
+		"gpt-4o-mini":            {Prompt: 0.15, Completion: 0.6},
+		"text-embedding-3-small": {Prompt: 0.02},
+	}
+
+	priceMtx sync.RWMutex
+)
+
+// Usage is the tokens used by a request
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Price of a model per million tokens in USD
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Add the usage of another request
+func (u *Usage) Add(o *Usage) {
+	if o == nil {
+		return
+	}
+	u.PromptTokens += o.PromptTokens
+	u.CompletionTokens += o.CompletionTokens
+	u.TotalTokens += o.TotalTokens
+}
+
+// SetPrice sets the price of a model per million tokens
+func SetPrice(model string, p Price) {
+	priceMtx.Lock()
+	Prices[model] = p
+	priceMtx.Unlock()
+}
+
+// GetPrice returns the price of a model or the longest model prefix
+// e.g gpt-4o-2024-05-13 is priced as gpt-4o
+func GetPrice(model string) (Price, bool) {
+	priceMtx.RLock()
+	defer priceMtx.RUnlock()
+
+	if p, ok := Prices[model]; ok {
+		return p, true
+	}
+
+	var price Price
+	var match string
+
+	for name, p := range Prices {
+		if strings.HasPrefix(model, name) && len(name) > len(match) {
+			price = p
+			match = name
+		}
+	}
+
+	return price, len(match) > 0
+}
+
+// Cost estimates the cost of the usage in USD, unknown models are free
+func Cost(model string, u Usage) float64 {
+	p, ok := GetPrice(model)
+	if !ok {
+		return 0
+	}
+
+	return (float64(u.PromptTokens)*p.Prompt + float64(u.CompletionTokens)*p.Completion) / 1e6
+}
+
+// newUsage returns the usage for the prompt and completion tokens
+func newUsage(prompt, completion int) *Usage {
+	return &Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+}
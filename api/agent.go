@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+)
+
+var (
+	// aliases are lowercase words e.g coder or code-review
+	aliasRegexp = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+)
+
+// ChatAgent routes an @alias mentioned in a chat to a model or persona
+type ChatAgent struct {
+	Alias string `json:"alias"`
+	// model to use, defaults to the chat model
+	Model string `json:"model,omitempty"`
+	// persona to use, defaults to the chat system prompt
+	PersonaID string `json:"persona_id,omitempty"`
+}
+
+// chatAgents returns the agents of a chat by alias including the global ones
+func chatAgents(chat *Chat) map[string]ChatAgent {
+	agents := map[string]ChatAgent{}
+
+	for alias, model := range ai.Agents {
+		agents[alias] = ChatAgent{Alias: alias, Model: model}
+	}
+
+	// chat agents take priority
+	for _, a := range chat.Agents {
+		agents[strings.ToLower(a.Alias)] = a
+	}
+
+	return agents
+}
+
+// agentAliases returns the sorted aliases of the agents
+func agentAliases(agents map[string]ChatAgent) []string {
+	var aliases []string
+	for alias := range agents {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// agentSystem returns the system prompt for an agent
+func agentSystem(chat *Chat, agent ChatAgent) string {
+	if len(agent.PersonaID) == 0 {
+		return getSystem(chat)
+	}
+
+	var persona Persona
+	if err := db.Where("id = ?", agent.PersonaID).First(&persona).Error; err != nil {
+		return getSystem(chat)
+	}
+
+	return persona.System
+}
+
+// checkAgents validates the agents of a chat and the user's access to their personas
+func checkAgents(agents []ChatAgent, userID string) error {
+	seen := map[string]bool{}
+
+	for i, a := range agents {
+		alias := strings.ToLower(strings.TrimPrefix(a.Alias, "@"))
+
+		if !aliasRegexp.MatchString(alias) {
+			return errors.New("invalid agent alias " + a.Alias)
+		}
+		if seen[alias] {
+			return errors.New("duplicate agent alias " + a.Alias)
+		}
+		seen[alias] = true
+
+		if len(a.Model) > 0 {
+			if _, err := ai.GetModel(a.Model); err != nil {
+				return errors.New("invalid agent model " + a.Model)
+			}
+		}
+
+		if len(a.PersonaID) > 0 {
+			if _, err := GetPersona(a.PersonaID, userID); err != nil {
+				return errors.New("invalid agent persona " + a.PersonaID)
+			}
+		}
+
+		agents[i].Alias = alias
+	}
+
+	return nil
+}
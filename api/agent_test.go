@@ -0,0 +1,80 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatAgents(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Persona{}, &GroupMember{}, &ChatUser{})
+
+	persona := Persona{
+		ID:     uuid.New().String(),
+		Name:   "reviewer",
+		System: "You review code",
+		UserID: "user-1",
+	}
+	db.Create(&persona)
+
+	agents := []ChatAgent{
+		{Alias: "@Reviewer", PersonaID: persona.ID},
+		{Alias: "coder"},
+	}
+
+	assert.NoError(t, checkAgents(agents, "user-1"))
+	assert.Equal(t, "reviewer", agents[0].Alias)
+
+	// no access to the persona
+	assert.Error(t, checkAgents([]ChatAgent{{Alias: "reviewer", PersonaID: persona.ID}}, "user-2"))
+
+	// bad aliases
+	assert.Error(t, checkAgents([]ChatAgent{{Alias: "two words"}}, "user-1"))
+	assert.Error(t, checkAgents([]ChatAgent{{Alias: "a"}, {Alias: "A"}}, "user-1"))
+
+	chat := &Chat{System: "Be brief", Agents: agents}
+
+	// includes the global agents
+	all := chatAgents(chat)
+	assert.Equal(t, []string{"chatgpt", "coder", "reviewer"}, agentAliases(all))
+
+	// persona or chat system prompt
+	assert.Equal(t, "You review code", agentSystem(chat, all["reviewer"]))
+	assert.Equal(t, "Be brief", agentSystem(chat, all["coder"]))
+
+	// mentions but not emails
+	alias, prompted := ai.IsPrompt("@reviewer take a look", 2, agentAliases(all)...)
+	assert.True(t, prompted)
+	assert.Equal(t, "reviewer", alias)
+
+	_, prompted = ai.IsPrompt("(@coder) and @reviewer", 2, agentAliases(all)...)
+	assert.True(t, prompted)
+
+	_, prompted = ai.IsPrompt("mail bob@chatgpt.com or bob@coder", 2, agentAliases(all)...)
+	assert.False(t, prompted)
+
+	// removed users aren't counted
+	chatID := uuid.New().String()
+	db.Create(&ChatUser{ChatID: chatID, UserID: "user-1"})
+	db.Create(&ChatUser{ChatID: chatID, UserID: "user-2"})
+	db.Where("chat_id = ? AND user_id = ?", chatID, "user-2").Delete(&ChatUser{})
+
+	users, err := GetChatUsers(chatID)
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, 1, activeChatUsers(users))
+
+	_, prompted = ai.IsPrompt("hello", activeChatUsers(users), agentAliases(all)...)
+	assert.True(t, prompted)
+}
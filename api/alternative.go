@@ -0,0 +1,503 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/event"
+	"github.com/asim/turbo/log"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Alternative is one of the replies generated for a message. The message
+// reply is always the selected alternative.
+type Alternative struct {
+	gorm.Model
+	ID        string `json:"id"`
+	MessageID string `json:"message_id" gorm:"index"`
+	Reply     string `json:"reply"`
+	LLM       string `json:"model"`
+	// tools called by the model and their results
+	ToolCalls []ai.ToolCall `json:"tool_calls,omitempty" gorm:"serializer:json"`
+	// why the reply finished e.g cancelled
+	FinishReason string `json:"finish_reason,omitempty"`
+	// generation params used for the reply
+	Params ai.Params `json:"params" gorm:"serializer:json"`
+	// tokens used for the reply
+	Usage ai.Usage `json:"usage" gorm:"embedded"`
+	// whether it's the reply used in the chat
+	Selected bool `json:"selected"`
+}
+
+type ChatRegenerateRequest struct {
+	// Message id of the reply to regenerate
+	ID string `json:"id" valid:"required"`
+	// model to use, defaults to the chat or agent model
+	Model  string `json:"model,omitempty"`
+	Stream bool   `json:"stream,omitempty"`
+	// params override those of the message
+	ai.Params
+}
+
+type ChatRegenerateResponse struct {
+	// If stream is specified the reply is sent via /chat/stream
+	Message Message `json:"message"`
+}
+
+type ChatSelectRequest struct {
+	// Message id
+	ID string `json:"id" valid:"required"`
+	// Alternative id to select
+	AlternativeID string `json:"alternative_id" valid:"required"`
+}
+
+type ChatSelectResponse struct {
+	Message Message `json:"message"`
+}
+
+// newAlternative returns the reply of a message as an alternative
+func newAlternative(m *Message) *Alternative {
+	return &Alternative{
+		ID:           uuid.New().String(),
+		MessageID:    m.ID,
+		Reply:        m.Reply,
+		LLM:          m.LLM,
+		ToolCalls:    m.ToolCalls,
+		FinishReason: m.FinishReason,
+		Params:       m.Params,
+		Usage:        m.Usage,
+		Selected:     true,
+	}
+}
+
+// GetAlternatives returns the alternative replies of the messages by message id
+func GetAlternatives(ids []string) (map[string][]Alternative, error) {
+	alts := map[string][]Alternative{}
+
+	if len(ids) == 0 {
+		return alts, nil
+	}
+
+	var list []Alternative
+
+	res := db.Where("message_id IN ?", ids).Order("created_at").Find(&list)
+	if err := res.Error; err != nil {
+		return nil, err
+	}
+
+	for _, a := range list {
+		alts[a.MessageID] = append(alts[a.MessageID], a)
+	}
+
+	return alts, nil
+}
+
+// saveAlternative stores the message reply as the selected alternative
+func saveAlternative(m *Message) error {
+	if err := db.Model(&Alternative{}).Where("message_id = ?", m.ID).Update("selected", false).Error; err != nil {
+		return err
+	}
+
+	return db.Create(newAlternative(m)).Error
+}
+
+// selectAlternative sets the message reply to the alternative
+func selectAlternative(m *Message, alt *Alternative) error {
+	if err := db.Model(&Alternative{}).Where("message_id = ?", m.ID).Update("selected", false).Error; err != nil {
+		return err
+	}
+
+	alt.Selected = true
+
+	if err := db.Update(alt).Error; err != nil {
+		return err
+	}
+
+	m.Reply = alt.Reply
+	m.LLM = alt.LLM
+	m.ToolCalls = alt.ToolCalls
+	m.FinishReason = alt.FinishReason
+	m.Params = alt.Params
+	m.Usage = alt.Usage
+
+	return db.Update(m).Error
+}
+
+// regenerateContext returns the summary and turns before a message
+func regenerateContext(chat *Chat, m *Message, limit int) (string, []ai.Context, error) {
+	var summary string
+	var since time.Time
+
+	// use the summary if it's of turns before the message
+	if chat.Strategy == StrategySummary {
+		s, err := getSummary(chat.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		if s.Until.Before(m.CreatedAt) {
+			summary = s.Summary
+			since = s.Until
+		}
+	}
+
+	var messages []Message
+
+	res := db.Where("chat_id = ? AND otr = ? AND created_at > ? AND created_at < ?", chat.ID, false, since, m.CreatedAt).
+		Order("created_at desc").Limit(limit).Find(&messages)
+	if err := res.Error; err != nil {
+		return "", nil, err
+	}
+
+	context := []ai.Context{}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		context = append(context, ai.Context{
+			Prompt: messages[i].Prompt,
+			Reply:  messages[i].Reply,
+			Images: contextImages(messages[i].Images),
+		})
+	}
+
+	return summary, context, nil
+}
+
+// chatMessage returns a message and its chat if the user is in the chat
+func chatMessage(id, userID string) (*Message, *Chat, error) {
+	var m Message
+	if err := db.Where("id = ?", id).First(&m).Error; err != nil {
+		return nil, nil, err
+	}
+
+	chat, err := GetChat(m.ChatID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if chat.UserID != userID {
+		if _, err := GetChatUser(chat.ID, userID); err != nil {
+			return nil, nil, ErrUnauthorized
+		}
+	}
+
+	return &m, chat, nil
+}
+
+// ChatRegenerate re-runs the prompt of a message with the same context
+// and stores the reply as a new alternative
+func ChatRegenerate(w http.ResponseWriter, r *http.Request) {
+	// latency of the reply
+	start := time.Now()
+
+	r.ParseForm()
+
+	// attempt to pull user session from context
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		// no session, don't proceed
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	c := new(ChatRegenerateRequest)
+	c.ID = r.Form.Get("id")
+	c.Model = r.Form.Get("model")
+
+	// stream back response via /chat/stream
+	if v := r.Form.Get("stream"); v == "true" {
+		c.Stream = true
+	}
+
+	// generation params
+	params, err := parseParams(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Params = params
+
+	if err := decode(r, c); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	m, chat, err := chatMessage(c.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	// nothing was generated for off the record or unprompted messages
+	if m.OTR || (len(m.Agent) == 0 && len(m.Reply) == 0) {
+		http.Error(w, "message has no reply to regenerate", http.StatusBadRequest)
+		return
+	}
+
+	// check the user and group are within their quota
+	if err := checkQuota(sess.UserID, chat.GroupID); err != nil {
+		quotaError(w, err)
+		return
+	}
+
+	// the agent's model unless another is asked for
+	agent := chatAgents(chat)[m.Agent]
+
+	llm := chat.LLM
+	if len(agent.Model) > 0 {
+		llm = agent.Model
+	}
+	if len(c.Model) > 0 {
+		llm = c.Model
+	}
+
+	model, err := ai.GetModel(llm)
+	if err != nil {
+		http.Error(w, "Unsupported model "+llm, http.StatusBadRequest)
+		return
+	}
+
+	// message params overridden by the request
+	params = m.Params.Merge(c.Params)
+
+	if err := validateParams(llm, params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the images attached to the prompt need a vision model
+	vision := ai.SupportsVision(model.String())
+
+	if len(m.Images) > 0 && !vision {
+		http.Error(w, "Model "+llm+" does not support images", http.StatusBadRequest)
+		return
+	}
+
+	summary, context, err := regenerateContext(chat, m, DefaultContext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	images := contextImages(m.Images)
+
+	if err := loadImages(images); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if vision {
+		if err := loadContextImages(context); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// the first reply is kept as an alternative
+	alts, err := GetAlternatives([]string{m.ID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(alts[m.ID]) == 0 {
+		if err := db.Create(newAlternative(m)).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// make request on behalf of user
+	key := fmt.Sprintf("%s-%s", sess.UserID, chat.ID)
+	user := base64.StdEncoding.EncodeToString([]byte(key))
+
+	// the request to the model with the same sources
+	req := &ai.Request{
+		Prompt:  m.Prompt,
+		Images:  images,
+		Schema:  m.Schema,
+		User:    user,
+		System:  withCitations(agentSystem(chat, agent), m.Citations),
+		Summary: summary,
+		Context: context,
+		Tools:   ai.ListTools(),
+		Params:  &params,
+	}
+
+	// the new reply
+	m.LLM = llm
+	m.Params = params
+	m.FinishReason = ""
+	m.Usage = ai.Usage{}
+
+	if c.Stream {
+		// cancellable via /chat/cancel
+		ctx, done := newGeneration(m.ID)
+
+		words, err := ai.RunStream(ctx, model, req)
+		if err != nil {
+			done()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := db.Update(m).Error; err != nil {
+			done()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		wait := make(chan *Message, 1)
+		wait <- m
+		close(wait)
+
+		// the reply is streamed
+		m.Reply = ""
+
+		// publish the start of the new reply
+		event.Publish(chat.ID, &ChatStreamResponse{
+			ID:      m.ID,
+			Message: *m,
+			Partial: true,
+		})
+
+		go func() {
+			defer done()
+
+			streamWords(ctx, r, sess, *chat, words, wait, context, start)
+
+			// store the streamed reply
+			var msg Message
+			if err := db.Where("id = ?", m.ID).First(&msg).Error; err != nil {
+				log.Printf("Error getting message %v: %v\n", m.ID, err)
+				return
+			}
+			if err := saveAlternative(&msg); err != nil {
+				log.Printf("Error saving alternative for message %v: %v\n", m.ID, err)
+			}
+
+			// rebuild the context with the new reply
+			cache.Delete(chat.ID)
+		}()
+
+		respond(w, r, ChatRegenerateResponse{Message: *m})
+		return
+	}
+
+	rsp, err := ai.Run(r.Context(), model, req)
+	if errors.Is(err, ai.ErrSchema) || errors.Is(err, ai.ErrToolRounds) {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.Reply = rsp.Reply
+	m.ToolCalls = rsp.ToolCalls
+	m.FinishReason = rsp.FinishReason
+	// set the fallback model if used
+	if len(rsp.Model) > 0 {
+		m.LLM = rsp.Model
+	}
+	if rsp.Usage != nil {
+		m.Usage = *rsp.Usage
+	}
+
+	if err := db.Update(m).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveAlternative(m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// rebuild the context with the new reply
+	cache.Delete(chat.ID)
+
+	// record the tokens used
+	go saveUsage(m, r.URL.Path)
+
+	// publish the new reply
+	event.Publish(chat.ID, &ChatStreamResponse{
+		ID:           m.ID,
+		Message:      *m,
+		Partial:      false,
+		FinishReason: m.FinishReason,
+		Usage:        &m.Usage,
+		Latency:      time.Since(start).Milliseconds(),
+	})
+
+	respond(w, r, ChatRegenerateResponse{Message: *m})
+}
+
+// ChatSelect selects one of the alternative replies of a message
+func ChatSelect(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// attempt to pull user session from context
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		// no session, don't proceed
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	c := new(ChatSelectRequest)
+	c.ID = r.Form.Get("id")
+	c.AlternativeID = r.Form.Get("alternative_id")
+
+	if err := decode(r, c); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	m, chat, err := chatMessage(c.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	var alt Alternative
+	if err := db.Where("id = ? AND message_id = ?", c.AlternativeID, m.ID).First(&alt).Error; err != nil {
+		http.Error(w, "alternative not found", http.StatusNotFound)
+		return
+	}
+
+	if err := selectAlternative(m, &alt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// rebuild the context with the selected reply
+	cache.Delete(chat.ID)
+
+	alts, err := GetAlternatives([]string{m.ID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.Alternatives = alts[m.ID]
+
+	// publish the selected reply
+	event.Publish(chat.ID, &ChatStreamResponse{
+		ID:      m.ID,
+		Message: *m,
+		Partial: false,
+	})
+
+	respond(w, r, ChatSelectResponse{Message: *m})
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/event"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatRegenerate(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &Alternative{}, &Usage{}, &Quota{}, &User{})
+
+	defer ai.MockReset()
+
+	chat := Chat{
+		ID:     uuid.New().String(),
+		Name:   "test",
+		LLM:    "mock",
+		UserID: "user-1",
+	}
+	db.Create(&chat)
+
+	call := func(hdr http.HandlerFunc, path string, form url.Values, rsp interface{}) int {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: "user-1"}))
+
+		w := httptest.NewRecorder()
+		hdr(w, r)
+		json.Unmarshal(w.Body.Bytes(), rsp)
+		return w.Code
+	}
+
+	var prompt ChatPromptResponse
+	assert.Equal(t, 200, call(ChatPrompt, "/chat/prompt", url.Values{"id": {chat.ID}, "prompt": {"hello"}}, &prompt))
+	assert.Equal(t, "hello", prompt.Message.Reply)
+
+	id := prompt.Message.ID
+
+	// regenerate on another model
+	ai.MockScript(ai.MockReply{Reply: "hi there"})
+
+	var regen ChatRegenerateResponse
+	assert.Equal(t, 200, call(ChatRegenerate, "/chat/regenerate", url.Values{"id": {id}, "model": {"mock/lorem"}}, &regen))
+	assert.Equal(t, "hi there", regen.Message.Reply)
+	assert.Equal(t, "mock/lorem", regen.Message.LLM)
+
+	// unknown models are rejected
+	assert.Equal(t, 400, call(ChatRegenerate, "/chat/regenerate", url.Values{"id": {id}, "model": {"nope"}}, &regen))
+
+	// the context uses the selected reply
+	history, err := buildContext(chat.ID, DefaultContext)
+	assert.NoError(t, err)
+	assert.Equal(t, []ai.Context{{Prompt: "hello", Reply: "hi there"}}, history)
+
+	// both replies are read with the chat
+	var read ChatReadResponse
+	assert.Equal(t, 200, call(ChatRead, "/chat/read", url.Values{"chat_id": {chat.ID}}, &read))
+	assert.Len(t, read.Messages, 1)
+
+	alts := read.Messages[0].Alternatives
+	assert.Len(t, alts, 2)
+	assert.Equal(t, "hello", alts[0].Reply)
+	assert.False(t, alts[0].Selected)
+	assert.Equal(t, "hi there", alts[1].Reply)
+	assert.True(t, alts[1].Selected)
+
+	// select the first reply again
+	var sel ChatSelectResponse
+	assert.Equal(t, 200, call(ChatSelect, "/chat/select", url.Values{"id": {id}, "alternative_id": {alts[0].ID}}, &sel))
+	assert.Equal(t, "hello", sel.Message.Reply)
+	assert.True(t, sel.Message.Alternatives[0].Selected)
+	assert.False(t, sel.Message.Alternatives[1].Selected)
+
+	history, err = buildContext(chat.ID, DefaultContext)
+	assert.NoError(t, err)
+	assert.Equal(t, []ai.Context{{Prompt: "hello", Reply: "hello"}}, history)
+
+	// streamed regeneration
+	sub, err := event.Subscribe(chat.ID)
+	assert.NoError(t, err)
+	defer event.Unsubscribe(sub)
+
+	ai.MockScript(ai.MockReply{Reply: "streamed reply"})
+	assert.Equal(t, 200, call(ChatRegenerate, "/chat/regenerate", url.Values{"id": {id}, "stream": {"true"}}, &regen))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var seq int64
+
+	for {
+		var ev ChatStreamResponse
+		assert.NoError(t, sub.Next(ctx, &ev))
+		assert.Equal(t, id, ev.ID)
+
+		// starts again for the new reply
+		assert.Equal(t, seq, ev.Seq)
+		seq++
+
+		if !ev.Partial {
+			assert.Equal(t, "streamed reply", ev.Message.Reply)
+			assert.Equal(t, ai.FinishStop, ev.FinishReason)
+			break
+		}
+	}
+
+	// stored once the stream is done
+	assert.Eventually(t, func() bool {
+		alts, _ := GetAlternatives([]string{id})
+		return len(alts[id]) == 3 && alts[id][2].Selected
+	}, time.Second, 10*time.Millisecond)
+
+	// wait for the usage of every reply
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Usage{}).Where("chat_id = ?", chat.ID).Count(&count)
+		return count == 3
+	}, time.Second, 10*time.Millisecond)
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -24,6 +25,9 @@ var (
 		"/chat/prompt":      ChatPrompt,
 		"/chat/index":       ChatIndex,
 		"/chat/stream":      ChatStream,
+		"/chat/cancel":      ChatCancel,
+		"/chat/regenerate":  ChatRegenerate,
+		"/chat/select":      ChatSelect,
 		"/chat/user/add":    ChatUserAdd,
 		"/chat/user/remove": ChatUserRemove,
 
@@ -45,9 +49,62 @@ var (
 		"/user/update":          UserUpdate,
 		"/user/session":         UserSession,
 		"/user/password/update": UserPasswordUpdate,
+
+		// persona apis
+		"/persona/create": PersonaCreate,
+		"/persona/read":   PersonaRead,
+		"/persona/update": PersonaUpdate,
+		"/persona/delete": PersonaDelete,
+		"/persona/index":  PersonaIndex,
+
+		// prompt library apis
+		"/prompt/create": PromptCreate,
+		"/prompt/read":   PromptRead,
+		"/prompt/update": PromptUpdate,
+		"/prompt/delete": PromptDelete,
+		"/prompt/index":  PromptIndex,
+
+		// knowledge base apis
+		"/knowledge/create": KnowledgeCreate,
+		"/knowledge/read":   KnowledgeRead,
+		"/knowledge/delete": KnowledgeDelete,
+		"/knowledge/index":  KnowledgeIndex,
+		"/knowledge/upload": KnowledgeUpload,
+		"/knowledge/remove": KnowledgeRemove,
+
+		// file apis
+		"/file/upload": FileUpload,
+		"/file/read":   FileRead,
+		"/file/delete": FileDelete,
+
+		// usage apis
+		"/usage/read": UsageRead,
+
+		// model apis
+		"/model/index": ModelIndex,
+	}
+
+	// AdminRoutes are served with basic auth via WithAdmin
+	AdminRoutes = map[string]http.HandlerFunc{
+		"/admin/usage":        AdminUsage,
+		"/admin/quota/set":    AdminQuotaSet,
+		"/admin/quota/read":   AdminQuotaRead,
+		"/admin/quota/delete": AdminQuotaDelete,
+		// models
+		"/admin/model/index":       AdminModelIndex,
+		"/admin/model/rule/set":    AdminModelRuleSet,
+		"/admin/model/rule/delete": AdminModelRuleDelete,
+		"/admin/model/discover":    AdminModelDiscover,
+		"/admin/upstreams":         AdminUpstreams,
+		"/admin/cache":             AdminCache,
 	}
 )
 
+var (
+	// ErrUnauthorized is returned when a user has no access to a resource
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
 var (
 	// Excludes paths from authentication / logging request-response
 	Excludes = []string{
@@ -178,23 +235,33 @@ func WithLogger(h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		// read body
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		// log the event
+		ev := &Event{
+			ID:          uuid.New().String(),
+			Timestamp:   time.Now(),
+			ClientIP:    getIP(r),
+			Endpoint:    r.URL.Path,
+			RequestType: r.Header.Get("Content-Type"),
 		}
 
-		// reset body
-		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		// binary and multipart bodies are streamed through, only the size is kept
+		body := &countReader{ReadCloser: r.Body}
 
-		// log the event
-		ev := &Event{
-			ID:        uuid.New().String(),
-			Timestamp: time.Now(),
-			ClientIP:  getIP(r),
-			Endpoint:  r.URL.Path,
-			Request:   string(b),
+		if isText(ev.RequestType) {
+			// read body
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			// reset body
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+			ev.Request = string(b)
+			ev.RequestSize = int64(len(b))
+		} else {
+			r.Body = body
 		}
 
 		// craft a response
@@ -212,6 +279,11 @@ func WithLogger(h http.Handler) http.Handler {
 		ev.Duration = time.Since(start)
 		ev.Status = rsp.status
 		ev.Response = string(rsp.data)
+		ev.ResponseType = w.Header().Get("Content-Type")
+		ev.ResponseSize = int64(rsp.size)
+		if body.size > 0 {
+			ev.RequestSize = body.size
+		}
 		// some extra info
 		ev.Method = r.Method
 		ev.Params = r.URL.Query().Encode()
@@ -223,8 +295,22 @@ func WithLogger(h http.Handler) http.Handler {
 			ev.UserID = sess.UserID
 		}
 
+		// WARNING WARNING DANGER DANGER
+		// don't log request/response for sensitive data
+		for _, path := range Excludes {
+			if strings.Compare(r.URL.Path, path) == 0 {
+				// strip request/response from event
+				ev.Request = ""
+				ev.Response = ""
+				break
+			}
+		}
+
+		// strip personal data and keys
+		redact(ev)
+
 		// log the event to stdout
-		// do not log request/response
+		// do not log request/response, the params are redacted
 		// but do save in the database
 		log.WithFields(log.Fields{
 			"id":        ev.ID,
@@ -238,23 +324,15 @@ func WithLogger(h http.Handler) http.Handler {
 			"user_id":   ev.UserID,
 		}).Println("request")
 
-		// WARNING WARNING DANGER DANGER
-		// don't log request/response for sensitive data
-		for _, path := range Excludes {
-			if strings.Compare(r.URL.Path, path) == 0 {
-				// strip request/response from event
-				ev.Request = ""
-				ev.Response = ""
-				break
-			}
-		}
+		// copy to publish as the db sets the model fields
+		pub := *ev
 
 		// write the event to db
 		// async to avoid slowdown
 		go db.Create(ev)
 
 		// publish the event
-		go event.Publish("events", ev)
+		go event.Publish("events", &pub)
 	}
 
 	return http.HandlerFunc(fn)
@@ -1,13 +1,16 @@
 package api
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
@@ -22,6 +25,19 @@ import (
 var (
 	// Default number of prompt/replies to send to the llm
 	DefaultContext = 10
+
+	// CancelTopic is the event topic used to cancel generations across nodes
+	CancelTopic = "cancel"
+
+	// in flight generations by message id
+	genMtx      sync.Mutex
+	genOnce     sync.Once
+	generations = map[string]context.CancelFunc{}
+)
+
+const (
+	// FinishCancelled is the finish reason of a reply stopped by /chat/cancel
+	FinishCancelled = "cancelled"
 )
 
 // Chat is the base type for a conversation
@@ -32,6 +48,17 @@ type Chat struct {
 	LLM     string `json:"model" valid:"required"`
 	UserID  string `json:"user_id" gorm:"index:idx_chat_user,priority:1"`
 	GroupID string `json:"group_id" gorm:"index"` // TODO new composite index with user
+	// system prompt, overrides the persona
+	System    string `json:"system"`
+	PersonaID string `json:"persona_id"`
+	// knowledge bases used to answer prompts
+	Knowledge []string `json:"knowledge" gorm:"serializer:json"`
+	// context strategy e.g window or summary
+	Strategy string `json:"strategy"`
+	// agents which can be mentioned as @alias
+	Agents []ChatAgent `json:"agents" gorm:"serializer:json"`
+	// default generation params
+	Params ai.Params `json:"params" gorm:"serializer:json"`
 }
 
 // Message represents the messages in a Chat
@@ -45,12 +72,38 @@ type Message struct {
 	Reply   string `json:"reply"`
 	LLM     string `json:"model"`
 	OTR     bool   `json:"otr"`
+	// tools called by the model and their results
+	ToolCalls []ai.ToolCall `json:"tool_calls,omitempty" gorm:"serializer:json"`
+	// why the reply finished e.g cancelled
+	FinishReason string `json:"finish_reason,omitempty"`
+	// sources from knowledge bases used in the reply
+	Citations []Citation `json:"citations,omitempty" gorm:"serializer:json"`
+	// the agent mentioned which replied
+	Agent string `json:"agent,omitempty"`
+	// generation params used for the reply
+	Params ai.Params `json:"params" gorm:"serializer:json"`
+	// tokens used for the reply
+	Usage ai.Usage `json:"usage" gorm:"embedded"`
+	// ids of the files attached as images
+	Images []string `json:"images,omitempty" gorm:"serializer:json"`
+	// the saved prompt used
+	TemplateID string `json:"template_id,omitempty" gorm:"index"`
+	// json schema of the reply
+	Schema json.RawMessage `json:"schema,omitempty" gorm:"serializer:json"`
+	// replies generated by /chat/regenerate
+	Alternatives []Alternative `json:"alternatives,omitempty" gorm:"-"`
 }
 
 type ChatCreateRequest struct {
-	Name    string `json:"name" valid:"required"`
-	Model   string `json:"model" valid:"required"`
-	GroupID string `json:"group_id"`
+	Name      string      `json:"name" valid:"required"`
+	Model     string      `json:"model" valid:"required"`
+	GroupID   string      `json:"group_id"`
+	System    string      `json:"system"`
+	PersonaID string      `json:"persona_id"`
+	Knowledge []string    `json:"knowledge"`
+	Strategy  string      `json:"strategy"`
+	Agents    []ChatAgent `json:"agents"`
+	ai.Params
 }
 
 type ChatCreateResponse struct {
@@ -61,6 +114,14 @@ type ChatUpdateRequest struct {
 	ID    string `json:"id"`
 	Name  string `json:"name" valid:"required"`
 	Model string `json:"model" valid:"required"`
+	// only updated if specified
+	System    *string      `json:"system"`
+	PersonaID *string      `json:"persona_id"`
+	Knowledge *[]string    `json:"knowledge"`
+	Strategy  *string      `json:"strategy"`
+	Agents    *[]ChatAgent `json:"agents"`
+	// params set are merged with the chat params
+	ai.Params
 }
 
 type ChatUpdateResponse struct {
@@ -99,10 +160,19 @@ type ChatReadResponse struct {
 
 type ChatPromptRequest struct {
 	ID      string `json:"id" valid:"required"`
-	Prompt  string `json:"prompt" valid:"required"`
+	Prompt  string `json:"prompt"`
 	Context int    `json:"context,omitempty"`
 	Stream  bool   `json:"stream,omitempty"`
 	OTR     bool   `json:"otr,omitempty"`
+	// ids of uploaded files to attach as images
+	Images []string `json:"images,omitempty"`
+	// saved prompt rendered with the variables
+	TemplateID string            `json:"template_id,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	// json schema the reply must match
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// params override the chat params
+	ai.Params
 }
 
 type ChatPromptResponse struct {
@@ -135,10 +205,26 @@ type ChatStreamRequest struct {
 }
 
 type ChatStreamResponse struct {
+	// ID of the message streamed
+	ID string `json:"id"`
+	// Seq orders the events of a reply starting at 0
+	Seq     int64   `json:"seq"`
 	Message Message `json:"message"`
 	Partial bool    `json:"partial"`
+	// the final event carries the finish reason, tokens used and
+	// milliseconds taken since the prompt
+	FinishReason string    `json:"finish_reason,omitempty"`
+	Usage        *ai.Usage `json:"usage,omitempty"`
+	Latency      int64     `json:"latency_ms,omitempty"`
 }
 
+type ChatCancelRequest struct {
+	// Message id of the reply being streamed
+	ID string `json:"id" valid:"required"`
+}
+
+type ChatCancelResponse struct{}
+
 // CreateChat enables the creation of a new chat
 func ChatCreate(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -155,12 +241,28 @@ func ChatCreate(w http.ResponseWriter, r *http.Request) {
 	cc.Name = r.Form.Get("name")
 	cc.Model = r.Form.Get("model")
 	cc.GroupID = r.Form.Get("group_id")
+	cc.System = r.Form.Get("system")
+	cc.PersonaID = r.Form.Get("persona_id")
+	cc.Knowledge = formList(r.Form["knowledge"])
+	cc.Strategy = r.Form.Get("strategy")
+
+	params, err := parseParams(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cc.Params = params
 
 	if err := decode(r, cc); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
+	if !validStrategy(cc.Strategy) {
+		http.Error(w, "Invalid strategy", http.StatusBadRequest)
+		return
+	}
+
 	// set default name
 	if len(cc.Name) == 0 {
 		cc.Name = "general"
@@ -172,11 +274,9 @@ func ChatCreate(w http.ResponseWriter, r *http.Request) {
 		cc.Model = ai.DefaultModel
 	} else {
 		// look up the model
-		_, ok := ai.Models[cc.Model]
-		if !ok {
-			// TODO: return error its an unsupported model
-			log.Printf("Unknown model for %v defaulting to %v\n", cc.Model, ai.DefaultModel)
-			cc.Model = ai.DefaultModel
+		if _, err := ai.GetModel(cc.Model); err != nil {
+			http.Error(w, err.Error()+" "+cc.Model, http.StatusBadRequest)
+			return
 		}
 	}
 
@@ -215,13 +315,45 @@ func ChatCreate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// check access to the persona
+	if len(cc.PersonaID) > 0 {
+		if _, err := GetPersona(cc.PersonaID, sess.UserID); err != nil {
+			http.Error(w, "Invalid persona", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// check access to the knowledge bases
+	if err := checkKnowledge(cc.Knowledge, sess.UserID); err != nil {
+		http.Error(w, "Invalid knowledge base", http.StatusBadRequest)
+		return
+	}
+
+	// check the agents
+	if err := checkAgents(cc.Agents, sess.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// check the params
+	if err := validateParams(cc.Model, cc.Params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// create a chat,
 	chat := &Chat{
-		ID:      uuid.New().String(),
-		Name:    cc.Name,
-		LLM:     cc.Model,
-		GroupID: group.ID,
-		UserID:  sess.UserID,
+		ID:        uuid.New().String(),
+		Name:      cc.Name,
+		LLM:       cc.Model,
+		GroupID:   group.ID,
+		UserID:    sess.UserID,
+		System:    cc.System,
+		PersonaID: cc.PersonaID,
+		Knowledge: cc.Knowledge,
+		Strategy:  cc.Strategy,
+		Agents:    cc.Agents,
+		Params:    cc.Params,
 	}
 
 	// create the chat
@@ -240,9 +372,6 @@ func ChatCreate(w http.ResponseWriter, r *http.Request) {
 	// create the chat user
 	db.Create(chatUser)
 
-	// TODO: call OpenAI to create a new chat
-	// {"role": "system", "content": "You are a helpful assistant"}
-
 	// respond to user
 	respond(w, r, ChatCreateResponse{*chat})
 }
@@ -368,6 +497,27 @@ func ChatUpdate(w http.ResponseWriter, r *http.Request) {
 	c.ID = r.Form.Get("id")
 	c.Name = r.Form.Get("name")
 
+	if v, ok := r.Form["system"]; ok {
+		c.System = &v[0]
+	}
+	if v, ok := r.Form["persona_id"]; ok {
+		c.PersonaID = &v[0]
+	}
+	if v, ok := r.Form["knowledge"]; ok {
+		list := formList(v)
+		c.Knowledge = &list
+	}
+	if v, ok := r.Form["strategy"]; ok {
+		c.Strategy = &v[0]
+	}
+
+	params, err := parseParams(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Params = params
+
 	if err := decode(r, c); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
@@ -390,6 +540,57 @@ func ChatUpdate(w http.ResponseWriter, r *http.Request) {
 	// set name
 	chat.Name = c.Name
 
+	// set system prompt
+	if c.System != nil {
+		chat.System = *c.System
+	}
+
+	// set persona
+	if c.PersonaID != nil {
+		if len(*c.PersonaID) > 0 {
+			if _, err := GetPersona(*c.PersonaID, sess.UserID); err != nil {
+				http.Error(w, "Invalid persona", http.StatusBadRequest)
+				return
+			}
+		}
+		chat.PersonaID = *c.PersonaID
+	}
+
+	// set knowledge bases
+	if c.Knowledge != nil {
+		if err := checkKnowledge(*c.Knowledge, sess.UserID); err != nil {
+			http.Error(w, "Invalid knowledge base", http.StatusBadRequest)
+			return
+		}
+		chat.Knowledge = *c.Knowledge
+	}
+
+	// set context strategy
+	if c.Strategy != nil {
+		if !validStrategy(*c.Strategy) {
+			http.Error(w, "Invalid strategy", http.StatusBadRequest)
+			return
+		}
+		chat.Strategy = *c.Strategy
+	}
+
+	// set agents
+	if c.Agents != nil {
+		if err := checkAgents(*c.Agents, sess.UserID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chat.Agents = *c.Agents
+	}
+
+	// merge params
+	chat.Params = chat.Params.Merge(c.Params)
+
+	if err := validateParams(chat.LLM, chat.Params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	res := db.Update(chat)
 	if err := res.Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -504,9 +705,22 @@ func ChatRead(w http.ResponseWriter, r *http.Request) {
 		Chat: &chat,
 	}
 
+	// get the alternative replies
+	var msgIDs []string
+	for _, m := range messages {
+		msgIDs = append(msgIDs, m.ID)
+	}
+
+	alts, err := GetAlternatives(msgIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// append messages
 	for _, m := range messages {
 		msg := m
+		msg.Alternatives = alts[msg.ID]
 		resp.Messages = append(resp.Messages, &msg)
 	}
 
@@ -532,6 +746,9 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 	var chat Chat
 	var sess Session
 
+	// latency of the reply
+	start := time.Now()
+
 	r.ParseForm()
 
 	// attempt to pull user session from context
@@ -543,10 +760,28 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 		sess = *s
 	}
 
+	// images may be uploaded with the prompt
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+		if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// parse the request
 	c := new(ChatPromptRequest)
 	c.ID = r.Form.Get("id")
 	c.Prompt = r.Form.Get("prompt")
+	c.Images = formList(r.Form["images"])
+	c.TemplateID = r.Form.Get("template_id")
+	c.Variables = parseVariables(r.Form)
+
+	// structured json reply
+	if v := r.Form.Get("schema"); len(v) > 0 {
+		c.Schema = json.RawMessage(v)
+	}
 
 	if v := r.Form.Get("context"); len(v) > 0 {
 		c.Context, _ = strconv.Atoi(v)
@@ -565,6 +800,14 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 		c.OTR = true
 	}
 
+	// generation params
+	params, err := parseParams(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Params = params
+
 	// set the default context limit
 	if c.Context > DefaultContext || c.Context < 0 {
 		c.Context = DefaultContext
@@ -575,6 +818,41 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// render the saved prompt
+	if len(c.TemplateID) > 0 {
+		tmpl, err := GetPrompt(c.TemplateID, sess.UserID)
+		if errors.Is(err, ErrUnauthorized) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "prompt not found", http.StatusNotFound)
+			return
+		}
+
+		vars := map[string]string{"prompt": c.Prompt}
+		for k, v := range c.Variables {
+			vars[k] = v
+		}
+
+		c.Prompt, err = renderPrompt(tmpl.Template, vars)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(c.Prompt) == 0 {
+		http.Error(w, "prompt required", http.StatusBadRequest)
+		return
+	}
+
+	if len(c.Schema) > 0 {
+		if err := ai.ParseSchema(c.Schema); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	chatID := c.ID
 	prompt := c.Prompt
 
@@ -619,15 +897,46 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 	// TODO: decide how context applies to a chat
 	user := base64.StdEncoding.EncodeToString([]byte(key))
 
+	// store the uploaded images
+	if r.MultipartForm != nil {
+		for _, hdr := range r.MultipartForm.File["image"] {
+			file, err := saveFile(hdr, sess.UserID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			c.Images = append(c.Images, file.ID)
+		}
+	}
+
+	// the images must be the user's own
+	images, err := promptImages(c.Images, sess.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// define the message
 	m := &Message{
-		ID:      uuid.New().String(),
-		Prompt:  prompt,
-		ChatID:  chatID,
-		UserID:  sess.UserID,
-		GroupID: chat.GroupID,
-		LLM:     chat.LLM,
-		OTR:     c.OTR,
+		ID:         uuid.New().String(),
+		Prompt:     prompt,
+		ChatID:     chatID,
+		UserID:     sess.UserID,
+		GroupID:    chat.GroupID,
+		LLM:        chat.LLM,
+		OTR:        c.OTR,
+		Images:     c.Images,
+		TemplateID: c.TemplateID,
+		Schema:     c.Schema,
+	}
+
+	// in chats with several users the model is only prompted by @alias
+	agents := chatAgents(&chat)
+	alias, prompted := ai.IsPrompt(prompt, activeChatUsers(chatUsers), agentAliases(agents)...)
+
+	// nothing to stream
+	if c.OTR || !prompted {
+		c.Stream = false
 	}
 
 	// with the stream we have to wait
@@ -636,10 +945,52 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 	// pull context from the cache
 	context := getContext(chat.ID)
 
+	// summary of older turns
+	var summary string
+
 	// send it to the LLM if it's not off the record
-	if !c.OTR {
+	if !c.OTR && prompted && chat.Strategy == StrategySummary {
+		// the summary and the turns since
+		s, err := getSummary(chat.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		context, err = summaryContext(chat.ID, s.Until, c.Context)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		summary = s.Summary
+	}
+
+	// send it to the LLM if it's not off the record
+	if !c.OTR && prompted {
+		// check the user and group are within their quota
+		if err := checkQuota(sess.UserID, chat.GroupID); err != nil {
+			quotaError(w, err)
+			return
+		}
+
+		// route to the agent's model
+		agent := agents[alias]
+		if len(agent.Model) > 0 {
+			m.LLM = agent.Model
+		}
+		m.Agent = alias
+
+		// chat params overridden by the prompt
+		m.Params = chat.Params.Merge(c.Params)
+
+		if err := validateParams(m.LLM, m.Params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// if there's not enough context attempt to get it from the chat
-		if len(context) < c.Context {
+		if len(context) < c.Context && chat.Strategy != StrategySummary {
 			var err error
 			context, err = buildContext(chat.ID, c.Context)
 			if err != nil {
@@ -654,38 +1005,107 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// get the model
-		model, ok := ai.Models[chat.LLM]
-		if !ok {
-			log.Printf("Unsupported model %v defaulting to %v\n", chat.LLM, ai.DefaultModel)
-			model = ai.Models[ai.DefaultModel]
+		model, err := ai.GetModel(m.LLM)
+		if err != nil {
+			http.Error(w, err.Error()+" "+m.LLM, http.StatusBadRequest)
+			return
+		}
+
+		// images are only sent to vision models
+		vision := ai.SupportsVision(model.String())
+
+		if len(images) > 0 && !vision {
+			http.Error(w, "Model "+m.LLM+" does not support images", http.StatusBadRequest)
+			return
+		}
+
+		if vision {
+			if err := loadContextImages(context); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// retrieve sources from the knowledge bases
+		if len(chat.Knowledge) > 0 {
+			citations, err := retrieve(r.Context(), chat.Knowledge, sess.UserID, prompt)
+			if err != nil {
+				log.Printf("Error retrieving knowledge for chat %v: %v\n", chat.ID, err)
+			}
+			m.Citations = citations
+		}
+
+		// the request to the model
+		req := &ai.Request{
+			Prompt:  prompt,
+			Images:  images,
+			Schema:  c.Schema,
+			User:    user,
+			System:  withCitations(agentSystem(&chat, agent), m.Citations),
+			Summary: summary,
+			Context: context,
+			Tools:   ai.ListTools(),
+			Params:  &m.Params,
 		}
 
 		// if asked for a streaming response we run this in a go routine
 		if c.Stream {
-			words, err := model.Stream(prompt, user, context...)
-			if err != nil {
+			// cancellable via /chat/cancel
+			ctx, done := newGeneration(m.ID)
+
+			words, err := ai.RunStream(ctx, model, req)
+			if errors.Is(err, ai.ErrNoVision) {
+				done()
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				done()
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
 			// stream the words, we can choose to do this async too
-			go streamWords(r, &sess, chat, words, wait, context)
+			// the chat is passed by value as it's updated below
+			go func(chat Chat) {
+				defer done()
+				streamWords(ctx, r, &sess, chat, words, wait, context, start)
+			}(chat)
 		} else {
 			// non streaming response, complete the prompt and reply inline
-			reply, err := model.Complete(prompt, user, context...)
-			if err != nil {
+			rsp, err := ai.Run(r.Context(), model, req)
+			if errors.Is(err, ai.ErrNoVision) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if errors.Is(err, ai.ErrSchema) || errors.Is(err, ai.ErrToolRounds) {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			} else if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			// set reply
-			m.Reply += reply
+			m.Reply += rsp.Reply
+			// set the tools called
+			m.ToolCalls = rsp.ToolCalls
+			// set why it finished
+			m.FinishReason = rsp.FinishReason
+			// set the fallback model if used
+			if len(rsp.Model) > 0 {
+				m.LLM = rsp.Model
+			}
+			// set the tokens used
+			if rsp.Usage != nil {
+				m.Usage = *rsp.Usage
+			}
 		}
 	}
 
 	// update the chat to indicate it's been updated
 	chat.UpdatedAt = time.Now()
 
-	go db.Update(&chat)
+	// saved as a copy as the db sets its fields
+	updated := chat
+	go db.Update(&updated)
 
 	// write response to database
 	if res := db.Create(m); res.Error != nil {
@@ -694,7 +1114,15 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// count the use of the saved prompt
+	if len(m.TemplateID) > 0 {
+		if err := usePrompt(m.TemplateID); err != nil {
+			log.Printf("Error counting use of prompt %v: %v\n", m.TemplateID, err)
+		}
+	}
+
 	ch := &ChatStreamResponse{
+		ID:      m.ID,
 		Message: *m,
 		Partial: c.Stream, // true if streaming
 	}
@@ -703,17 +1131,29 @@ func ChatPrompt(w http.ResponseWriter, r *http.Request) {
 	if !c.Stream {
 		// set as non partial response
 		ch.Partial = false
+		// the reply is complete
+		if prompted && !c.OTR {
+			ch.FinishReason = m.FinishReason
+			ch.Usage = &m.Usage
+			ch.Latency = time.Since(start).Milliseconds()
+		}
 		// save context immediately
 		saveContext(*m, context)
+		// record the tokens used
+		go saveUsage(m, r.URL.Path)
+		// summarise older turns
+		if chat.Strategy == StrategySummary && !m.OTR {
+			go refreshSummary(chat)
+		}
 	}
 
+	// publish event before the streamed words
+	event.Publish(chatID, ch)
+
 	// written the db record, keep going
 	wait <- m
 	close(wait)
 
-	// publish event
-	event.Publish(chatID, ch)
-
 	// write response to user
 	respond(w, r, ChatPromptResponse{
 		Message: *m,
@@ -912,6 +1352,50 @@ func ChatStream(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ChatCancel stops a reply being streamed
+func ChatCancel(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// attempt to pull user session from context
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		// no session, don't proceed
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	c := new(ChatCancelRequest)
+	c.ID = r.Form.Get("id")
+
+	if err := decode(r, c); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// get the message
+	var msg Message
+	if err := db.Where("id = ?", c.ID).First(&msg).Error; err != nil {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	// only the user who prompted or the chat owner can cancel
+	if msg.UserID != sess.UserID {
+		chat, err := GetChat(msg.ChatID)
+		if err != nil || chat.UserID != sess.UserID {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// cancel locally or on whichever node is generating it
+	if !cancelGeneration(msg.ID) {
+		event.Publish(CancelTopic, msg.ID)
+	}
+
+	respond(w, r, ChatCancelResponse{})
+}
+
 func GetChat(id string) (*Chat, error) {
 	var chat Chat
 	chat.ID = id
@@ -925,6 +1409,25 @@ func GetChat(id string) (*Chat, error) {
 	return &chat, nil
 }
 
+// getSystem returns the system prompt for a chat
+func getSystem(chat *Chat) string {
+	if len(chat.System) > 0 {
+		return chat.System
+	}
+
+	if len(chat.PersonaID) == 0 {
+		return ""
+	}
+
+	var persona Persona
+	if err := db.Where("id = ?", chat.PersonaID).First(&persona).Error; err != nil {
+		log.Printf("Error getting persona %v: %v\n", chat.PersonaID, err)
+		return ""
+	}
+
+	return persona.System
+}
+
 func GetChatUser(chatID, userID string) (*ChatUser, error) {
 	var user ChatUser
 	res := db.Where("chat_id = ? AND user_id = ?", chatID, userID).First(&user)
@@ -946,6 +1449,17 @@ func GetChatUsers(id string) ([]ChatUser, error) {
 	return users, nil
 }
 
+// activeChatUsers counts the users who haven't been removed from the chat
+func activeChatUsers(users []ChatUser) int {
+	var n int
+	for _, u := range users {
+		if !u.DeletedAt.Valid {
+			n++
+		}
+	}
+	return n
+}
+
 func GetChatsForUser(id string) ([]ChatUser, error) {
 	var users []ChatUser
 
@@ -958,9 +1472,62 @@ func GetChatsForUser(id string) ([]ChatUser, error) {
 	return users, nil
 }
 
-func streamWords(r *http.Request, sess *Session, chat Chat, words chan string, wait chan *Message, context []ai.Context) {
+// newGeneration returns a context which is cancelled by /chat/cancel
+// the done func must be called once the generation is complete
+func newGeneration(id string) (context.Context, func()) {
+	// listen for cancellations from other nodes
+	genOnce.Do(func() {
+		sub, err := event.Subscribe(CancelTopic)
+		if err != nil {
+			log.Print("Failed to subscribe to cancellations", err)
+			return
+		}
+
+		go func() {
+			for {
+				var id string
+				if err := sub.Next(context.Background(), &id); err != nil {
+					log.Print("Cancel subscription ended", err)
+					return
+				}
+				cancelGeneration(id)
+			}
+		}()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	genMtx.Lock()
+	generations[id] = cancel
+	genMtx.Unlock()
+
+	return ctx, func() {
+		genMtx.Lock()
+		delete(generations, id)
+		genMtx.Unlock()
+		cancel()
+	}
+}
+
+// cancelGeneration cancels a local generation returning false if not found
+func cancelGeneration(id string) bool {
+	genMtx.Lock()
+	cancel, ok := generations[id]
+	genMtx.Unlock()
+
+	if ok {
+		cancel()
+	}
+
+	return ok
+}
+
+func streamWords(ctx context.Context, r *http.Request, sess *Session, chat Chat, words chan *ai.Response, wait chan *Message, history []ai.Context, start time.Time) {
 	var reply string
 
+	// the first event is published with the prompt
+	var seq int64
+
 	// make message copy
 	var msg Message
 
@@ -978,41 +1545,160 @@ func streamWords(r *http.Request, sess *Session, chat Chat, words chan string, w
 		return
 	}
 
+	// tools called
+	var calls []ai.ToolCall
+
+	// tokens used across tool rounds
+	var usage ai.Usage
+
+	// why the last round finished
+	var finish string
+
 	for {
 		select {
 		case word, ok := <-words:
 			if !ok {
-				// we're done, save context and leave
-				saveContext(msg, context)
-
 				// set the reply
 				msg.Reply = reply
+				msg.ToolCalls = calls
+				msg.Usage = usage
+				msg.FinishReason = finish
+
+				// stopped by /chat/cancel
+				if ctx.Err() != nil {
+					msg.FinishReason = FinishCancelled
+				}
+
+				// we're done, save context and leave
+				saveContext(msg, history)
+
+				seq++
 
 				ch := &ChatStreamResponse{
-					Message: msg,
-					Partial: false,
+					ID:           msg.ID,
+					Seq:          seq,
+					Message:      msg,
+					Partial:      false,
+					FinishReason: msg.FinishReason,
+					Usage:        &msg.Usage,
+					Latency:      time.Since(start).Milliseconds(),
 				}
 
 				// publish the whole thing
 				event.Publish(msg.ChatID, ch)
 
 				// update record
-				db.Update(msg)
+				db.Update(&msg)
+
+				// record the tokens used
+				saveUsage(&msg, r.URL.Path)
+
+				// summarise older turns
+				if chat.Strategy == StrategySummary {
+					go refreshSummary(chat)
+				}
 
 				// done
 				return
 			}
 
 			// add to the reply
-			reply += word
-			// set the word
-			msg.Reply = word
+			reply += word.Reply
+			calls = append(calls, word.ToolCalls...)
+
+			// the fallback model answering
+			if len(word.Model) > 0 {
+				msg.LLM = word.Model
+			}
+
+			// usage and finish reason are sent at the end
+			if word.Usage != nil {
+				usage.Add(word.Usage)
+			}
+			if len(word.FinishReason) > 0 {
+				finish = word.FinishReason
+			}
+			if len(word.Reply) == 0 && len(word.ToolCalls) == 0 {
+				continue
+			}
+
+			// set the word and any tool called
+			msg.Reply = word.Reply
+			msg.ToolCalls = word.ToolCalls
+
+			// citations are sent with the whole message
+			partial := msg
+			partial.Citations = nil
+
+			seq++
 
 			// publish the message
 			event.Publish(msg.ChatID, &ChatStreamResponse{
-				Message: msg,
+				ID:      msg.ID,
+				Seq:     seq,
+				Message: partial,
 				Partial: true,
 			})
 		}
 	}
 }
+
+// parseParams reads the generation params from the form
+func parseParams(form url.Values) (ai.Params, error) {
+	var p ai.Params
+
+	floats := []struct {
+		name string
+		val  **float32
+	}{
+		{"temperature", &p.Temperature},
+		{"top_p", &p.TopP},
+		{"presence_penalty", &p.PresencePenalty},
+		{"frequency_penalty", &p.FrequencyPenalty},
+	}
+
+	for _, f := range floats {
+		if v := form.Get(f.name); len(v) > 0 {
+			n, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s", f.name)
+			}
+			x := float32(n)
+			*f.val = &x
+		}
+	}
+
+	ints := []struct {
+		name string
+		val  **int
+	}{
+		{"max_tokens", &p.MaxTokens},
+		{"seed", &p.Seed},
+	}
+
+	for _, i := range ints {
+		if v := form.Get(i.name); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s", i.name)
+			}
+			*i.val = &n
+		}
+	}
+
+	// stop sequences may contain commas so aren't split
+	if v, ok := form["stop"]; ok {
+		p.Stop = v
+	}
+
+	return p, nil
+}
+
+// validateParams checks the params against the limits of the model
+func validateParams(model string, p ai.Params) error {
+	// resolve aliases e.g gpt-4
+	if md, err := ai.GetModel(model); err == nil {
+		model = md.String()
+	}
+	return p.Validate(model)
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/event"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelGeneration(t *testing.T) {
+	ctx, done := newGeneration("msg-1")
+
+	// unknown generation
+	assert.False(t, cancelGeneration("msg-2"))
+	assert.NoError(t, ctx.Err())
+
+	// cancel in flight generation
+	assert.True(t, cancelGeneration("msg-1"))
+	assert.Error(t, ctx.Err())
+
+	// removed once done
+	done()
+	assert.False(t, cancelGeneration("msg-1"))
+}
+
+func TestParseParams(t *testing.T) {
+	form := url.Values{}
+	form.Set("temperature", "0.5")
+	form.Set("max_tokens", "256")
+	form.Set("seed", "7")
+	form.Add("stop", "a,b")
+	form.Add("stop", "END")
+
+	p, err := parseParams(form)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(0.5), *p.Temperature)
+	assert.Equal(t, 256, *p.MaxTokens)
+	assert.Equal(t, 7, *p.Seed)
+	assert.Equal(t, []string{"a,b", "END"}, p.Stop)
+	assert.Nil(t, p.TopP)
+
+	assert.NoError(t, validateParams("gpt-3.5-turbo", p))
+
+	// over the max output of the model
+	form.Set("max_tokens", "5000")
+	p, err = parseParams(form)
+	assert.NoError(t, err)
+	assert.Error(t, validateParams("gpt-3.5-turbo", p))
+	assert.NoError(t, validateParams("gpt-4", p))
+
+	form.Set("temperature", "hot")
+	_, err = parseParams(form)
+	assert.Error(t, err)
+}
+
+func TestChatPrompt(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &Usage{}, &Quota{})
+
+	chat := Chat{
+		ID:     uuid.New().String(),
+		Name:   "test",
+		LLM:    "mock",
+		UserID: "user-1",
+	}
+	db.Create(&chat)
+	db.Create(&ChatUser{ChatID: chat.ID, UserID: "user-1"})
+
+	prompt := func(form url.Values) ChatPromptResponse {
+		r := httptest.NewRequest("POST", "/chat/prompt", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: "user-1"}))
+
+		w := httptest.NewRecorder()
+		ChatPrompt(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var rsp ChatPromptResponse
+		json.Unmarshal(w.Body.Bytes(), &rsp)
+		return rsp
+	}
+
+	// inline reply
+	rsp := prompt(url.Values{"id": {chat.ID}, "prompt": {"hello world"}})
+	assert.Equal(t, "hello world", rsp.Message.Reply)
+	assert.Equal(t, "mock", rsp.Message.LLM)
+	assert.Equal(t, ai.FinishStop, rsp.Message.FinishReason)
+	assert.True(t, rsp.Message.Usage.CompletionTokens > 0)
+
+	// streamed reply
+	sub, err := event.Subscribe(chat.ID)
+	assert.NoError(t, err)
+	defer event.Unsubscribe(sub)
+
+	rsp = prompt(url.Values{"id": {chat.ID}, "prompt": {"one two three"}, "stream": {"true"}})
+	assert.Empty(t, rsp.Message.Reply)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var words []string
+	var seq int64
+
+	for {
+		var ev ChatStreamResponse
+		assert.NoError(t, sub.Next(ctx, &ev))
+
+		if ev.ID != rsp.Message.ID {
+			continue
+		}
+
+		// in order from the prompt
+		assert.Equal(t, seq, ev.Seq)
+		seq++
+
+		if !ev.Partial {
+			assert.Equal(t, "one two three", ev.Message.Reply)
+			assert.Equal(t, ai.FinishStop, ev.FinishReason)
+			assert.Equal(t, ai.FinishStop, ev.Message.FinishReason)
+			assert.NotNil(t, ev.Usage)
+			assert.True(t, ev.Usage.CompletionTokens > 0)
+			assert.True(t, ev.Latency >= 0)
+			break
+		}
+		assert.Empty(t, ev.FinishReason)
+		assert.Nil(t, ev.Usage)
+		// the initial event carries no reply
+		if len(ev.Message.Reply) > 0 {
+			words = append(words, ev.Message.Reply)
+		}
+	}
+
+	assert.Equal(t, []string{"one ", "two ", "three"}, words)
+
+	// the usage is recorded once the reply is saved
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Usage{}).Where("chat_id = ?", chat.ID).Count(&count)
+		return count == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChatPromptSchema(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &Usage{}, &Quota{}, &User{})
+
+	defer ai.MockReset()
+
+	chat := Chat{
+		ID:     uuid.New().String(),
+		Name:   "test",
+		LLM:    "mock",
+		UserID: "user-1",
+	}
+	db.Create(&chat)
+
+	call := func(form url.Values, rsp interface{}) int {
+		r := httptest.NewRequest("POST", "/chat/prompt", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: "user-1"}))
+
+		w := httptest.NewRecorder()
+		ChatPrompt(w, r)
+		json.Unmarshal(w.Body.Bytes(), rsp)
+		return w.Code
+	}
+
+	schema := `{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`
+
+	// invalid reply is fixed
+	ai.MockScript(ai.MockReply{Reply: `{"town":"Paris"}`}, ai.MockReply{Reply: `{"city":"Paris"}`})
+
+	var rsp ChatPromptResponse
+	assert.Equal(t, 200, call(url.Values{"id": {chat.ID}, "prompt": {"capital of france"}, "schema": {schema}}, &rsp))
+	assert.Equal(t, `{"city":"Paris"}`, rsp.Message.Reply)
+	assert.JSONEq(t, schema, string(rsp.Message.Schema))
+
+	// stored with the message
+	var msg Message
+	assert.NoError(t, db.Where("id = ?", rsp.Message.ID).First(&msg).Error)
+	assert.JSONEq(t, schema, string(msg.Schema))
+
+	// invalid schema
+	assert.Equal(t, 400, call(url.Values{"id": {chat.ID}, "prompt": {"hello"}, "schema": {"{"}}, &rsp))
+
+	// the model never gets it right
+	ai.MockScript(ai.MockReply{Reply: "no"}, ai.MockReply{Reply: "no"}, ai.MockReply{Reply: "no"})
+	assert.Equal(t, 502, call(url.Values{"id": {chat.ID}, "prompt": {"capital of france"}, "schema": {schema}}, &rsp))
+
+	// wait for the usage of the reply
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Usage{}).Where("chat_id = ?", chat.ID).Count(&count)
+		return count == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -17,6 +17,7 @@ func saveContext(msg Message, context []ai.Context) {
 	context = append(context, ai.Context{
 		Prompt: msg.Prompt,
 		Reply:  msg.Reply,
+		Images: contextImages(msg.Images),
 	})
 
 	// save the context
@@ -53,9 +54,11 @@ func buildContext(chatID string, limit int) ([]ai.Context, error) {
 			continue
 		}
 
+		// the reply is the selected alternative
 		context = append(context, ai.Context{
 			Prompt: message.Prompt,
 			Reply:  message.Reply,
+			Images: contextImages(message.Images),
 		})
 	}
 
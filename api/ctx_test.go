@@ -12,7 +12,12 @@ import (
 )
 
 func cleanup() {
+	// wait for the writes of background tasks
+	if sqlDB, err := db.DB.DB(); err == nil {
+		sqlDB.Close()
+	}
 	os.Remove("turbo.db")
+	os.Remove("turbo.db-journal")
 }
 
 func TestSaveAndGetContext(t *testing.T) {
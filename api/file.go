@@ -0,0 +1,291 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// MaxImageSize is the max size of an image attached to a prompt
+	MaxImageSize int64 = 5 << 20
+
+	// MaxImages is the max number of images attached to a prompt
+	MaxImages = 4
+
+	// ImageTypes are the image types which can be attached to a prompt
+	ImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+)
+
+// File is an uploaded file e.g an image attached to a prompt
+type File struct {
+	gorm.Model
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Data        []byte `json:"-"`
+	UserID      string `json:"user_id" gorm:"index"`
+}
+
+type FileUploadResponse struct {
+	File File `json:"file"`
+}
+
+type FileReadRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type FileReadResponse struct {
+	File File `json:"file"`
+}
+
+type FileDeleteRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type FileDeleteResponse struct{}
+
+// isImage checks the content type is a supported image
+func isImage(contentType string) bool {
+	for _, t := range ImageTypes {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// GetFile returns a file uploaded by the user
+func GetFile(id, userID string) (*File, error) {
+	var f File
+	if err := db.Where("id = ?", id).First(&f).Error; err != nil {
+		return nil, err
+	}
+	if f.UserID != userID {
+		return nil, ErrUnauthorized
+	}
+	return &f, nil
+}
+
+// saveFile stores an uploaded multipart file for the user
+func saveFile(hdr *multipart.FileHeader, userID string) (*File, error) {
+	f, err := hdr.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		ID:          uuid.New().String(),
+		Name:        hdr.Filename,
+		ContentType: http.DetectContentType(data),
+		Size:        int64(len(data)),
+		Data:        data,
+		UserID:      userID,
+	}
+
+	if err := db.Create(file).Error; err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// promptImages checks the files are images of the user and returns them
+func promptImages(ids []string, userID string) ([]ai.Image, error) {
+	if len(ids) > MaxImages {
+		return nil, fmt.Errorf("at most %d images", MaxImages)
+	}
+
+	var images []ai.Image
+
+	for _, id := range ids {
+		f, err := GetFile(id, userID)
+		if err != nil {
+			return nil, fmt.Errorf("image %s not found", id)
+		}
+		if !isImage(f.ContentType) {
+			return nil, fmt.Errorf("file %s is not a supported image", f.Name)
+		}
+		if f.Size > MaxImageSize {
+			return nil, fmt.Errorf("image %s is larger than %d bytes", f.Name, MaxImageSize)
+		}
+
+		images = append(images, ai.Image{
+			ID:       f.ID,
+			MimeType: f.ContentType,
+			Data:     f.Data,
+		})
+	}
+
+	return images, nil
+}
+
+// loadImages reads the data of the images from the stored files
+func loadImages(images []ai.Image) error {
+	for i, img := range images {
+		if len(img.Data) > 0 || len(img.ID) == 0 {
+			continue
+		}
+
+		var f File
+		if err := db.Where("id = ?", img.ID).First(&f).Error; errors.Is(err, db.ErrNotFound) {
+			// deleted since
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		images[i].MimeType = f.ContentType
+		images[i].Data = f.Data
+	}
+
+	return nil
+}
+
+// loadContextImages reads the data of the images in the context
+func loadContextImages(context []ai.Context) error {
+	for _, c := range context {
+		if err := loadImages(c.Images); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contextImages returns the stored images of a message as references
+func contextImages(ids []string) []ai.Image {
+	var images []ai.Image
+	for _, id := range ids {
+		images = append(images, ai.Image{ID: id})
+	}
+	return images
+}
+
+// FileUpload stores a multipart file for the user
+func FileUpload(w http.ResponseWriter, r *http.Request) {
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		http.Error(w, "multipart file required", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, hdr, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file required", http.StatusBadRequest)
+		return
+	}
+
+	file, err := saveFile(hdr, sess.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, FileUploadResponse{File: *file})
+}
+
+// FileRead returns a file uploaded by the user, the content with raw=true
+func FileRead(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := FileReadRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := GetFile(req.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	// serve the content
+	if r.Form.Get("raw") == "true" {
+		w.Header().Set("Content-Type", file.ContentType)
+		w.Write(file.Data)
+		return
+	}
+
+	respond(w, r, FileReadResponse{File: *file})
+}
+
+// FileDelete deletes a file uploaded by the user
+func FileDelete(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := FileDeleteRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := GetFile(req.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	if err := db.Where("id = ?", file.ID).Delete(&File{}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, FileDeleteResponse{})
+}
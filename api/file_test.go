@@ -0,0 +1,146 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestChatImages(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &File{}, &Usage{}, &Quota{}, &User{})
+
+	// a model without vision
+	text, err := ai.NewOllama(ai.Config{URL: "http://localhost:0"}).Model("llama3")
+	assert.NoError(t, err)
+
+	ai.Models["test-text"] = text
+	defer delete(ai.Models, "test-text")
+
+	call := func(hdr http.HandlerFunc, userID string, r *http.Request, rsp interface{}) int {
+		r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: userID}))
+
+		w := httptest.NewRecorder()
+		hdr(w, r)
+		json.Unmarshal(w.Body.Bytes(), rsp)
+		return w.Code
+	}
+
+	form := func(path string, vals url.Values) *http.Request {
+		r := httptest.NewRequest("POST", path, strings.NewReader(vals.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	multi := func(path string, vals url.Values, field string, data []byte) *http.Request {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for k, v := range vals {
+			mw.WriteField(k, v[0])
+		}
+		fw, _ := mw.CreateFormFile(field, "screenshot.png")
+		fw.Write(data)
+		mw.Close()
+
+		r := httptest.NewRequest("POST", path, &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+
+	// upload an image
+	var upload FileUploadResponse
+	assert.Equal(t, 200, call(FileUpload, "user-1", multi("/file/upload", nil, "file", testPNG), &upload))
+	assert.Equal(t, "image/png", upload.File.ContentType)
+	assert.Equal(t, int64(len(testPNG)), upload.File.Size)
+
+	var read FileReadResponse
+	assert.Equal(t, 200, call(FileRead, "user-1", form("/file/read", url.Values{"id": {upload.File.ID}}), &read))
+	assert.Equal(t, "screenshot.png", read.File.Name)
+
+	// only readable by the owner
+	assert.Equal(t, 401, call(FileRead, "user-2", form("/file/read", url.Values{"id": {upload.File.ID}}), &read))
+
+	chat := Chat{
+		ID:     uuid.New().String(),
+		Name:   "test",
+		LLM:    "mock",
+		UserID: "user-1",
+	}
+	db.Create(&chat)
+
+	// prompt with a stored image
+	var prompt ChatPromptResponse
+	vals := url.Values{"id": {chat.ID}, "prompt": {"what is this"}, "images": {upload.File.ID}}
+	assert.Equal(t, 200, call(ChatPrompt, "user-1", form("/chat/prompt", vals), &prompt))
+	assert.Equal(t, "what is this [image image/png]", prompt.Message.Reply)
+	assert.Equal(t, []string{upload.File.ID}, prompt.Message.Images)
+
+	// the image is kept in the context
+	history := getContext(chat.ID)
+	assert.Len(t, history, 1)
+	assert.Equal(t, []ai.Image{{ID: upload.File.ID}}, history[0].Images)
+
+	// prompt with an uploaded image
+	vals = url.Values{"id": {chat.ID}, "prompt": {"and this"}}
+	assert.Equal(t, 200, call(ChatPrompt, "user-1", multi("/chat/prompt", vals, "image", testPNG), &prompt))
+	assert.Equal(t, "and this [image image/png]", prompt.Message.Reply)
+	assert.Len(t, prompt.Message.Images, 1)
+
+	// images of other users and other files are rejected
+	vals = url.Values{"id": {chat.ID}, "prompt": {"what is this"}, "images": {"nope"}}
+	assert.Equal(t, 400, call(ChatPrompt, "user-1", form("/chat/prompt", vals), &prompt))
+
+	assert.Equal(t, 200, call(FileUpload, "user-1", multi("/file/upload", nil, "file", []byte("plain text")), &upload))
+	vals = url.Values{"id": {chat.ID}, "prompt": {"what is this"}, "images": {upload.File.ID}}
+	assert.Equal(t, 400, call(ChatPrompt, "user-1", form("/chat/prompt", vals), &prompt))
+
+	// models without vision reject images
+	other := Chat{
+		ID:     uuid.New().String(),
+		Name:   "text",
+		LLM:    "test-text",
+		UserID: "user-1",
+	}
+	db.Create(&other)
+
+	vals = url.Values{"id": {other.ID}, "prompt": {"what is this"}}
+	assert.Equal(t, 400, call(ChatPrompt, "user-1", multi("/chat/prompt", vals, "image", testPNG), &prompt))
+
+	// deleted files are skipped in the context
+	var del FileDeleteResponse
+	assert.Equal(t, 200, call(FileDelete, "user-1", form("/file/delete", url.Values{"id": {history[0].Images[0].ID}}), &del))
+	assert.NoError(t, loadContextImages(history))
+	assert.Empty(t, history[0].Images[0].Data)
+
+	// wait for the usage of both replies
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Usage{}).Where("chat_id = ?", chat.ID).Count(&count)
+		return count == 2
+	}, time.Second, 10*time.Millisecond)
+}
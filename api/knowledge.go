@@ -0,0 +1,784 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/log"
+	"github.com/google/uuid"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"gorm.io/gorm"
+)
+
+var (
+	// KnowledgeResults is the number of chunks retrieved for a prompt
+	KnowledgeResults = 4
+
+	// MaxUploadSize is the max size of a document in bytes
+	MaxUploadSize int64 = 10 << 20
+
+	// EmbedBatch is the number of chunks embedded per request
+	EmbedBatch = 64
+)
+
+// KnowledgeBase is a collection of documents owned by a group
+type KnowledgeBase struct {
+	gorm.Model
+	ID          string `json:"id" valid:"required"`
+	Name        string `json:"name" valid:"length(1|64)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	// embedding model used for the documents
+	EmbedModel string `json:"embed_model"`
+	UserID     string `json:"user_id" gorm:"index"`
+	GroupID    string `json:"group_id" gorm:"index"`
+}
+
+// Document is a file uploaded to a knowledge base
+type Document struct {
+	gorm.Model
+	ID          string `json:"id" valid:"required"`
+	KnowledgeID string `json:"knowledge_id" gorm:"index"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Chunks      int    `json:"chunks"`
+	UserID      string `json:"user_id"`
+}
+
+// Chunk is a part of a document which is embedded for retrieval
+type Chunk struct {
+	gorm.Model
+	ID          string `json:"id" valid:"required"`
+	KnowledgeID string `json:"knowledge_id" gorm:"index"`
+	DocumentID  string `json:"document_id" gorm:"index"`
+	Position    int    `json:"position"`
+	Content     string `json:"content"`
+}
+
+// Citation is a chunk of a document used to answer a prompt
+type Citation struct {
+	// the number referenced in the reply e.g [1]
+	Index       int     `json:"index"`
+	KnowledgeID string  `json:"knowledge_id"`
+	DocumentID  string  `json:"document_id"`
+	ChunkID     string  `json:"chunk_id"`
+	Name        string  `json:"name"`
+	Content     string  `json:"content"`
+	Score       float64 `json:"score"`
+}
+
+type KnowledgeCreateRequest struct {
+	Name        string `json:"name" valid:"required,length(1|64)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	GroupID     string `json:"group_id"`
+}
+
+type KnowledgeCreateResponse struct {
+	KnowledgeBase
+}
+
+type KnowledgeReadRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type KnowledgeReadResponse struct {
+	KnowledgeBase KnowledgeBase `json:"knowledge_base"`
+	Documents     []Document    `json:"documents"`
+}
+
+type KnowledgeDeleteRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type KnowledgeDeleteResponse struct{}
+
+type KnowledgeIndexRequest struct {
+	GroupID string `json:"group_id"`
+}
+
+type KnowledgeIndexResponse struct {
+	KnowledgeBases []KnowledgeBase `json:"knowledge_bases"`
+}
+
+type KnowledgeUploadRequest struct {
+	KnowledgeID string `json:"knowledge_id" valid:"required"`
+	Name        string `json:"name" valid:"required"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
+
+type KnowledgeUploadResponse struct {
+	Document
+}
+
+type KnowledgeRemoveRequest struct {
+	// Document id
+	ID string `json:"id" valid:"required"`
+}
+
+type KnowledgeRemoveResponse struct{}
+
+// KnowledgeCreate creates a knowledge base for a group
+func KnowledgeCreate(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := KnowledgeCreateRequest{
+		Name:        r.Form.Get("name"),
+		Description: r.Form.Get("description"),
+		GroupID:     r.Form.Get("group_id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.GroupID) > 0 {
+		// must be a member of the group
+		if !IsInGroup(req.GroupID, sess.UserID) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		// default to the user group
+		group, err := GetGroup(sess.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.GroupID = group.ID
+	}
+
+	kb := KnowledgeBase{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+		EmbedModel:  ai.DefaultEmbedModel,
+		UserID:      sess.UserID,
+		GroupID:     req.GroupID,
+	}
+
+	if err := db.Create(&kb).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, KnowledgeCreateResponse{KnowledgeBase: kb})
+}
+
+// KnowledgeRead returns a knowledge base and its documents
+func KnowledgeRead(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := KnowledgeReadRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	kb, err := GetKnowledge(req.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "knowledge base not found", http.StatusNotFound)
+		return
+	}
+
+	var docs []Document
+	if err := db.Order("created_at desc").Where("knowledge_id = ?", kb.ID).Find(&docs).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, KnowledgeReadResponse{
+		KnowledgeBase: *kb,
+		Documents:     docs,
+	})
+}
+
+// KnowledgeDelete deletes a knowledge base owned by the user along with its documents
+func KnowledgeDelete(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := KnowledgeDeleteRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var kb KnowledgeBase
+	if err := db.Where("id = ?", req.ID).First(&kb).Error; err != nil {
+		http.Error(w, "knowledge base not found", http.StatusNotFound)
+		return
+	}
+
+	// check the owner matches
+	if kb.UserID != sess.UserID {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var docs []Document
+	if err := db.Where("knowledge_id = ?", kb.ID).Find(&docs).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, doc := range docs {
+		if err := removeDocument(&doc); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := db.Where("knowledge_id = ?", kb.ID).Delete(&Document{}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.Delete(&kb).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, KnowledgeDeleteResponse{})
+}
+
+// KnowledgeIndex lists the knowledge bases of the user's groups
+func KnowledgeIndex(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := KnowledgeIndexRequest{
+		GroupID: r.Form.Get("group_id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var groupIDs []string
+
+	if len(req.GroupID) > 0 {
+		if !IsInGroup(req.GroupID, sess.UserID) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		groupIDs = append(groupIDs, req.GroupID)
+	} else {
+		// Get all groups for the current user
+		var groupMembers []GroupMember
+		if err := db.Where("user_id = ?", sess.UserID).Find(&groupMembers).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, gm := range groupMembers {
+			groupIDs = append(groupIDs, gm.GroupID)
+		}
+	}
+
+	var kbs []KnowledgeBase
+
+	if len(groupIDs) > 0 {
+		if err := db.Order("updated_at desc").Where("group_id IN ?", groupIDs).Find(&kbs).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	respond(w, r, KnowledgeIndexResponse{KnowledgeBases: kbs})
+}
+
+// KnowledgeUpload adds a document to a knowledge base. The document is sent
+// as a multipart file or as content in the request and is chunked and embedded.
+func KnowledgeUpload(w http.ResponseWriter, r *http.Request) {
+	var req KnowledgeUploadRequest
+	var data []byte
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		// multipart file upload
+		if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, hdr, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file required", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+
+		data, err = io.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req.KnowledgeID = r.FormValue("knowledge_id")
+		req.Name = r.FormValue("name")
+		req.ContentType = r.FormValue("content_type")
+
+		if len(req.Name) == 0 {
+			req.Name = hdr.Filename
+		}
+		if len(req.ContentType) == 0 {
+			req.ContentType = hdr.Header.Get("Content-Type")
+		}
+	} else {
+		// Parse form and fill request with form values
+		r.ParseForm()
+		req.KnowledgeID = r.Form.Get("knowledge_id")
+		req.Name = r.Form.Get("name")
+		req.ContentType = r.Form.Get("content_type")
+		req.Content = r.Form.Get("content")
+
+		// Decode the request
+		if err := decode(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data = []byte(req.Content)
+	}
+
+	if len(req.KnowledgeID) == 0 || len(req.Name) == 0 {
+		http.Error(w, "knowledge_id and name required", http.StatusBadRequest)
+		return
+	}
+
+	if len(data) == 0 {
+		http.Error(w, "content required", http.StatusBadRequest)
+		return
+	}
+
+	kb, err := GetKnowledge(req.KnowledgeID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "knowledge base not found", http.StatusNotFound)
+		return
+	}
+
+	text, err := extractText(req.Name, req.ContentType, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc := Document{
+		ID:          uuid.New().String(),
+		KnowledgeID: kb.ID,
+		Name:        req.Name,
+		ContentType: req.ContentType,
+		Size:        len(data),
+		UserID:      sess.UserID,
+	}
+
+	if err := indexDocument(r.Context(), kb, &doc, text); err != nil {
+		log.Printf("Error indexing document %v: %v\n", doc.Name, err)
+		removeDocument(&doc)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.Create(&doc).Error; err != nil {
+		removeDocument(&doc)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, KnowledgeUploadResponse{Document: doc})
+}
+
+// KnowledgeRemove removes a document from a knowledge base
+func KnowledgeRemove(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := KnowledgeRemoveRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var doc Document
+	if err := db.Where("id = ?", req.ID).First(&doc).Error; err != nil {
+		http.Error(w, "document not found", http.StatusNotFound)
+		return
+	}
+
+	// group members can remove documents
+	if _, err := GetKnowledge(doc.KnowledgeID, sess.UserID); err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := removeDocument(&doc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.Delete(&doc).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, KnowledgeRemoveResponse{})
+}
+
+// GetKnowledge returns a knowledge base if the user is a member of its group
+func GetKnowledge(id, userID string) (*KnowledgeBase, error) {
+	var kb KnowledgeBase
+	if err := db.Where("id = ?", id).First(&kb).Error; err != nil {
+		return nil, err
+	}
+
+	if kb.UserID == userID || IsInGroup(kb.GroupID, userID) {
+		return &kb, nil
+	}
+
+	return nil, ErrUnauthorized
+}
+
+// knowledgeCollection is the vector collection of a knowledge base
+func knowledgeCollection(id string) string {
+	return "knowledge:" + id
+}
+
+// indexDocument chunks and embeds the text of a document
+func indexDocument(ctx context.Context, kb *KnowledgeBase, doc *Document, text string) error {
+	chunks := ai.Chunk(text, 0)
+	if len(chunks) == 0 {
+		return errors.New("document has no text")
+	}
+
+	for i := 0; i < len(chunks); i += EmbedBatch {
+		end := i + EmbedBatch
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+
+		batch := chunks[i:end]
+
+		vecs, err := ai.Embed(ctx, kb.EmbedModel, batch...)
+		if err != nil {
+			return err
+		}
+		if len(vecs) != len(batch) {
+			return fmt.Errorf("expected %d embeddings got %d", len(batch), len(vecs))
+		}
+
+		for j, vec := range vecs {
+			chunk := Chunk{
+				ID:          uuid.New().String(),
+				KnowledgeID: kb.ID,
+				DocumentID:  doc.ID,
+				Position:    i + j,
+				Content:     batch[j],
+			}
+
+			if err := db.Create(&chunk).Error; err != nil {
+				return err
+			}
+
+			if err := db.PutVector(knowledgeCollection(kb.ID), chunk.ID, vec); err != nil {
+				return err
+			}
+		}
+	}
+
+	doc.Chunks = len(chunks)
+
+	return nil
+}
+
+// removeDocument deletes the chunks and vectors of a document
+func removeDocument(doc *Document) error {
+	var chunks []Chunk
+	if err := db.Where("document_id = ?", doc.ID).Find(&chunks).Error; err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if err := db.DeleteVector(knowledgeCollection(c.KnowledgeID), c.ID); err != nil {
+			return err
+		}
+	}
+
+	return db.Unscoped().Where("document_id = ?", doc.ID).Delete(&Chunk{}).Error
+}
+
+// checkKnowledge verifies the user has access to the knowledge bases
+func checkKnowledge(ids []string, userID string) error {
+	for _, id := range ids {
+		if _, err := GetKnowledge(id, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retrieve returns the chunks of the knowledge bases most relevant to the prompt,
+// the knowledge bases the user can't access are skipped
+func retrieve(ctx context.Context, ids []string, userID, prompt string) ([]Citation, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var kbs []*KnowledgeBase
+	for _, id := range ids {
+		kb, err := GetKnowledge(id, userID)
+		if err != nil {
+			continue
+		}
+		kbs = append(kbs, kb)
+	}
+
+	// prompt embeddings by model
+	vecs := map[string][]float32{}
+
+	var matches []Citation
+
+	for _, kb := range kbs {
+		vec, ok := vecs[kb.EmbedModel]
+		if !ok {
+			v, err := ai.Embed(ctx, kb.EmbedModel, prompt)
+			if err != nil {
+				return nil, err
+			}
+			if len(v) == 0 {
+				continue
+			}
+			vec = v[0]
+			vecs[kb.EmbedModel] = vec
+		}
+
+		res, err := db.SearchVectors(knowledgeCollection(kb.ID), vec, KnowledgeResults)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range res {
+			matches = append(matches, Citation{
+				KnowledgeID: kb.ID,
+				ChunkID:     m.ID,
+				Score:       m.Score,
+			})
+		}
+	}
+
+	// best matches across knowledge bases
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+
+	if len(matches) > KnowledgeResults {
+		matches = matches[:KnowledgeResults]
+	}
+
+	var citations []Citation
+
+	for _, c := range matches {
+		var chunk Chunk
+		if err := db.Where("id = ?", c.ChunkID).First(&chunk).Error; err != nil {
+			continue
+		}
+
+		var doc Document
+		if err := db.Where("id = ?", chunk.DocumentID).First(&doc).Error; err != nil {
+			continue
+		}
+
+		c.Index = len(citations) + 1
+		c.DocumentID = doc.ID
+		c.Name = doc.Name
+		c.Content = chunk.Content
+
+		citations = append(citations, c)
+	}
+
+	return citations, nil
+}
+
+// withCitations adds the retrieved sources to the system prompt
+func withCitations(system string, citations []Citation) string {
+	if len(citations) == 0 {
+		return system
+	}
+
+	var sb strings.Builder
+
+	if len(system) > 0 {
+		sb.WriteString(system)
+		sb.WriteString("\n\n")
+	}
+
+	sb.WriteString("Use the following sources to answer where relevant. ")
+	sb.WriteString("Cite the sources used by their number e.g [1].\n")
+
+	for _, c := range citations {
+		fmt.Fprintf(&sb, "\n[%d] %s\n%s\n", c.Index, c.Name, c.Content)
+	}
+
+	return sb.String()
+}
+
+// extractText returns the text of a markdown, text, html or pdf document
+func extractText(name, contentType string, data []byte) (string, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	switch {
+	case ext == ".pdf" || strings.HasPrefix(contentType, "application/pdf"):
+		return pdfText(data)
+	case ext == ".html" || ext == ".htm" || strings.HasPrefix(contentType, "text/html"):
+		return htmlText(data), nil
+	}
+
+	if !utf8.Valid(data) {
+		return "", errors.New("unsupported document type")
+	}
+
+	return string(data), nil
+}
+
+// pdfText extracts the plain text of a pdf
+func pdfText(data []byte) (text string, err error) {
+	// the pdf reader panics on malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("invalid pdf: %v", r)
+		}
+	}()
+
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid pdf: %v", err)
+	}
+
+	var sb strings.Builder
+
+	for i := 1; i <= r.NumPage(); i++ {
+		p := r.Page(i)
+		if p.V.IsNull() {
+			continue
+		}
+
+		text, err := p.GetPlainText(nil)
+		if err != nil {
+			return "", fmt.Errorf("invalid pdf: %v", err)
+		}
+
+		sb.WriteString(text)
+		sb.WriteString("\n\n")
+	}
+
+	return sb.String(), nil
+}
+
+// htmlText extracts the visible text of a html document keeping block breaks
+func htmlText(data []byte) string {
+	var sb strings.Builder
+	var skip int
+
+	z := html.NewTokenizer(bytes.NewReader(data))
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return sb.String()
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+
+			switch tok.Data {
+			case "script", "style", "head", "noscript":
+				if tok.Type == html.StartTagToken {
+					skip++
+				} else if tok.Type == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case "p", "div", "br", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6",
+				"section", "article", "pre", "blockquote", "table", "ul", "ol":
+				sb.WriteString("\n\n")
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			if text := strings.TrimSpace(string(z.Text())); len(text) > 0 {
+				sb.WriteString(text)
+				sb.WriteString(" ")
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractText(t *testing.T) {
+	text, err := extractText("notes.md", "", []byte("# Notes\n\nHello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Notes\n\nHello", text)
+
+	text, err = extractText("page.html", "", []byte(`<html><head><title>x</title><style>p{}</style></head><body><h1>Title</h1><p>Hello <b>world</b></p><script>alert(1)</script></body></html>`))
+	assert.NoError(t, err)
+	assert.Contains(t, text, "Title")
+	assert.Contains(t, text, "Hello world")
+	assert.NotContains(t, text, "alert")
+	assert.NotContains(t, text, "p{}")
+
+	_, err = extractText("doc.pdf", "", []byte("not a pdf"))
+	assert.Error(t, err)
+
+	_, err = extractText("image.bin", "", []byte{0xff, 0xfe, 0xfd})
+	assert.Error(t, err)
+}
+
+func TestRetrieve(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// embed by the count of some words
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var rsp struct {
+			Embeddings [][]float32 `json:"embeddings"`
+		}
+		for _, in := range req.Input {
+			in = strings.ToLower(in)
+			rsp.Embeddings = append(rsp.Embeddings, []float32{
+				float32(strings.Count(in, "cat")),
+				float32(strings.Count(in, "dog")),
+				0.1,
+			})
+		}
+		json.NewEncoder(w).Encode(rsp)
+	}))
+	defer srv.Close()
+
+	ai.Register(ai.NewOllama(ai.Config{URL: srv.URL}))
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&KnowledgeBase{}, &Document{}, &Chunk{}, &db.Vector{}, &GroupMember{})
+
+	kb := &KnowledgeBase{
+		ID:         uuid.New().String(),
+		Name:       "pets",
+		EmbedModel: "ollama/embed",
+		UserID:     "user-1",
+		GroupID:    "group-1",
+	}
+	db.Create(kb)
+
+	doc := &Document{
+		ID:          uuid.New().String(),
+		KnowledgeID: kb.ID,
+		Name:        "pets.md",
+	}
+
+	text := "Cats purr and a cat sleeps all day.\n\nDogs bark and a dog fetches the ball."
+	assert.NoError(t, indexDocument(context.TODO(), kb, doc, text))
+	assert.Equal(t, 1, doc.Chunks)
+
+	// smaller chunks per paragraph
+	size := ai.ChunkSize
+	ai.ChunkSize = 12
+	defer func() { ai.ChunkSize = size }()
+
+	assert.NoError(t, removeDocument(doc))
+	assert.NoError(t, indexDocument(context.TODO(), kb, doc, text))
+	assert.Equal(t, 2, doc.Chunks)
+	db.Create(doc)
+
+	citations, err := retrieve(context.TODO(), []string{kb.ID}, "user-1", "tell me about dogs")
+	assert.NoError(t, err)
+	assert.Len(t, citations, 2)
+	assert.Equal(t, 1, citations[0].Index)
+	assert.Equal(t, "pets.md", citations[0].Name)
+	assert.Contains(t, citations[0].Content, "Dogs bark")
+
+	system := withCitations("Be brief", citations)
+	assert.True(t, strings.HasPrefix(system, "Be brief\n\n"))
+	assert.Contains(t, system, "[1] pets.md\nDogs bark")
+
+	// group members only
+	assert.NoError(t, checkKnowledge([]string{kb.ID}, "user-1"))
+	assert.Equal(t, ErrUnauthorized, checkKnowledge([]string{kb.ID}, "user-2"))
+
+	// nothing is retrieved for users outside the group
+	citations, err = retrieve(context.TODO(), []string{kb.ID}, "user-2", "tell me about dogs")
+	assert.NoError(t, err)
+	assert.Empty(t, citations)
+
+	// a member who left the group
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-3"})
+
+	citations, err = retrieve(context.TODO(), []string{kb.ID}, "user-3", "tell me about dogs")
+	assert.NoError(t, err)
+	assert.Len(t, citations, 2)
+
+	db.Where("group_id = ? AND user_id = ?", "group-1", "user-3").Delete(&GroupMember{})
+
+	citations, err = retrieve(context.TODO(), []string{kb.ID}, "user-3", "tell me about dogs")
+	assert.NoError(t, err)
+	assert.Empty(t, citations)
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/event"
+	"github.com/asim/turbo/log"
+)
+
+const (
+	// RuleAlias points a name at a model e.g fast=ollama/llama3
+	RuleAlias = "alias"
+	// RuleAllow allows only the matching models
+	RuleAllow = "allow"
+	// RuleDeny denies the matching models
+	RuleDeny = "deny"
+)
+
+// ModelRulesTopic is the event topic used to reload the model rules across nodes
+var ModelRulesTopic = "model_rules"
+
+// ModelRule is an alias, allow or deny rule for the models set by the admin
+type ModelRule struct {
+	// type:name
+	ID   string `json:"id" gorm:"primaryKey"`
+	Type string `json:"type"`
+	// alias or model pattern e.g ollama/*
+	Name string `json:"name"`
+	// the model an alias points at
+	Model     string    `json:"model,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ModelIndexRequest struct{}
+
+type ModelIndexResponse struct {
+	Models []ai.ModelInfo `json:"models"`
+}
+
+type AdminModelIndexRequest struct{}
+
+type AdminModelIndexResponse struct {
+	Models []ai.ModelInfo `json:"models"`
+	Rules  []ModelRule    `json:"rules"`
+}
+
+type AdminModelRuleSetRequest struct {
+	Type  string `json:"type" valid:"required"`
+	Name  string `json:"name" valid:"required"`
+	Model string `json:"model"`
+}
+
+type AdminModelRuleSetResponse struct {
+	Rule ModelRule `json:"rule"`
+}
+
+type AdminModelRuleDeleteRequest struct {
+	Type string `json:"type" valid:"required"`
+	Name string `json:"name" valid:"required"`
+}
+
+type AdminModelRuleDeleteResponse struct{}
+
+type AdminModelDiscoverRequest struct{}
+
+type AdminModelDiscoverResponse struct {
+	Models []ai.ModelInfo `json:"models"`
+}
+
+type AdminUpstreamsRequest struct{}
+
+type AdminUpstreamsResponse struct {
+	Upstreams []ai.UpstreamStatus `json:"upstreams"`
+}
+
+type AdminCacheRequest struct{}
+
+type AdminCacheResponse struct {
+	ai.CacheStats
+	Enabled bool    `json:"enabled"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// LoadModelRules applies the rules saved by the admin to the models
+func LoadModelRules() error {
+	var rules []ModelRule
+	if err := db.Find(&rules).Error; err != nil {
+		return err
+	}
+
+	var allow, deny []string
+	aliases := map[string]string{}
+
+	for _, r := range rules {
+		switch r.Type {
+		case RuleAlias:
+			aliases[r.Name] = r.Model
+		case RuleAllow:
+			allow = append(allow, r.Name)
+		case RuleDeny:
+			deny = append(deny, r.Name)
+		}
+	}
+
+	ai.SetAliases(aliases)
+	ai.SetRules(allow, deny)
+
+	return nil
+}
+
+// WatchModelRules reloads the model rules when they're changed on any node until the context is done
+func WatchModelRules(ctx context.Context) error {
+	sub, err := event.Subscribe(ModelRulesTopic)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer event.Unsubscribe(sub)
+
+		for {
+			var id string
+			if err := sub.Next(ctx, &id); err != nil {
+				if ctx.Err() == nil {
+					log.Print("Model rules subscription ended", err)
+				}
+				return
+			}
+			if err := LoadModelRules(); err != nil {
+				log.Print("Failed to reload model rules", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reloadModelRules applies the rules here and tells the other nodes to reload
+func reloadModelRules(id string) error {
+	if err := LoadModelRules(); err != nil {
+		return err
+	}
+	return event.Publish(ModelRulesTopic, id)
+}
+
+// ModelIndex lists the models a user may pick
+func ModelIndex(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// attempt to pull user session from context
+	if _, ok := r.Context().Value(Session{}).(*Session); !ok {
+		// no session, don't proceed
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	models := []ai.ModelInfo{}
+
+	for _, m := range ai.ListModels() {
+		if m.Allowed {
+			models = append(models, m)
+		}
+	}
+
+	respond(w, r, ModelIndexResponse{Models: models})
+}
+
+// AdminModelIndex lists every model, including those denied, and the rules
+func AdminModelIndex(w http.ResponseWriter, r *http.Request) {
+	var rules []ModelRule
+	if err := db.Order("id asc").Find(&rules).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, AdminModelIndexResponse{
+		Models: ai.ListModels(),
+		Rules:  rules,
+	})
+}
+
+// AdminModelRuleSet aliases, allows or denies models
+func AdminModelRuleSet(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := AdminModelRuleSetRequest{
+		Type:  r.Form.Get("type"),
+		Name:  r.Form.Get("name"),
+		Model: r.Form.Get("model"),
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Type {
+	case RuleAlias:
+		if strings.Contains(req.Name, "/") {
+			http.Error(w, "alias can't contain /", http.StatusBadRequest)
+			return
+		}
+		// must point at a real model rather than another alias
+		if _, err := ai.GetModel(req.Model); err != nil || !strings.Contains(req.Model, "/") {
+			http.Error(w, "Unsupported model "+req.Model, http.StatusBadRequest)
+			return
+		}
+	case RuleAllow, RuleDeny:
+		req.Model = ""
+	default:
+		http.Error(w, "type must be alias, allow or deny", http.StatusBadRequest)
+		return
+	}
+
+	rule := ModelRule{
+		ID:    req.Type + ":" + req.Name,
+		Type:  req.Type,
+		Name:  req.Name,
+		Model: req.Model,
+	}
+
+	// keep the created time
+	var old ModelRule
+	if err := db.Where("id = ?", rule.ID).First(&old).Error; err == nil {
+		rule.CreatedAt = old.CreatedAt
+	}
+
+	if err := db.Update(&rule).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := reloadModelRules(rule.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, AdminModelRuleSetResponse{Rule: rule})
+}
+
+// AdminModelRuleDelete removes a rule
+func AdminModelRuleDelete(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := AdminModelRuleDeleteRequest{
+		Type: r.Form.Get("type"),
+		Name: r.Form.Get("name"),
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Where("id = ?", req.Type+":"+req.Name).Delete(&ModelRule{}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := reloadModelRules(req.Type + ":" + req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, AdminModelRuleDeleteResponse{})
+}
+
+// AdminModelDiscover lists the models of the upstreams now
+func AdminModelDiscover(w http.ResponseWriter, r *http.Request) {
+	if err := ai.Discover(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	respond(w, r, AdminModelDiscoverResponse{Models: ai.ListModels()})
+}
+
+// AdminUpstreams returns the health of the upstreams in the pool
+func AdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	rsp := AdminUpstreamsResponse{Upstreams: []ai.UpstreamStatus{}}
+
+	if ai.Upstreams != nil {
+		rsp.Upstreams = ai.Upstreams.Status()
+	}
+
+	respond(w, r, rsp)
+}
+
+// AdminCache returns the hits and misses of the completion cache
+func AdminCache(w http.ResponseWriter, r *http.Request) {
+	stats := ai.GetCacheStats()
+
+	var rate float64
+	if n := stats.Hits + stats.Misses; n > 0 {
+		rate = float64(stats.Hits) / float64(n)
+	}
+
+	respond(w, r, AdminCacheResponse{
+		CacheStats: stats,
+		Enabled:    ai.CacheTTL > 0,
+		HitRate:    rate,
+	})
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelRules(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	defer func() {
+		ai.SetRules(nil, nil)
+		ai.SetAliases(nil)
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &ModelRule{}, &Group{}, &GroupMember{}, &Usage{}, &Quota{})
+
+	// the user's group
+	db.Create(&Group{ID: "group-1", Name: "test"})
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-1"})
+
+	call := func(hdr http.HandlerFunc, form url.Values, rsp interface{}) int {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: "user-1"}))
+
+		w := httptest.NewRecorder()
+		hdr(w, r)
+		json.Unmarshal(w.Body.Bytes(), rsp)
+		return w.Code
+	}
+
+	names := func() []string {
+		var index ModelIndexResponse
+		assert.Equal(t, 200, call(ModelIndex, url.Values{}, &index))
+
+		var names []string
+		for _, m := range index.Models {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	// unknown models are rejected
+	var chat ChatCreateResponse
+	assert.Equal(t, 400, call(ChatCreate, url.Values{"name": {"test"}, "model": {"nope"}}, &chat))
+	assert.Equal(t, 200, call(ChatCreate, url.Values{"name": {"test"}, "model": {"mock/lorem"}}, &chat))
+	assert.Contains(t, names(), "mock/lorem")
+
+	// denied by the admin
+	var set AdminModelRuleSetResponse
+	assert.Equal(t, 200, call(AdminModelRuleSet, url.Values{"type": {"deny"}, "name": {"mock/lorem"}}, &set))
+	assert.Equal(t, "deny:mock/lorem", set.Rule.ID)
+
+	assert.NotContains(t, names(), "mock/lorem")
+	assert.Contains(t, names(), "mock/echo")
+	assert.Equal(t, 400, call(ChatCreate, url.Values{"name": {"test"}, "model": {"mock/lorem"}}, &chat))
+
+	// the existing chat can't be prompted
+	var prompt ChatPromptResponse
+	assert.Equal(t, 400, call(ChatPrompt, url.Values{"id": {chat.ID}, "prompt": {"hello"}}, &prompt))
+
+	// aliased by the admin
+	assert.Equal(t, 400, call(AdminModelRuleSet, url.Values{"type": {"alias"}, "name": {"fast"}, "model": {"nope"}}, &set))
+	assert.Equal(t, 400, call(AdminModelRuleSet, url.Values{"type": {"other"}, "name": {"fast"}}, &set))
+	assert.Equal(t, 200, call(AdminModelRuleSet, url.Values{"type": {"alias"}, "name": {"fast"}, "model": {"mock/echo"}}, &set))
+
+	var index ModelIndexResponse
+	assert.Equal(t, 200, call(ModelIndex, url.Values{}, &index))
+
+	var found bool
+	for _, m := range index.Models {
+		if m.Name == "fast" {
+			found = true
+			assert.Equal(t, "mock/echo", m.Alias)
+		}
+	}
+	assert.True(t, found)
+
+	assert.Equal(t, 200, call(ChatCreate, url.Values{"name": {"test"}, "model": {"fast"}}, &chat))
+	assert.Equal(t, "fast", chat.LLM)
+
+	// the admin sees the denied models and the rules
+	var admin AdminModelIndexResponse
+	assert.Equal(t, 200, call(AdminModelIndex, url.Values{}, &admin))
+	assert.Len(t, admin.Rules, 2)
+
+	for _, m := range admin.Models {
+		if m.Name == "mock/lorem" {
+			assert.False(t, m.Allowed)
+		}
+	}
+
+	// loaded again on restart
+	ai.SetRules(nil, nil)
+	assert.NoError(t, LoadModelRules())
+	assert.NotContains(t, names(), "mock/lorem")
+
+	var del AdminModelRuleDeleteResponse
+	assert.Equal(t, 200, call(AdminModelRuleDelete, url.Values{"type": {"deny"}, "name": {"mock/lorem"}}, &del))
+	assert.Contains(t, names(), "mock/lorem")
+
+	// reloaded when changed on another node
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, WatchModelRules(ctx))
+	assert.NoError(t, db.Update(&ModelRule{ID: "deny:mock/echo", Type: RuleDeny, Name: "mock/echo"}).Error)
+	assert.NoError(t, event.Publish(ModelRulesTopic, "deny:mock/echo"))
+	assert.Eventually(t, func() bool {
+		return !ai.Allowed("mock/echo")
+	}, 5*time.Second, 10*time.Millisecond)
+}
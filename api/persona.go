@@ -0,0 +1,322 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Persona is a reusable system prompt owned by a user or group
+type Persona struct {
+	gorm.Model
+	ID          string `json:"id" valid:"required"`
+	Name        string `json:"name" valid:"length(1|30)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	System      string `json:"system" valid:"required"`
+	UserID      string `json:"user_id" gorm:"index"`
+	GroupID     string `json:"group_id" gorm:"index"`
+}
+
+type PersonaCreateRequest struct {
+	Name        string `json:"name" valid:"required,length(1|30)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	System      string `json:"system" valid:"required"`
+	GroupID     string `json:"group_id"`
+}
+
+type PersonaCreateResponse struct {
+	Persona
+}
+
+type PersonaReadRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type PersonaReadResponse struct {
+	Persona
+}
+
+type PersonaUpdateRequest struct {
+	ID          string `json:"id" valid:"required"`
+	Name        string `json:"name" valid:"required,length(1|30)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	System      string `json:"system" valid:"required"`
+}
+
+type PersonaUpdateResponse struct {
+	Persona
+}
+
+type PersonaDeleteRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type PersonaDeleteResponse struct{}
+
+type PersonaIndexRequest struct {
+	GroupID string `json:"group_id"`
+}
+
+type PersonaIndexResponse struct {
+	Personas []Persona `json:"personas"`
+}
+
+// PersonaCreate creates a persona for the user or a group they're a member of
+func PersonaCreate(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PersonaCreateRequest{
+		Name:        r.Form.Get("name"),
+		Description: r.Form.Get("description"),
+		System:      r.Form.Get("system"),
+		GroupID:     r.Form.Get("group_id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// must be a member to share with the group
+	if len(req.GroupID) > 0 && !IsInGroup(req.GroupID, sess.UserID) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	persona := Persona{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+		System:      req.System,
+		UserID:      sess.UserID,
+		GroupID:     req.GroupID,
+	}
+
+	if err := db.Create(&persona).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with created persona
+	respond(w, r, PersonaCreateResponse{Persona: persona})
+}
+
+// PersonaRead returns a persona owned by the user or their group
+func PersonaRead(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PersonaReadRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	persona, err := GetPersona(req.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "persona not found", http.StatusNotFound)
+		return
+	}
+
+	// Respond with persona
+	respond(w, r, PersonaReadResponse{Persona: *persona})
+}
+
+// PersonaUpdate updates a persona owned by the user
+func PersonaUpdate(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PersonaUpdateRequest{
+		ID:          r.Form.Get("id"),
+		Name:        r.Form.Get("name"),
+		Description: r.Form.Get("description"),
+		System:      r.Form.Get("system"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get persona from database
+	var persona Persona
+	if err := db.Where("id = ?", req.ID).First(&persona).Error; err != nil {
+		http.Error(w, "persona not found", http.StatusNotFound)
+		return
+	}
+
+	// check the owner matches
+	if persona.UserID != sess.UserID {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	persona.Name = req.Name
+	persona.Description = req.Description
+	persona.System = req.System
+
+	// Save persona to database
+	if err := db.Update(&persona).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with updated persona
+	respond(w, r, PersonaUpdateResponse{Persona: persona})
+}
+
+// PersonaDelete deletes a persona owned by the user
+func PersonaDelete(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PersonaDeleteRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get persona from database
+	var persona Persona
+	if err := db.Where("id = ?", req.ID).First(&persona).Error; err != nil {
+		http.Error(w, "persona not found", http.StatusNotFound)
+		return
+	}
+
+	// check the owner matches
+	if persona.UserID != sess.UserID {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.Delete(&persona).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, PersonaDeleteResponse{})
+}
+
+// PersonaIndex lists the personas of the user and their groups
+func PersonaIndex(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PersonaIndexRequest{
+		GroupID: r.Form.Get("group_id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var personas []Persona
+
+	// list personas for a specific group
+	if len(req.GroupID) > 0 {
+		if !IsInGroup(req.GroupID, sess.UserID) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := db.Where("group_id = ?", req.GroupID).Find(&personas).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, r, PersonaIndexResponse{Personas: personas})
+		return
+	}
+
+	// Get all groups for the current user
+	var groupMembers []GroupMember
+	if err := db.Where("user_id = ?", sess.UserID).Find(&groupMembers).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	groupIDs := make([]string, len(groupMembers))
+	for i, gm := range groupMembers {
+		groupIDs[i] = gm.GroupID
+	}
+
+	q := db.Order("updated_at desc").Where("user_id = ?", sess.UserID)
+	if len(groupIDs) > 0 {
+		q = q.Or("group_id IN ?", groupIDs)
+	}
+
+	if err := q.Find(&personas).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, PersonaIndexResponse{Personas: personas})
+}
+
+// GetPersona returns a persona if the user owns it or is a member of its group
+func GetPersona(id, userID string) (*Persona, error) {
+	var persona Persona
+	if err := db.Where("id = ?", id).First(&persona).Error; err != nil {
+		return nil, err
+	}
+
+	if persona.UserID == userID {
+		return &persona, nil
+	}
+
+	if len(persona.GroupID) > 0 && IsInGroup(persona.GroupID, userID) {
+		return &persona, nil
+	}
+
+	return nil, ErrUnauthorized
+}
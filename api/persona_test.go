@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSystem(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Persona{}, &GroupMember{})
+
+	persona := Persona{
+		ID:      uuid.New().String(),
+		Name:    "pirate",
+		System:  "You talk like a pirate",
+		UserID:  "user-1",
+		GroupID: "group-1",
+	}
+	db.Create(&persona)
+
+	// chat system prompt
+	assert.Equal(t, "Be brief", getSystem(&Chat{System: "Be brief", PersonaID: persona.ID}))
+
+	// fallback to the persona
+	assert.Equal(t, persona.System, getSystem(&Chat{PersonaID: persona.ID}))
+
+	// no system prompt
+	assert.Equal(t, "", getSystem(&Chat{}))
+
+	// owner has access
+	_, err := GetPersona(persona.ID, "user-1")
+	assert.NoError(t, err)
+
+	// non group member does not
+	_, err = GetPersona(persona.ID, "user-2")
+	assert.Equal(t, ErrUnauthorized, err)
+
+	// group member does
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-2"})
+	_, err = GetPersona(persona.ID, "user-2")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,449 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Prompt is a saved prompt template owned by a user or shared with a group.
+// Templates use text/template variables e.g {{.language}}
+type Prompt struct {
+	gorm.Model
+	ID          string `json:"id" valid:"required"`
+	Name        string `json:"name" valid:"length(1|30)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	Template    string `json:"template" valid:"required"`
+	// variables used by the template
+	Variables []string `json:"variables" gorm:"serializer:json"`
+	UserID    string   `json:"user_id" gorm:"index"`
+	GroupID   string   `json:"group_id" gorm:"index"`
+	// number of times used by /chat/prompt
+	Uses int64 `json:"uses"`
+}
+
+type PromptCreateRequest struct {
+	Name        string `json:"name" valid:"required,length(1|30)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	Template    string `json:"template" valid:"required"`
+	GroupID     string `json:"group_id"`
+}
+
+type PromptCreateResponse struct {
+	Prompt
+}
+
+type PromptReadRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type PromptReadResponse struct {
+	Prompt
+}
+
+type PromptUpdateRequest struct {
+	ID          string `json:"id" valid:"required"`
+	Name        string `json:"name" valid:"required,length(1|30)"`
+	Description string `json:"description" valid:"length(0|256)"`
+	Template    string `json:"template" valid:"required"`
+}
+
+type PromptUpdateResponse struct {
+	Prompt
+}
+
+type PromptDeleteRequest struct {
+	ID string `json:"id" valid:"required"`
+}
+
+type PromptDeleteResponse struct{}
+
+type PromptIndexRequest struct {
+	GroupID string `json:"group_id"`
+	// popular sorts by uses
+	Sort string `json:"sort" valid:"in(recent|popular)"`
+}
+
+type PromptIndexResponse struct {
+	Prompts []Prompt `json:"prompts"`
+}
+
+// parsePrompt parses the template and returns the variables it uses
+func parsePrompt(text string) ([]string, error) {
+	t, err := template.New("prompt").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+
+	var walk func(node parse.Node)
+
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				for _, arg := range c.Args {
+					walk(arg)
+				}
+			}
+		case *parse.FieldNode:
+			seen[n.Ident[0]] = true
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+
+	if t.Tree != nil {
+		walk(t.Tree.Root)
+	}
+
+	vars := []string{}
+	for v := range seen {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+
+	return vars, nil
+}
+
+// renderPrompt executes the template with the variables. Missing variables are an error.
+func renderPrompt(text string, vars map[string]string) (string, error) {
+	t, err := template.New("prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, vars); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+// parseVariables reads form values set as variables[name]=value
+func parseVariables(form url.Values) map[string]string {
+	vars := map[string]string{}
+
+	for k, v := range form {
+		if !strings.HasPrefix(k, "variables[") || !strings.HasSuffix(k, "]") || len(v) == 0 {
+			continue
+		}
+		vars[k[len("variables["):len(k)-1]] = v[0]
+	}
+
+	return vars
+}
+
+// usePrompt counts a use of the prompt
+func usePrompt(id string) error {
+	return db.Model(&Prompt{}).Where("id = ?", id).UpdateColumn("uses", gorm.Expr("uses + 1")).Error
+}
+
+// PromptCreate saves a prompt for the user or a group they're a member of
+func PromptCreate(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PromptCreateRequest{
+		Name:        r.Form.Get("name"),
+		Description: r.Form.Get("description"),
+		Template:    r.Form.Get("template"),
+		GroupID:     r.Form.Get("group_id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars, err := parsePrompt(req.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// must be a member to share with the group
+	if len(req.GroupID) > 0 && !IsInGroup(req.GroupID, sess.UserID) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prompt := Prompt{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		Description: req.Description,
+		Template:    req.Template,
+		Variables:   vars,
+		UserID:      sess.UserID,
+		GroupID:     req.GroupID,
+	}
+
+	if err := db.Create(&prompt).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with created prompt
+	respond(w, r, PromptCreateResponse{Prompt: prompt})
+}
+
+// PromptRead returns a prompt owned by the user or their group
+func PromptRead(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PromptReadRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prompt, err := GetPrompt(req.ID, sess.UserID)
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "prompt not found", http.StatusNotFound)
+		return
+	}
+
+	// Respond with prompt
+	respond(w, r, PromptReadResponse{Prompt: *prompt})
+}
+
+// PromptUpdate updates a prompt owned by the user
+func PromptUpdate(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PromptUpdateRequest{
+		ID:          r.Form.Get("id"),
+		Name:        r.Form.Get("name"),
+		Description: r.Form.Get("description"),
+		Template:    r.Form.Get("template"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars, err := parsePrompt(req.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get prompt from database
+	var prompt Prompt
+	if err := db.Where("id = ?", req.ID).First(&prompt).Error; err != nil {
+		http.Error(w, "prompt not found", http.StatusNotFound)
+		return
+	}
+
+	// check the owner matches
+	if prompt.UserID != sess.UserID {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prompt.Name = req.Name
+	prompt.Description = req.Description
+	prompt.Template = req.Template
+	prompt.Variables = vars
+
+	// Save prompt to database
+	if err := db.Update(&prompt).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with updated prompt
+	respond(w, r, PromptUpdateResponse{Prompt: prompt})
+}
+
+// PromptDelete deletes a prompt owned by the user
+func PromptDelete(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PromptDeleteRequest{
+		ID: r.Form.Get("id"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get prompt from database
+	var prompt Prompt
+	if err := db.Where("id = ?", req.ID).First(&prompt).Error; err != nil {
+		http.Error(w, "prompt not found", http.StatusNotFound)
+		return
+	}
+
+	// check the owner matches
+	if prompt.UserID != sess.UserID {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.Delete(&prompt).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, PromptDeleteResponse{})
+}
+
+// PromptIndex lists the prompts of the user and their groups, most recent or popular first
+func PromptIndex(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := PromptIndexRequest{
+		GroupID: r.Form.Get("group_id"),
+		Sort:    r.Form.Get("sort"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order := "updated_at desc"
+	if req.Sort == "popular" {
+		order = "uses desc, updated_at desc"
+	}
+
+	var prompts []Prompt
+
+	// list prompts for a specific group
+	if len(req.GroupID) > 0 {
+		if !IsInGroup(req.GroupID, sess.UserID) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := db.Order(order).Where("group_id = ?", req.GroupID).Find(&prompts).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		respond(w, r, PromptIndexResponse{Prompts: prompts})
+		return
+	}
+
+	// Get all groups for the current user
+	var groupMembers []GroupMember
+	if err := db.Where("user_id = ?", sess.UserID).Find(&groupMembers).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	groupIDs := make([]string, len(groupMembers))
+	for i, gm := range groupMembers {
+		groupIDs[i] = gm.GroupID
+	}
+
+	q := db.Order(order).Where("user_id = ?", sess.UserID)
+	if len(groupIDs) > 0 {
+		q = q.Or("group_id IN ?", groupIDs)
+	}
+
+	if err := q.Find(&prompts).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, PromptIndexResponse{Prompts: prompts})
+}
+
+// GetPrompt returns a prompt if the user owns it or is a member of its group
+func GetPrompt(id, userID string) (*Prompt, error) {
+	var prompt Prompt
+	if err := db.Where("id = ?", id).First(&prompt).Error; err != nil {
+		return nil, err
+	}
+
+	if prompt.UserID == userID {
+		return &prompt, nil
+	}
+
+	if len(prompt.GroupID) > 0 && IsInGroup(prompt.GroupID, userID) {
+		return &prompt, nil
+	}
+
+	return nil, ErrUnauthorized
+}
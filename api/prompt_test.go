@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	vars, err := parsePrompt("Translate {{.text}} to {{.language}}{{if .formal}} formally{{end}}. {{.text}}")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"formal", "language", "text"}, vars)
+
+	_, err = parsePrompt("Translate {{.text")
+	assert.Error(t, err)
+
+	out, err := renderPrompt("Translate {{.text}} to {{.language}}", map[string]string{"text": "hello", "language": "French"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Translate hello to French", out)
+
+	// missing variables are an error
+	_, err = renderPrompt("Translate {{.text}} to {{.language}}", map[string]string{"text": "hello"})
+	assert.Error(t, err)
+
+	form := url.Values{"variables[text]": {"hello"}, "variables[language]": {"French"}, "variables": {"x"}}
+	assert.Equal(t, map[string]string{"text": "hello", "language": "French"}, parseVariables(form))
+}
+
+func TestChatPromptTemplate(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &Prompt{}, &GroupMember{}, &Usage{}, &Quota{}, &User{})
+
+	call := func(hdr http.HandlerFunc, userID string, form url.Values, rsp interface{}) int {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: userID}))
+
+		w := httptest.NewRecorder()
+		hdr(w, r)
+		json.Unmarshal(w.Body.Bytes(), rsp)
+		return w.Code
+	}
+
+	// invalid templates are rejected
+	var create PromptCreateResponse
+	assert.Equal(t, 400, call(PromptCreate, "user-1", url.Values{"name": {"bad"}, "template": {"{{.text"}}, &create))
+
+	// shared with the group
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-1"})
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-2"})
+
+	assert.Equal(t, 200, call(PromptCreate, "user-1", url.Values{
+		"name":     {"translate"},
+		"template": {"Translate {{.prompt}} to {{.language}}"},
+		"group_id": {"group-1"},
+	}, &create))
+	assert.Equal(t, []string{"language", "prompt"}, create.Variables)
+
+	var other PromptCreateResponse
+	assert.Equal(t, 200, call(PromptCreate, "user-1", url.Values{"name": {"other"}, "template": {"Hello"}}, &other))
+
+	chat := Chat{
+		ID:     uuid.New().String(),
+		Name:   "test",
+		LLM:    "mock",
+		UserID: "user-2",
+	}
+	db.Create(&chat)
+
+	// a group member prompts with the template
+	var prompt ChatPromptResponse
+	assert.Equal(t, 200, call(ChatPrompt, "user-2", url.Values{
+		"id":                  {chat.ID},
+		"prompt":              {"hello"},
+		"template_id":         {create.ID},
+		"variables[language]": {"French"},
+	}, &prompt))
+	assert.Equal(t, "Translate hello to French", prompt.Message.Prompt)
+	assert.Equal(t, "Translate hello to French", prompt.Message.Reply)
+	assert.Equal(t, create.ID, prompt.Message.TemplateID)
+
+	// missing variables
+	assert.Equal(t, 400, call(ChatPrompt, "user-2", url.Values{
+		"id":          {chat.ID},
+		"prompt":      {"hello"},
+		"template_id": {create.ID},
+	}, &prompt))
+
+	// not shared with the user
+	assert.Equal(t, 401, call(ChatPrompt, "user-2", url.Values{"id": {chat.ID}, "template_id": {other.ID}}, &prompt))
+
+	// the use is counted
+	var read PromptReadResponse
+	assert.Equal(t, 200, call(PromptRead, "user-2", url.Values{"id": {create.ID}}, &read))
+	assert.Equal(t, int64(1), read.Uses)
+
+	// only the owner can update
+	var update PromptUpdateResponse
+	assert.Equal(t, 401, call(PromptUpdate, "user-2", url.Values{"id": {create.ID}, "name": {"x"}, "template": {"x"}}, &update))
+
+	// most used first
+	var index PromptIndexResponse
+	assert.Equal(t, 200, call(PromptIndex, "user-1", url.Values{"sort": {"popular"}}, &index))
+	assert.Len(t, index.Prompts, 2)
+	assert.Equal(t, create.ID, index.Prompts[0].ID)
+
+	assert.Equal(t, 400, call(PromptIndex, "user-1", url.Values{"sort": {"nope"}}, &index))
+
+	// wait for the usage of the reply
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Usage{}).Where("chat_id = ?", chat.ID).Count(&count)
+		return count == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -3,17 +3,22 @@ package api
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"strings"
 	"sync"
 	"time"
 
 	valid "github.com/asaskevich/govalidator"
+	"github.com/asim/turbo/ai"
 	"github.com/asim/turbo/db"
 	"github.com/asim/turbo/log"
 	"github.com/google/uuid"
@@ -24,6 +29,10 @@ import (
 var (
 	SessionCookie = "sess"
 
+	// TrustedProxies are the ips or cidrs of the proxies in front of turbo e.g 10.0.0.0/8
+	// the client ip is only taken from the forwarded headers of requests they send
+	TrustedProxies []string
+
 	// sessions
 	sessMtx  sync.RWMutex
 	sessions = map[string]*Session{}
@@ -34,11 +43,14 @@ type Options struct {
 	Key string
 	// url to proxy to
 	Url string
+	// pool of upstreams used instead of the key and url
+	Pool *ai.Pool
 }
 
 // Proxy handles all inbound requests
 type Proxy struct {
-	opts *Options
+	opts  *Options
+	proxy *httputil.ReverseProxy
 }
 
 // Event is a request summary
@@ -57,6 +69,11 @@ type Event struct {
 	Method    string        `json:"Method"`
 	Params    string        `json:"Params"`
 	UserID    string        `json:"UserID"`
+	// content types and sizes in bytes, binary bodies are not kept
+	RequestType  string `json:"RequestType"`
+	RequestSize  int64  `json:"RequestSize"`
+	ResponseType string `json:"ResponseType"`
+	ResponseSize int64  `json:"ResponseSize"`
 }
 
 // response wrapper for logger middleware
@@ -86,8 +103,10 @@ func (r *responseWriter) Write(b []byte) (int, error) {
 	size, err := r.ResponseWriter.Write(b) // write response using original http.ResponseWriter
 	// set size
 	r.response.size += size
-	// set data
-	r.response.data = b
+	// keep all the data, streamed responses are written in chunks
+	if isText(r.Header().Get("Content-Type")) {
+		r.response.data = append(r.response.data, b[:size]...)
+	}
 
 	if r.response.status == 0 {
 		r.response.status = 200
@@ -101,17 +120,95 @@ func (r *responseWriter) WriteHeader(statusCode int) {
 	r.response.status = statusCode           // capture status code
 }
 
+// countReader counts the bytes read from a body
+type countReader struct {
+	io.ReadCloser
+	size int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// isJSON returns whether the content type is json, no content type is assumed to be json
+func isJSON(contentType string) bool {
+	if len(contentType) == 0 {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasSuffix(ct, "json")
+}
+
+// isText returns whether the content type is text which can be logged or parsed
+func isText(contentType string) bool {
+	// no content type is assumed to be json
+	if len(contentType) == 0 {
+		return true
+	}
+
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(ct, "text/"),
+		strings.HasSuffix(ct, "json"),
+		strings.HasSuffix(ct, "+xml"),
+		ct == "application/xml",
+		ct == "application/x-www-form-urlencoded":
+		return true
+	}
+
+	return false
+}
+
+// trustedProxy returns whether the ip is one of the trusted proxies
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, p := range TrustedProxies {
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if cidr.Contains(addr) {
+				return true
+			}
+		} else if addr.Equal(net.ParseIP(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// getIP returns the ip of the client, the forwarded headers are only used from trusted proxies
 func getIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !trustedProxy(ip) {
+		return ip
+	}
+
 	if v := r.Header.Get("do-connecting-ip"); len(v) > 0 {
-		return v
+		return strings.TrimSpace(v)
 	}
+
+	// the closest address which isn't another trusted proxy
 	if v := r.Header.Get("X-Forwarded-For"); len(v) > 0 {
-		return v
-	}
-	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return host
+		addrs := strings.Split(v, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			if addr := strings.TrimSpace(addrs[i]); i == 0 || !trustedProxy(addr) {
+				return addr
+			}
+		}
 	}
-	return r.RemoteAddr
+
+	return ip
 }
 
 func newSession(user *User) (*Session, error) {
@@ -181,10 +278,6 @@ func respond(w http.ResponseWriter, r *http.Request, vals interface{}) {
 	// done?
 }
 
-func uri(api, ep string) string {
-	return fmt.Sprintf("%s%s", api, ep)
-}
-
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// All /v1/* calls are routed to OpenAI /v1/*
 	// Everything else is routed internally
@@ -193,50 +286,174 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 1. get request
-	// 2. make request
-	// 3. return response
-	b, err := ioutil.ReadAll(r.Body)
+	// attempt to pull user session from context
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		sess = &Session{}
+	}
+
+	// a call isn't made in a group so every group of the user is checked
+	groups, err := userGroups(sess.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	buf := bytes.NewReader(b)
-
-	// TODO: check http path validity
-	req, err := http.NewRequest(r.Method, uri(p.opts.Url, r.URL.Path), buf)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	// check the user and their groups are within their quota
+	if err := checkQuota(sess.UserID, groups...); err != nil {
+		quotaError(w, err)
 		return
 	}
-	// TODO: Use/validate requested content-type
-	req.Header.Set("Content-Type", "application/json")
 
-	if len(p.opts.Key) > 0 {
-		req.Header.Set("Authorization", "Bearer "+p.opts.Key)
+	ctx := context.WithValue(r.Context(), Session{}, sess)
+
+	// binary and multipart uploads are passed on untouched
+	if isJSON(r.Header.Get("Content-Type")) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		// ask for the usage of streamed completions, the client doesn't get it unless they asked
+		b, ok = withStreamUsage(b)
+		if ok {
+			ctx = context.WithValue(ctx, streamUsage{}, true)
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		// replayed on fail over to the next upstream
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
 	}
-	// make request
-	rsp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+
+	// stream the upstream response back as it arrives
+	p.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// rewrite the request for the upstream, the url and key are set by the pool
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	// don't pass on our own credentials
+	pr.Out.Header.Del("Authorization")
+	pr.Out.Header.Del("Cookie")
+
+	// let the transport handle compression so the body can be read for usage
+	pr.Out.Header.Del("Accept-Encoding")
+
+	// json unless told otherwise
+	if len(pr.Out.Header.Get("Content-Type")) == 0 {
+		pr.Out.Header.Set("Content-Type", "application/json")
 	}
-	defer rsp.Body.Close()
 
-	b, err = ioutil.ReadAll(rsp.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+}
+
+// modify the upstream response before it's streamed back
+func (p *Proxy) modify(rsp *http.Response) error {
+	// upstream cookies are not for our users
+	rsp.Header.Del("Set-Cookie")
+
+	// only json responses carry usage, binary responses are streamed untouched
+	if !isJSON(rsp.Header.Get("Content-Type")) && !strings.HasPrefix(rsp.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
 	}
 
-	// return response to user
-	w.Header().Set("Content-Type", "application/json")
-	// write the response data
-	w.Write(b)
-	// set status code from proxy
-	w.WriteHeader(rsp.StatusCode)
-	// done?
+	sess := rsp.Request.Context().Value(Session{}).(*Session)
+	path := rsp.Request.URL.Path
+
+	// usage is charged to the first group the user joined
+	var groupID string
+	if groups, err := userGroups(sess.UserID); err == nil && len(groups) > 0 {
+		groupID = groups[0]
+	}
+
+	// record the tokens used once the body is done
+	rsp.Body = &proxyBody{ReadCloser: rsp.Body, done: func(b []byte) {
+		model, usage := proxyUsage(b)
+		if usage == nil {
+			return
+		}
+
+		go func() {
+			err := recordUsage(&Usage{
+				UserID:   sess.UserID,
+				GroupID:  groupID,
+				Endpoint: path,
+				LLM:      model,
+				Usage:    *usage,
+			})
+			if err != nil {
+				log.Printf("Error saving usage for %v: %v\n", path, err)
+			}
+		}()
+	}}
+
+	// drop the usage we asked for from the stream
+	if added, _ := rsp.Request.Context().Value(streamUsage{}).(bool); added {
+		rsp.Body = &usageFilter{ReadCloser: rsp.Body, r: bufio.NewReader(rsp.Body)}
+	}
+
+	return nil
+}
+
+// streamUsage marks a request where the usage of the stream was added by the proxy
+type streamUsage struct{}
+
+// usageFilter removes the usage only chunk from an event stream
+type usageFilter struct {
+	io.ReadCloser
+	r    *bufio.Reader
+	buf  bytes.Buffer
+	skip bool
+}
+
+func (f *usageFilter) Read(p []byte) (int, error) {
+	for f.buf.Len() == 0 {
+		line, err := f.r.ReadBytes('\n')
+
+		switch {
+		case isUsageChunk(line):
+			// and the blank line ending the event
+			f.skip = true
+		case f.skip && len(bytes.TrimSpace(line)) == 0 && len(line) > 0:
+			f.skip = false
+		default:
+			f.skip = false
+			f.buf.Write(line)
+		}
+
+		if err != nil {
+			if f.buf.Len() > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+
+	return f.buf.Read(p)
+}
+
+// proxyBody keeps a copy of the upstream response body as it's read
+type proxyBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func([]byte)
+}
+
+func (b *proxyBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *proxyBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.done(b.buf.Bytes())
+	})
+	return err
 }
 
 func decode(r *http.Request, v interface{}) error {
@@ -254,14 +471,50 @@ func decode(r *http.Request, v interface{}) error {
 	return err
 }
 
+// formList returns the values of a form field which may be comma separated
+func formList(vals []string) []string {
+	var list []string
+	for _, v := range vals {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
 // func contentType(r *http.Request) string {
 // 	return r.Header.Get("Content-Type")
 // }
 
 func New(opts *Options) *Proxy {
-	return &Proxy{
+	pool := opts.Pool
+	if pool == nil {
+		var err error
+		pool, err = ai.NewPool(ai.Upstream{URL: opts.Url, Key: opts.Key})
+		if err != nil {
+			log.Printf("Invalid proxy url %v: %v\n", opts.Url, err)
+			pool, _ = ai.NewPool(ai.Upstream{})
+		}
+	}
+
+	p := &Proxy{
 		opts: opts,
 	}
+
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		ModifyResponse: p.modify,
+		Transport:      pool.Transport(http.DefaultTransport),
+		// flush every write so event streams aren't held back
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+
+	return p
 }
 
 func (p *Proxy) Register(routes map[string]http.HandlerFunc) {
@@ -0,0 +1,321 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyStream(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Event{}, &Usage{}, &Quota{}, &GroupMember{})
+
+	// usage is charged to the group of the user
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-1"})
+
+	next := make(chan bool)
+
+	// upstream sending a chunk at a time
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer upstream-key", r.Header.Get("Authorization"))
+		assert.Empty(t, r.Header.Get("Cookie"))
+
+		b, _ := ioutil.ReadAll(r.Body)
+
+		if r.URL.Path == "/v1/missing" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"message":"not found"}}`))
+			return
+		}
+
+		assert.Contains(t, string(b), `"include_usage":true`)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Request-Id", "req-1")
+		w.Header().Set("Set-Cookie", "upstream=1")
+		w.WriteHeader(http.StatusOK)
+
+		for _, word := range []string{"one", "two"} {
+			fmt.Fprintf(w, "data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", word)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+
+		fmt.Fprint(w, "data: {\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	prx := New(&Options{Key: "upstream-key", Url: upstream.URL})
+
+	srv := httptest.NewServer(WithLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), Session{}, &Session{UserID: "user-1"})
+		prx.ServeHTTP(w, r.WithContext(ctx))
+	})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", srv.URL+"/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true}`))
+	req.Header.Set("Authorization", "Bearer turbo-session")
+	req.Header.Set("Cookie", "sess=turbo-session")
+
+	rsp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+	assert.Equal(t, "req-1", rsp.Header.Get("X-Request-Id"))
+	assert.Empty(t, rsp.Header.Get("Set-Cookie"))
+
+	// each chunk arrives before the upstream sends the next
+	reader := bufio.NewReader(rsp.Body)
+
+	for _, word := range []string{"one", "two"} {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Contains(t, line, word)
+		reader.ReadString('\n')
+		next <- true
+	}
+
+	// the usage the client didn't ask for is dropped
+	rest, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "data: [DONE]\n\n", string(rest))
+
+	// usage recorded from the last chunk
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Usage{}).Where("user_id = ? AND group_id = ? AND llm = ? AND total_tokens = ?", "user-1", "group-1", "gpt-4o", 5).Count(&count)
+		return count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the whole stream is logged
+	assert.Eventually(t, func() bool {
+		var ev Event
+		if err := db.Where("endpoint = ?", "/v1/chat/completions").First(&ev).Error; err != nil {
+			return false
+		}
+		return ev.Status == 200 && strings.Contains(ev.Response, "one") && strings.Contains(ev.Response, "[DONE]")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// upstream errors are passed on
+	rsp, err = http.Post(srv.URL+"/v1/missing", "application/json", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+
+	b, _ := ioutil.ReadAll(rsp.Body)
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	assert.Equal(t, `{"error":{"message":"not found"}}`, string(b))
+
+	assert.Eventually(t, func() bool {
+		var ev Event
+		if err := db.Where("endpoint = ?", "/v1/missing").First(&ev).Error; err != nil {
+			return false
+		}
+		return ev.Status == http.StatusNotFound
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the group has used its quota
+	assert.NoError(t, SetQuota(&Quota{GroupID: "group-1", Tokens: 5}))
+
+	rsp, err = http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o","stream":true}`))
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, rsp.StatusCode)
+	assert.NotEmpty(t, rsp.Header.Get("Retry-After"))
+
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Event{}).Where("status = ?", http.StatusTooManyRequests).Count(&count)
+		return count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestProxyBinary(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Event{}, &Usage{}, &Quota{}, &GroupMember{})
+
+	audio := []byte{0xff, 0xfb, 0x90, 0x00, 0x01, 0x02}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/audio/transcriptions":
+			f, hdr, err := r.FormFile("file")
+			if !assert.NoError(t, err) {
+				return
+			}
+			b, _ := ioutil.ReadAll(f)
+			assert.Equal(t, "speech.mp3", hdr.Filename)
+			assert.Equal(t, audio, b)
+			assert.Equal(t, "whisper-1", r.FormValue("model"))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"text":"hello"}`))
+		case "/v1/form":
+			// forms are passed on as they are
+			b, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+			assert.Equal(t, "model=tts-1", string(b))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		case "/v1/audio/speech":
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.Write(audio)
+		}
+	}))
+	defer upstream.Close()
+
+	prx := New(&Options{Url: upstream.URL})
+	srv := httptest.NewServer(WithLogger(prx))
+	defer srv.Close()
+
+	event := func(endpoint string) *Event {
+		var ev Event
+		assert.Eventually(t, func() bool {
+			return db.Where("endpoint = ?", endpoint).First(&ev).Error == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		return &ev
+	}
+
+	// multipart upload
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("model", "whisper-1")
+	fw, _ := mw.CreateFormFile("file", "speech.mp3")
+	fw.Write(audio)
+	mw.Close()
+
+	rsp, err := http.Post(srv.URL+"/v1/audio/transcriptions", mw.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, `{"text":"hello"}`, string(b))
+
+	ev := event("/v1/audio/transcriptions")
+	assert.Empty(t, ev.Request)
+	assert.Equal(t, mw.FormDataContentType(), ev.RequestType)
+	assert.Equal(t, int64(body.Len()), ev.RequestSize)
+	assert.Equal(t, `{"text":"hello"}`, ev.Response)
+
+	// binary response
+	rsp, err = http.Post(srv.URL+"/v1/audio/speech", "application/json", strings.NewReader(`{"model":"tts-1","input":"hello"}`))
+	assert.NoError(t, err)
+	b, _ = ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	assert.Equal(t, "audio/mpeg", rsp.Header.Get("Content-Type"))
+	assert.Equal(t, audio, b)
+
+	ev = event("/v1/audio/speech")
+	assert.Equal(t, `{"model":"tts-1","input":"hello"}`, ev.Request)
+	assert.Empty(t, ev.Response)
+	assert.Equal(t, "audio/mpeg", ev.ResponseType)
+	assert.Equal(t, int64(len(audio)), ev.ResponseSize)
+
+	// form body
+	rsp, err = http.Post(srv.URL+"/v1/form", "application/x-www-form-urlencoded", strings.NewReader("model=tts-1"))
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	event("/v1/form")
+}
+
+func TestIsText(t *testing.T) {
+	assert.True(t, isText(""))
+	assert.True(t, isText("application/json; charset=utf-8"))
+	assert.True(t, isText("text/event-stream"))
+	assert.True(t, isText("application/x-www-form-urlencoded"))
+	assert.False(t, isText("multipart/form-data; boundary=xyz"))
+	assert.False(t, isText("audio/mpeg"))
+	assert.False(t, isText("application/octet-stream"))
+}
+
+func TestProxyFailover(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Event{}, &Usage{}, &Quota{}, &GroupMember{})
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer sk-2", r.Header.Get("Authorization"))
+		assert.Equal(t, `{"model":"gpt-4o"}`, string(b))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"gpt-4o"}`))
+	}))
+	defer upstream.Close()
+
+	pool, err := ai.NewPool(
+		ai.Upstream{URL: limited.URL + "/v1", Key: "sk-1"},
+		ai.Upstream{URL: upstream.URL + "/v1", Key: "sk-2"},
+	)
+	assert.NoError(t, err)
+
+	srv := httptest.NewServer(New(&Options{Pool: pool}))
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"gpt-4o"}`))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, `{"model":"gpt-4o"}`, string(b))
+
+	status := pool.Status()
+	assert.False(t, status[0].Healthy)
+	assert.True(t, status[1].Healthy)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/log"
+	"github.com/asim/turbo/ratelimit"
+)
+
+var (
+	// RateLimited are the paths which are rate limited, a prefix ends in *
+	RateLimited = []string{"/v1/*", "/chat/*"}
+
+	// UserRateLimit is the requests allowed per user, zero is no limit
+	UserRateLimit ratelimit.Limit
+	// GroupRateLimit is the requests allowed per group shared by its members
+	GroupRateLimit ratelimit.Limit
+	// IPRateLimit is the requests allowed per client ip
+	IPRateLimit ratelimit.Limit
+	// RouteRateLimits are the requests allowed per user on a route e.g /chat/prompt or /v1/*
+	RouteRateLimits = map[string]ratelimit.Limit{}
+
+	// RateLimitPrefix of the keys of the buckets
+	RateLimitPrefix = "ratelimit:"
+
+	// how long the groups of a user are cached
+	groupsTTL = time.Minute
+)
+
+// matchPath returns whether the path matches the pattern, a prefix ends in *
+func matchPath(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == path
+}
+
+// userGroups returns the ids of the groups the user is a member of in the order they joined
+func userGroups(userID string) ([]string, error) {
+	key := RateLimitPrefix + "groups:" + userID
+
+	var ids []string
+	if err := cache.Get(key, &ids); err == nil {
+		return ids, nil
+	}
+
+	var members []GroupMember
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	ids = []string{}
+	for _, m := range members {
+		ids = append(ids, m.GroupID)
+	}
+
+	cache.SetTTL(key, ids, groupsTTL)
+
+	return ids, nil
+}
+
+// rateLimitHeaders sets the RateLimit-* headers of the result
+func rateLimitHeaders(w http.ResponseWriter, rsp *ratelimit.Result) {
+	ceil := func(d time.Duration) string {
+		return strconv.Itoa(int(math.Ceil(d.Seconds())))
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(rsp.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(rsp.Remaining))
+	w.Header().Set("RateLimit-Reset", ceil(rsp.Reset))
+
+	if !rsp.Allowed {
+		w.Header().Set("Retry-After", ceil(rsp.RetryAfter))
+	}
+}
+
+// WithRateLimit will limit the requests per user, group, ip and route
+func WithRateLimit(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var limited bool
+		for _, path := range RateLimited {
+			if matchPath(path, r.URL.Path) {
+				limited = true
+				break
+			}
+		}
+
+		if !limited {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var buckets []ratelimit.Bucket
+
+		bucket := func(key string, limit ratelimit.Limit) {
+			buckets = append(buckets, ratelimit.Bucket{Key: RateLimitPrefix + key, Limit: limit})
+		}
+
+		// the ip is always limited, the caller is the user if there's a session
+		ip := getIP(r)
+		caller := "ip:" + ip
+		bucket("ip:"+ip, IPRateLimit)
+
+		if sess, ok := r.Context().Value(Session{}).(*Session); ok && len(sess.UserID) > 0 {
+			caller = "user:" + sess.UserID
+			bucket(caller, UserRateLimit)
+
+			if !GroupRateLimit.IsZero() {
+				groups, err := userGroups(sess.UserID)
+				if err != nil {
+					log.Printf("Error getting groups of %v: %v\n", sess.UserID, err)
+				}
+				for _, id := range groups {
+					bucket("group:"+id, GroupRateLimit)
+				}
+			}
+		}
+
+		for pattern, limit := range RouteRateLimits {
+			if matchPath(pattern, r.URL.Path) {
+				bucket("route:"+pattern+":"+caller, limit)
+			}
+		}
+
+		// a token is only taken if every bucket has one
+		rsps, err := ratelimit.TakeAll(buckets...)
+		if err != nil {
+			// don't block requests if the limiter is down
+			log.Printf("Error rate limiting %v: %v\n", caller, err)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// the headers are of the bucket with the fewest requests left
+		var least *ratelimit.Result
+
+		for _, rsp := range rsps {
+			// no limit
+			if rsp.Limit == 0 {
+				continue
+			}
+
+			if !rsp.Allowed {
+				rateLimitHeaders(w, rsp)
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+
+			if least == nil || rsp.Remaining < least.Remaining {
+				least = rsp
+			}
+		}
+
+		if least != nil {
+			rateLimitHeaders(w, least)
+		}
+
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	defer func() {
+		TrustedProxies = nil
+		UserRateLimit = ratelimit.Limit{}
+		GroupRateLimit = ratelimit.Limit{}
+		IPRateLimit = ratelimit.Limit{}
+		RouteRateLimits = map[string]ratelimit.Limit{}
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// Initialize the limiter
+	ratelimit.Init("")
+
+	// migration
+	db.Migrate(&Group{}, &GroupMember{})
+
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-1"})
+	db.Create(&GroupMember{GroupID: "group-1", UserID: "user-2"})
+
+	hdr := WithRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+
+	call := func(path, userID, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, nil)
+		r.RemoteAddr = ip + ":1234"
+		if len(userID) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: userID}))
+		}
+		w := httptest.NewRecorder()
+		hdr.ServeHTTP(w, r)
+		return w
+	}
+
+	// no limits set
+	w := call("/chat/prompt", "user-1", "10.0.0.1")
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+
+	// per user
+	UserRateLimit = ratelimit.Limit{Rate: 2, Per: time.Hour}
+
+	w = call("/chat/prompt", "user-1", "10.0.0.1")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1800", w.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, 200, call("/v1/chat/completions", "user-1", "10.0.0.1").Code)
+
+	w = call("/chat/prompt", "user-1", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+
+	// other paths aren't limited
+	assert.Equal(t, 200, call("/user/read", "user-1", "10.0.0.1").Code)
+
+	// per group shared by the members
+	GroupRateLimit = ratelimit.Limit{Rate: 3, Per: time.Hour}
+
+	assert.Equal(t, 200, call("/chat/prompt", "user-2", "10.0.0.2").Code)
+	assert.Equal(t, 200, call("/chat/prompt", "user-2", "10.0.0.2").Code)
+	assert.Equal(t, 200, call("/chat/prompt", "user-3", "10.0.0.3").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("/chat/prompt", "user-2", "10.0.0.2").Code)
+
+	// per ip without a session
+	IPRateLimit = ratelimit.Limit{Rate: 1, Per: time.Hour}
+
+	assert.Equal(t, 200, call("/v1/models", "", "10.0.0.4").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("/v1/models", "", "10.0.0.4").Code)
+	assert.Equal(t, 200, call("/v1/models", "", "10.0.0.5").Code)
+
+	// forwarded headers are only trusted from the proxies
+	forwarded := func(remote, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/models", nil)
+		r.RemoteAddr = remote + ":1234"
+		r.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		hdr.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, 200, forwarded("10.0.0.7", "1.1.1.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, forwarded("10.0.0.7", "2.2.2.2").Code)
+
+	TrustedProxies = []string{"10.1.0.0/16"}
+
+	assert.Equal(t, 200, forwarded("10.1.0.1", "3.3.3.3, 10.1.0.2").Code)
+	assert.Equal(t, 200, forwarded("10.1.0.1", "4.4.4.4").Code)
+	assert.Equal(t, http.StatusTooManyRequests, forwarded("10.1.0.3", "9.9.9.9, 3.3.3.3").Code)
+
+	// nothing is taken when one of the limits is hit
+	IPRateLimit = ratelimit.Limit{}
+	UserRateLimit = ratelimit.Limit{Rate: 2, Per: time.Hour}
+	RouteRateLimits["/chat/prompt"] = ratelimit.Limit{Rate: 1, Per: time.Hour}
+
+	assert.Equal(t, 200, call("/chat/prompt", "user-6", "10.0.0.8").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("/chat/prompt", "user-6", "10.0.0.8").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("/chat/prompt", "user-6", "10.0.0.8").Code)
+
+	w = call("/chat/read", "user-6", "10.0.0.8")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	delete(RouteRateLimits, "/chat/prompt")
+
+	// per user on a route
+	UserRateLimit = ratelimit.Limit{}
+	GroupRateLimit = ratelimit.Limit{}
+	IPRateLimit = ratelimit.Limit{}
+	RouteRateLimits["/chat/cancel"] = ratelimit.Limit{Rate: 1, Per: time.Hour}
+
+	assert.Equal(t, 200, call("/chat/cancel", "user-4", "10.0.0.6").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("/chat/cancel", "user-4", "10.0.0.6").Code)
+	assert.Equal(t, 200, call("/chat/cancel", "user-5", "10.0.0.6").Code)
+	assert.Equal(t, 200, call("/chat/read", "user-4", "10.0.0.6").Code)
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// RedactMask replaces the redacted data
+	RedactMask = "[REDACTED]"
+
+	// RedactEmails masks email addresses
+	RedactEmails = RedactRegex(regexp.MustCompile(`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`))
+
+	// RedactPhones masks phone numbers e.g +44 20 7946 0958 or (555) 123-4567
+	RedactPhones = RedactRegex(regexp.MustCompile(`\+\d{1,3}[\s.\-]?\d[\d\s.\-]{6,14}\d|\(?\b\d{3}\)?[\s.\-]\d{3}[\s.\-]\d{4}\b`))
+
+	// RedactKeys masks api keys and bearer tokens e.g sk-... or Bearer ...
+	RedactKeys = RedactRegex(regexp.MustCompile(`\b(?:sk|pk|rk)-[a-zA-Z0-9_\-]{16,}|\b(?:Bearer|Basic)\s+[a-zA-Z0-9._~+/=\-]{8,}`))
+
+	// Redactors are applied to the request and response of every event
+	Redactors = []Redactor{RedactEmails, RedactPhones, RedactKeys}
+
+	// RouteRedactors are also applied in order to the events of a route, a prefix ends in *
+	RouteRedactors = []RouteRedactor{}
+
+	// MetadataOnly routes keep no request or response in the events e.g /v1/*
+	MetadataOnly = []string{}
+)
+
+// Redactor removes sensitive data from the request or response of an event
+type Redactor interface {
+	Redact(string) string
+}
+
+// RouteRedactor applies the redactors to the events of the route e.g /chat/*
+type RouteRedactor struct {
+	Route     string
+	Redactors []Redactor
+}
+
+// RedactFunc is a custom func used as a redactor
+type RedactFunc func(string) string
+
+func (fn RedactFunc) Redact(s string) string {
+	return fn(s)
+}
+
+// RedactRegex masks the matches of the regex
+func RedactRegex(re *regexp.Regexp) Redactor {
+	return RedactFunc(func(s string) string {
+		return re.ReplaceAllString(s, RedactMask)
+	})
+}
+
+// RedactFields masks the values of json fields by path e.g password or messages.*.content
+// where * is any key or index. Event streams are masked per data line and forms by key.
+func RedactFields(paths ...string) Redactor {
+	var fields [][]string
+	for _, p := range paths {
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+		if len(p) > 0 {
+			fields = append(fields, strings.Split(p, "."))
+		}
+	}
+
+	return RedactFunc(func(s string) string {
+		if len(fields) == 0 || len(s) == 0 {
+			return s
+		}
+
+		if v, ok := maskJSON(s, fields); ok {
+			return v
+		}
+
+		// server sent events
+		if strings.Contains(s, "data:") {
+			lines := strings.Split(s, "\n")
+			for i, line := range lines {
+				if !strings.HasPrefix(line, "data:") {
+					continue
+				}
+				if v, ok := maskJSON(strings.TrimSpace(line[5:]), fields); ok {
+					lines[i] = "data: " + v
+				}
+			}
+			return strings.Join(lines, "\n")
+		}
+
+		// url encoded forms
+		if vals, ok := parseForm(s); ok {
+			for _, f := range fields {
+				if len(f) == 1 && len(vals[f[0]]) > 0 {
+					vals.Set(f[0], RedactMask)
+				}
+			}
+			return vals.Encode()
+		}
+
+		return s
+	})
+}
+
+// maskJSON masks the fields of a json object or array
+func maskJSON(s string, fields [][]string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return s, false
+	}
+
+	for _, f := range fields {
+		v = maskPath(v, f)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return s, false
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+// maskPath replaces the values at the path
+func maskPath(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return RedactMask
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if path[0] == "*" || path[0] == k {
+				val[k] = maskPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range val {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				val[i] = maskPath(child, path[1:])
+			}
+		}
+	}
+
+	return v
+}
+
+// redact the request and response of the event before it's stored or published
+func redact(ev *Event) {
+	for _, path := range MetadataOnly {
+		if matchPath(path, ev.Endpoint) {
+			ev.Request = ""
+			ev.Response = ""
+			break
+		}
+	}
+
+	redactors := append([]Redactor{}, Redactors...)
+	for _, rr := range RouteRedactors {
+		if matchPath(rr.Route, ev.Endpoint) {
+			redactors = append(redactors, rr.Redactors...)
+		}
+	}
+
+	ev.Request = redactText(ev.Request, redactors)
+	ev.Response = redactText(ev.Response, redactors)
+	ev.Params = redactText(ev.Params, redactors)
+}
+
+// redactText applies the redactors to the text and the values of a url encoded form
+func redactText(s string, redactors []Redactor) string {
+	if len(s) == 0 {
+		return s
+	}
+
+	if vals, ok := parseForm(s); ok {
+		var changed bool
+		for _, vs := range vals {
+			for i, v := range vs {
+				for _, r := range redactors {
+					vs[i] = r.Redact(vs[i])
+				}
+				changed = changed || vs[i] != v
+			}
+		}
+		if changed {
+			s = vals.Encode()
+		}
+	}
+
+	for _, r := range redactors {
+		s = r.Redact(s)
+	}
+
+	return s
+}
+
+// parseForm parses the text if it's a url encoded form
+func parseForm(s string) (url.Values, bool) {
+	if !strings.Contains(s, "=") || strings.ContainsAny(s, " \n{[") {
+		return nil, false
+	}
+	vals, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, false
+	}
+	return vals, true
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/event"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactors(t *testing.T) {
+	text := "mail bob@example.com or call +44 20 7946 0958 or (555) 123-4567 with sk-abcdefghijklmnopqrstu"
+	for _, r := range Redactors {
+		text = r.Redact(text)
+	}
+	assert.Equal(t, "mail [REDACTED] or call [REDACTED] or [REDACTED] with [REDACTED]", text)
+
+	// numbers which aren't phones are kept
+	assert.Equal(t, `{"created":1717171717,"total_tokens":15}`, RedactPhones.Redact(`{"created":1717171717,"total_tokens":15}`))
+	assert.Equal(t, "Authorization: [REDACTED]", RedactKeys.Redact("Authorization: Bearer abcdefghijkl"))
+
+	fields := RedactFields("password", "$.messages.*.content")
+
+	// json
+	assert.Equal(t,
+		`{"messages":[{"content":"[REDACTED]","role":"user"}],"model":"gpt-4o","password":"[REDACTED]"}`,
+		fields.Redact(`{"model":"gpt-4o","password":"secret","messages":[{"role":"user","content":"hi"}]}`),
+	)
+
+	// event streams
+	assert.Equal(t,
+		"data: {\"messages\":[{\"content\":\"[REDACTED]\"}]}\n\ndata: [DONE]\n\n",
+		fields.Redact("data: {\"messages\":[{\"content\":\"hi\"}]}\n\ndata: [DONE]\n\n"),
+	)
+
+	// forms
+	assert.Equal(t, "password=%5BREDACTED%5D&username=bob", fields.Redact("username=bob&password=secret"))
+
+	// not json
+	assert.Equal(t, "hello", fields.Redact("hello"))
+
+	// custom func
+	upper := RedactFunc(strings.ToUpper)
+	assert.Equal(t, "HELLO", upper.Redact("hello"))
+}
+
+func TestRedactEvent(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	defer func(rs []Redactor) {
+		Redactors = rs
+		RouteRedactors = []RouteRedactor{}
+		MetadataOnly = []string{}
+	}(Redactors)
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Event{})
+
+	// applied in order, masked before it's upper cased
+	RouteRedactors = []RouteRedactor{
+		{Route: "/chat/*", Redactors: []Redactor{RedactFields("name")}},
+		{Route: "/chat/prompt", Redactors: []Redactor{RedactFunc(strings.ToUpper)}},
+	}
+	MetadataOnly = []string{"/v1/*"}
+
+	var logged bytes.Buffer
+	logrus.SetOutput(&logged)
+	defer logrus.SetOutput(os.Stderr)
+
+	sub, err := event.Subscribe("events")
+	assert.NoError(t, err)
+	defer event.Unsubscribe(sub)
+
+	hdr := WithLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"reply":"mail me at bob@example.com","name":"bob"}`))
+	}))
+
+	call := func(path, body string) {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		hdr.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	next := func() Event {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var ev Event
+		assert.NoError(t, sub.Next(ctx, &ev))
+		return ev
+	}
+
+	// form values are redacted as well as the route fields
+	call("/chat/prompt?email=bob%40example.com", "id=1&prompt=call+%2B44+20+7946+0958")
+
+	ev := next()
+	assert.Equal(t, "ID=1&PROMPT=CALL+%5BREDACTED%5D", ev.Request)
+	assert.Equal(t, `{"NAME":"[REDACTED]","REPLY":"MAIL ME AT [REDACTED]"}`, ev.Response)
+	assert.Equal(t, "EMAIL=%5BREDACTED%5D", ev.Params)
+
+	// the logged params are redacted
+	assert.NotContains(t, logged.String(), "bob")
+	assert.Contains(t, logged.String(), "EMAIL=%5BREDACTED%5D")
+
+	// only the metadata
+	call("/v1/chat/completions", `{"model":"gpt-4o"}`)
+
+	ev = next()
+	assert.Empty(t, ev.Request)
+	assert.Empty(t, ev.Response)
+	assert.Equal(t, 200, ev.Status)
+	assert.Equal(t, int64(18), ev.RequestSize)
+
+	// stored redacted
+	assert.Eventually(t, func() bool {
+		var count int64
+		db.Model(&Event{}).Count(&count)
+		return count == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var stored Event
+	assert.NoError(t, db.Where("endpoint = ?", "/chat/prompt").First(&stored).Error)
+	assert.NotContains(t, stored.Response, "bob@example.com")
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/log"
+)
+
+const (
+	// StrategyWindow sends the most recent turns of a chat, the default
+	StrategyWindow = "window"
+	// StrategySummary sends a running summary of older turns with the recent ones
+	StrategySummary = "summary"
+)
+
+var (
+	// SummaryThreshold is the number of unsummarised turns which triggers a new summary
+	SummaryThreshold = 10
+
+	// SummaryKeep is the number of recent turns left out of the summary
+	SummaryKeep = 5
+
+	// SummaryPrompt is the system prompt used to summarise a conversation
+	SummaryPrompt = "You summarise conversations between a user and an assistant. " +
+		"Update the summary with the new turns keeping facts, decisions, names and open questions. " +
+		"Be concise and reply with the summary only."
+
+	// chats being summarised
+	summarising sync.Map
+)
+
+// Summary is a running summary of the older turns of a chat
+type Summary struct {
+	ChatID  string `json:"chat_id" gorm:"primaryKey"`
+	Summary string `json:"summary"`
+	// created time of the last message summarised
+	Until time.Time `json:"until"`
+	// number of turns summarised
+	Turns     int       `json:"turns"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func summaryKey(chatID string) string {
+	return "summary:" + chatID
+}
+
+// validStrategy checks the context strategy of a chat
+func validStrategy(s string) bool {
+	return len(s) == 0 || s == StrategyWindow || s == StrategySummary
+}
+
+// getSummary returns the summary of a chat from the cache or database
+func getSummary(chatID string) (*Summary, error) {
+	var s Summary
+
+	if err := cache.Get(summaryKey(chatID), &s); err == nil && s.ChatID == chatID {
+		return &s, nil
+	}
+
+	err := db.Where("chat_id = ?", chatID).First(&s).Error
+	if errors.Is(err, db.ErrNotFound) {
+		// nothing summarised yet
+		return &Summary{ChatID: chatID}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cache.Set(summaryKey(chatID), s)
+
+	return &s, nil
+}
+
+// summaryContext builds the context from the turns after the summary
+func summaryContext(chatID string, since time.Time, limit int) ([]ai.Context, error) {
+	var messages []Message
+
+	res := db.Where("chat_id = ? AND otr = ? AND created_at > ?", chatID, false, since).
+		Order("created_at desc").Limit(limit).Find(&messages)
+	if err := res.Error; err != nil {
+		return nil, err
+	}
+
+	context := []ai.Context{}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		context = append(context, ai.Context{
+			Prompt: messages[i].Prompt,
+			Reply:  messages[i].Reply,
+			Images: contextImages(messages[i].Images),
+		})
+	}
+
+	return context, nil
+}
+
+// refreshSummary folds older turns of a chat into its summary once
+// enough have built up. It's called in the background after each reply.
+func refreshSummary(chat Chat) {
+	// one at a time per chat
+	if _, busy := summarising.LoadOrStore(chat.ID, true); busy {
+		return
+	}
+	defer summarising.Delete(chat.ID)
+
+	s, err := getSummary(chat.ID)
+	if err != nil {
+		log.Printf("Error getting summary for chat %v: %v\n", chat.ID, err)
+		return
+	}
+
+	var messages []Message
+
+	res := db.Where("chat_id = ? AND otr = ? AND created_at > ?", chat.ID, false, s.Until).
+		Order("created_at asc").Find(&messages)
+	if err := res.Error; err != nil {
+		log.Printf("Error getting messages for chat %v: %v\n", chat.ID, err)
+		return
+	}
+
+	if len(messages) <= SummaryThreshold {
+		return
+	}
+
+	// keep the recent turns as they are
+	turns := messages[:len(messages)-SummaryKeep]
+
+	model, err := ai.GetModel(chat.LLM)
+	if err != nil {
+		model, err = ai.GetModel(ai.DefaultModel)
+	}
+	if err != nil {
+		log.Printf("Error getting model for summary of chat %v: %v\n", chat.ID, err)
+		return
+	}
+
+	// in batches which fit the context window of the model
+	for len(turns) > 0 {
+		batch := turns[:summaryBatch(model.String(), s.Summary, turns)]
+		turns = turns[len(batch):]
+
+		summary, err := summarise(context.Background(), model, s.Summary, batch)
+		if err != nil {
+			log.Printf("Error summarising chat %v: %v\n", chat.ID, err)
+			return
+		}
+
+		s.Summary = summary
+		s.Until = batch[len(batch)-1].CreatedAt
+		s.Turns += len(batch)
+
+		if err := db.Update(s).Error; err != nil {
+			log.Printf("Error saving summary for chat %v: %v\n", chat.ID, err)
+			return
+		}
+
+		cache.Set(summaryKey(chat.ID), s)
+	}
+}
+
+// summaryBatch returns how many of the turns fit in the context window of the model
+// along with the summary so far, at least one is returned to make progress
+func summaryBatch(model, summary string, turns []Message) int {
+	limit := ai.GetLimit(model)
+
+	// the tokens left after the output, the prompts and the message framing
+	budget := limit.Context - limit.Output - ai.Tokens(model, SummaryPrompt+summaryPrompt(summary, nil)) - 16
+
+	n := 0
+	for _, m := range turns {
+		if budget -= ai.Tokens(model, summaryTurn(m)); budget < 0 {
+			break
+		}
+		n++
+	}
+
+	if n == 0 && len(turns) > 0 {
+		n = 1
+	}
+
+	return n
+}
+
+// summaryTurn is a turn as written in the summary prompt
+func summaryTurn(m Message) string {
+	return fmt.Sprintf("User: %s\nAssistant: %s\n", m.Prompt, m.Reply)
+}
+
+// summaryPrompt asks for the summary to be updated with the turns
+func summaryPrompt(summary string, turns []Message) string {
+	var sb strings.Builder
+
+	if len(summary) > 0 {
+		fmt.Fprintf(&sb, "Summary so far:\n%s\n\n", summary)
+	}
+
+	sb.WriteString("New turns:\n")
+
+	for _, m := range turns {
+		sb.WriteString(summaryTurn(m))
+	}
+
+	sb.WriteString("\nWrite the updated summary.")
+
+	return sb.String()
+}
+
+// summarise asks the model to update the summary with the turns
+func summarise(ctx context.Context, model ai.Model, summary string, turns []Message) (string, error) {
+	rsp, err := model.Complete(ctx, &ai.Request{
+		Prompt: summaryPrompt(summary, turns),
+		System: SummaryPrompt,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(rsp.Reply), nil
+}
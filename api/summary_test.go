@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestRefreshSummary(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	var prompts []string
+
+	// summarise by counting the turns
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		prompt := req.Messages[len(req.Messages)-1].Content
+		prompts = append(prompts, prompt)
+		reply := fmt.Sprintf("%d turns", strings.Count(prompt, "User:"))
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": map[string]string{"role": "assistant", "content": reply},
+			"done":    true,
+		})
+	}))
+	defer srv.Close()
+
+	ai.Register(ai.NewOllama(ai.Config{URL: srv.URL}))
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Message{}, &Summary{})
+
+	chat := Chat{
+		ID:       uuid.New().String(),
+		LLM:      "ollama/llama3",
+		Strategy: StrategySummary,
+	}
+
+	now := time.Now()
+
+	for i := 0; i < SummaryThreshold; i++ {
+		db.Create(&Message{
+			Model:  gorm.Model{CreatedAt: now.Add(time.Duration(i) * time.Second)},
+			ID:     uuid.New().String(),
+			ChatID: chat.ID,
+			Prompt: fmt.Sprintf("prompt %d", i),
+			Reply:  fmt.Sprintf("reply %d", i),
+		})
+	}
+
+	// not enough turns yet
+	refreshSummary(chat)
+
+	s, err := getSummary(chat.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, s.Summary)
+
+	db.Create(&Message{
+		Model:  gorm.Model{CreatedAt: now.Add(time.Minute)},
+		ID:     uuid.New().String(),
+		ChatID: chat.ID,
+		Prompt: "prompt 10",
+		Reply:  "reply 10",
+	})
+
+	refreshSummary(chat)
+
+	s, err = getSummary(chat.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "6 turns", s.Summary)
+	assert.Equal(t, 6, s.Turns)
+
+	// stored in the database
+	var stored Summary
+	assert.NoError(t, db.Where("chat_id = ?", chat.ID).First(&stored).Error)
+	assert.Equal(t, s.Summary, stored.Summary)
+
+	// the recent turns follow the summary
+	context, err := summaryContext(chat.ID, s.Until, DefaultContext)
+	assert.NoError(t, err)
+	assert.Len(t, context, SummaryKeep)
+	assert.Equal(t, "prompt 6", context[0].Prompt)
+	assert.Equal(t, "prompt 10", context[len(context)-1].Prompt)
+
+	// a long chat is summarised in batches which fit the context window
+	ai.Limits["summary-test"] = ai.Limit{Context: 200, Output: 20, Encoding: ai.DefaultEncoding}
+	defer delete(ai.Limits, "summary-test")
+
+	long := Chat{
+		ID:       uuid.New().String(),
+		LLM:      "ollama/summary-test",
+		Strategy: StrategySummary,
+	}
+
+	for i := 0; i < 30; i++ {
+		db.Create(&Message{
+			Model:  gorm.Model{CreatedAt: now.Add(time.Duration(i) * time.Second)},
+			ID:     uuid.New().String(),
+			ChatID: long.ID,
+			Prompt: fmt.Sprintf("prompt %d is a longer question about the weather", i),
+			Reply:  fmt.Sprintf("reply %d is a longer answer about the weather", i),
+		})
+	}
+
+	prompts = nil
+	refreshSummary(long)
+
+	s, err = getSummary(long.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 30-SummaryKeep, s.Turns)
+	assert.Greater(t, len(prompts), 1)
+
+	var turns int
+	for _, p := range prompts {
+		assert.LessOrEqual(t, ai.Tokens("summary-test", SummaryPrompt+p), 200-20)
+		turns += strings.Count(p, "User:")
+	}
+	assert.Equal(t, 30-SummaryKeep, turns)
+
+	// the last batch summarised is where the recent turns start
+	context, err = summaryContext(long.ID, s.Until, DefaultContext)
+	assert.NoError(t, err)
+	assert.Len(t, context, SummaryKeep)
+}
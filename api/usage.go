@@ -0,0 +1,659 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/db"
+	"github.com/asim/turbo/log"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a user or group has used their monthly quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Usage is the tokens used by a chat message or proxied call
+type Usage struct {
+	gorm.Model
+	ID        string `json:"id"`
+	UserID    string `json:"user_id" gorm:"index:idx_usage_user,priority:1"`
+	GroupID   string `json:"group_id" gorm:"index:idx_usage_group,priority:1"`
+	ChatID    string `json:"chat_id,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// the endpoint called e.g /chat/prompt or /v1/chat/completions
+	Endpoint string `json:"endpoint"`
+	LLM      string `json:"model"`
+	ai.Usage `gorm:"embedded"`
+	// estimated cost in USD
+	Cost float64 `json:"cost"`
+	// when it was used, indexed for monthly totals
+	UsedAt time.Time `json:"used_at" gorm:"index:idx_usage_user,priority:2;index:idx_usage_group,priority:2"`
+}
+
+// Quota is the monthly limit of a user or group, zero values are unlimited
+type Quota struct {
+	// user:id or group:id
+	ID      string  `json:"id" gorm:"primaryKey"`
+	UserID  string  `json:"user_id,omitempty"`
+	GroupID string  `json:"group_id,omitempty"`
+	Tokens  int64   `json:"tokens"`
+	Cost    float64 `json:"cost"`
+	// when the quota was set
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UsageTotal is the usage summed by model, user, group or day
+type UsageTotal struct {
+	Name             string  `json:"name"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+type UsageReadRequest struct {
+	GroupID string `json:"group_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	By      string `json:"by"`
+}
+
+type UsageReadResponse struct {
+	From   time.Time    `json:"from"`
+	To     time.Time    `json:"to"`
+	Total  UsageTotal   `json:"total"`
+	Totals []UsageTotal `json:"totals"`
+	Quota  *Quota       `json:"quota,omitempty"`
+}
+
+type AdminUsageRequest struct {
+	UserID  string `json:"user_id"`
+	GroupID string `json:"group_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	By      string `json:"by"`
+}
+
+type AdminUsageResponse struct {
+	From   time.Time    `json:"from"`
+	To     time.Time    `json:"to"`
+	Total  UsageTotal   `json:"total"`
+	Totals []UsageTotal `json:"totals"`
+}
+
+type AdminQuotaSetRequest struct {
+	UserID  string  `json:"user_id"`
+	GroupID string  `json:"group_id"`
+	Tokens  int64   `json:"tokens"`
+	Cost    float64 `json:"cost"`
+}
+
+type AdminQuotaSetResponse struct {
+	Quota Quota `json:"quota"`
+}
+
+type AdminQuotaReadRequest struct {
+	UserID  string `json:"user_id"`
+	GroupID string `json:"group_id"`
+}
+
+type AdminQuotaReadResponse struct {
+	Quota Quota      `json:"quota"`
+	Used  UsageTotal `json:"used"`
+}
+
+type AdminQuotaDeleteRequest struct {
+	UserID  string `json:"user_id"`
+	GroupID string `json:"group_id"`
+}
+
+type AdminQuotaDeleteResponse struct{}
+
+// usage grouping columns
+var usageBy = map[string]string{
+	"model": "llm",
+	"user":  "user_id",
+	"group": "group_id",
+	"day":   "date(used_at)",
+}
+
+// monthStart returns the start of the current quota period
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func quotaID(userID, groupID string) string {
+	if len(groupID) > 0 {
+		return "group:" + groupID
+	}
+	return "user:" + userID
+}
+
+// recordUsage saves the usage of a model with its estimated cost
+func recordUsage(u *Usage) error {
+	if u.ID == "" {
+		u.ID = uuid.New().String()
+	}
+	if u.UsedAt.IsZero() {
+		u.UsedAt = time.Now()
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	u.Cost = ai.Cost(u.LLM, u.Usage)
+
+	return db.Create(u).Error
+}
+
+// GetQuota returns the quota of a user or group
+func GetQuota(userID, groupID string) (*Quota, error) {
+	var q Quota
+	if err := db.Where("id = ?", quotaID(userID, groupID)).First(&q).Error; err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// SetQuota creates or updates the quota of a user or group
+func SetQuota(q *Quota) error {
+	if len(q.UserID) == 0 && len(q.GroupID) == 0 {
+		return errors.New("user_id or group_id required")
+	}
+	if len(q.UserID) > 0 && len(q.GroupID) > 0 {
+		return errors.New("only one of user_id or group_id")
+	}
+	if q.Tokens < 0 || q.Cost < 0 {
+		return errors.New("quota must be positive")
+	}
+
+	q.ID = quotaID(q.UserID, q.GroupID)
+
+	return db.Update(q).Error
+}
+
+// usageTotals sums the usage matching the query between from and to
+func usageTotals(query string, args []interface{}, from, to time.Time, by string) (UsageTotal, []UsageTotal, error) {
+	sums := "count(*) as requests, coalesce(sum(prompt_tokens), 0) as prompt_tokens, " +
+		"coalesce(sum(completion_tokens), 0) as completion_tokens, " +
+		"coalesce(sum(total_tokens), 0) as total_tokens, coalesce(sum(cost), 0) as cost"
+
+	where := func() *gorm.DB {
+		q := db.Model(&Usage{}).Where("used_at >= ? AND used_at < ?", from, to)
+		if len(query) > 0 {
+			q = q.Where(query, args...)
+		}
+		return q
+	}
+
+	var total UsageTotal
+	if err := where().Select(sums).Scan(&total).Error; err != nil {
+		return total, nil, err
+	}
+	total.Name = "total"
+
+	if len(by) == 0 {
+		return total, nil, nil
+	}
+
+	col, ok := usageBy[by]
+	if !ok {
+		return total, nil, fmt.Errorf("invalid by %s", by)
+	}
+
+	var totals []UsageTotal
+	err := where().Select(col + " as name, " + sums).Group(col).Order("total_tokens desc").Scan(&totals).Error
+
+	return total, totals, err
+}
+
+// usedQuota returns the usage of a user or group in the current period
+func usedQuota(userID, groupID string) (UsageTotal, error) {
+	now := time.Now()
+
+	query, args := "user_id = ?", []interface{}{userID}
+	if len(groupID) > 0 {
+		query, args = "group_id = ?", []interface{}{groupID}
+	}
+
+	total, _, err := usageTotals(query, args, monthStart(now), now.Add(time.Second), "")
+	return total, err
+}
+
+// checkQuota returns ErrQuotaExceeded if the user or any of the groups is over their monthly quota
+func checkQuota(userID string, groupIDs ...string) error {
+	subjects := [][2]string{{userID, ""}}
+	for _, id := range groupIDs {
+		if len(id) > 0 {
+			subjects = append(subjects, [2]string{"", id})
+		}
+	}
+
+	for _, s := range subjects {
+		q, err := GetQuota(s[0], s[1])
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if q.Tokens == 0 && q.Cost == 0 {
+			continue
+		}
+
+		used, err := usedQuota(s[0], s[1])
+		if err != nil {
+			return err
+		}
+
+		if q.Tokens > 0 && used.TotalTokens >= q.Tokens {
+			return fmt.Errorf("%w: monthly limit of %d tokens reached", ErrQuotaExceeded, q.Tokens)
+		}
+		if q.Cost > 0 && used.Cost >= q.Cost {
+			return fmt.Errorf("%w: monthly limit of $%.2f reached", ErrQuotaExceeded, q.Cost)
+		}
+	}
+
+	return nil
+}
+
+// quotaError writes a 429 for an exceeded quota or a 500 otherwise
+func quotaError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrQuotaExceeded) {
+		// try again next month
+		next := monthStart(time.Now()).AddDate(0, 1, 0)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next).Seconds())))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// parsePeriod parses from and to as dates or RFC3339 defaulting to the current month
+func parsePeriod(from, to string) (time.Time, time.Time, error) {
+	parse := func(v string) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02", v)
+	}
+
+	start := monthStart(time.Now())
+	end := time.Now().Add(time.Second)
+
+	if len(from) > 0 {
+		t, err := parse(from)
+		if err != nil {
+			return start, end, errors.New("invalid from")
+		}
+		start = t
+	}
+
+	if len(to) > 0 {
+		t, err := parse(to)
+		if err != nil {
+			return start, end, errors.New("invalid to")
+		}
+		end = t
+	}
+
+	return start, end, nil
+}
+
+// proxyUsage parses the model and usage from a json or event stream response
+func proxyUsage(b []byte) (string, *ai.Usage) {
+	var rsp struct {
+		Model string    `json:"model"`
+		Usage *ai.Usage `json:"usage"`
+	}
+
+	if err := json.Unmarshal(b, &rsp); err == nil {
+		return rsp.Model, rsp.Usage
+	}
+
+	// the usage is in the last chunk of a stream
+	var model string
+	var usage *ai.Usage
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		rsp.Model, rsp.Usage = "", nil
+
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &rsp); err != nil {
+			continue
+		}
+		if len(rsp.Model) > 0 {
+			model = rsp.Model
+		}
+		if rsp.Usage != nil {
+			usage = rsp.Usage
+		}
+	}
+
+	return model, usage
+}
+
+// withStreamUsage asks for usage in the last chunk of a streamed completion
+// unless the client set include_usage, it returns whether the usage was added
+func withStreamUsage(b []byte) ([]byte, bool) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(b, &req); err != nil {
+		return b, false
+	}
+
+	if string(req["stream"]) != "true" {
+		return b, false
+	}
+
+	opts := map[string]json.RawMessage{}
+	if v, ok := req["stream_options"]; ok {
+		if err := json.Unmarshal(v, &opts); err != nil {
+			return b, false
+		}
+	}
+	if _, ok := opts["include_usage"]; ok {
+		return b, false
+	}
+
+	opts["include_usage"] = json.RawMessage(`true`)
+
+	ob, err := json.Marshal(opts)
+	if err != nil {
+		return b, false
+	}
+	req["stream_options"] = ob
+
+	nb, err := json.Marshal(req)
+	if err != nil {
+		return b, false
+	}
+	return nb, true
+}
+
+// isUsageChunk returns whether the line is the usage only chunk at the end of a stream
+func isUsageChunk(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return false
+	}
+
+	var rsp struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   *ai.Usage         `json:"usage"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(line[5:]), &rsp); err != nil {
+		return false
+	}
+	return len(rsp.Choices) == 0 && rsp.Usage != nil
+}
+
+// UsageRead returns the usage of the user or a group they're a member of
+func UsageRead(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := UsageReadRequest{
+		GroupID: r.Form.Get("group_id"),
+		From:    r.Form.Get("from"),
+		To:      r.Form.Get("to"),
+		By:      r.Form.Get("by"),
+	}
+
+	// Check user session
+	sess, ok := r.Context().Value(Session{}).(*Session)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.By) == 0 {
+		req.By = "model"
+	}
+
+	// only the usage of group members is shown by user
+	if req.By == "group" || (req.By == "user" && len(req.GroupID) == 0) {
+		http.Error(w, "invalid by "+req.By, http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parsePeriod(req.From, req.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, args := "user_id = ?", []interface{}{sess.UserID}
+
+	if len(req.GroupID) > 0 {
+		if !IsInGroup(req.GroupID, sess.UserID) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		query, args = "group_id = ?", []interface{}{req.GroupID}
+	}
+
+	total, totals, err := usageTotals(query, args, from, to, req.By)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rsp := UsageReadResponse{
+		From:   from,
+		To:     to,
+		Total:  total,
+		Totals: totals,
+	}
+
+	if q, err := GetQuota(sess.UserID, req.GroupID); err == nil {
+		rsp.Quota = q
+	}
+
+	respond(w, r, rsp)
+}
+
+// AdminUsage returns the usage of all users or a user or group
+func AdminUsage(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := AdminUsageRequest{
+		UserID:  r.Form.Get("user_id"),
+		GroupID: r.Form.Get("group_id"),
+		From:    r.Form.Get("from"),
+		To:      r.Form.Get("to"),
+		By:      r.Form.Get("by"),
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.By) == 0 {
+		req.By = "user"
+	}
+
+	from, to, err := parsePeriod(req.From, req.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var query []string
+	var args []interface{}
+
+	if len(req.UserID) > 0 {
+		query = append(query, "user_id = ?")
+		args = append(args, req.UserID)
+	}
+	if len(req.GroupID) > 0 {
+		query = append(query, "group_id = ?")
+		args = append(args, req.GroupID)
+	}
+
+	total, totals, err := usageTotals(strings.Join(query, " AND "), args, from, to, req.By)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	respond(w, r, AdminUsageResponse{
+		From:   from,
+		To:     to,
+		Total:  total,
+		Totals: totals,
+	})
+}
+
+// AdminQuotaSet sets the monthly token or cost limit of a user or group
+func AdminQuotaSet(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := AdminQuotaSetRequest{
+		UserID:  r.Form.Get("user_id"),
+		GroupID: r.Form.Get("group_id"),
+	}
+
+	if v := r.Form.Get("tokens"); len(v) > 0 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid tokens", http.StatusBadRequest)
+			return
+		}
+		req.Tokens = n
+	}
+
+	if v := r.Form.Get("cost"); len(v) > 0 {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "invalid cost", http.StatusBadRequest)
+			return
+		}
+		req.Cost = f
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := Quota{
+		UserID:  req.UserID,
+		GroupID: req.GroupID,
+		Tokens:  req.Tokens,
+		Cost:    req.Cost,
+	}
+
+	// keep the created time
+	if old, err := GetQuota(req.UserID, req.GroupID); err == nil {
+		q.CreatedAt = old.CreatedAt
+	}
+
+	if err := SetQuota(&q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	respond(w, r, AdminQuotaSetResponse{Quota: q})
+}
+
+// AdminQuotaRead returns the quota of a user or group and their usage this month
+func AdminQuotaRead(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := AdminQuotaReadRequest{
+		UserID:  r.Form.Get("user_id"),
+		GroupID: r.Form.Get("group_id"),
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := GetQuota(req.UserID, req.GroupID)
+	if err != nil {
+		http.Error(w, "quota not found", http.StatusNotFound)
+		return
+	}
+
+	used, err := usedQuota(req.UserID, req.GroupID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, AdminQuotaReadResponse{Quota: *q, Used: used})
+}
+
+// AdminQuotaDelete removes the quota of a user or group
+func AdminQuotaDelete(w http.ResponseWriter, r *http.Request) {
+	// Parse form and fill request with form values
+	r.ParseForm()
+	req := AdminQuotaDeleteRequest{
+		UserID:  r.Form.Get("user_id"),
+		GroupID: r.Form.Get("group_id"),
+	}
+
+	// Decode and validate the request
+	if err := decode(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Where("id = ?", quotaID(req.UserID, req.GroupID)).Delete(&Quota{}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respond(w, r, AdminQuotaDeleteResponse{})
+}
+
+// saveUsage records the usage of a chat message in the background
+func saveUsage(m *Message, endpoint string) {
+	if m.Usage.TotalTokens == 0 && m.Usage.PromptTokens == 0 {
+		return
+	}
+
+	u := &Usage{
+		UserID:    m.UserID,
+		GroupID:   m.GroupID,
+		ChatID:    m.ChatID,
+		MessageID: m.ID,
+		Endpoint:  endpoint,
+		LLM:       m.LLM,
+		Usage:     m.Usage,
+	}
+
+	if err := recordUsage(u); err != nil {
+		log.Printf("Error saving usage for message %v: %v\n", m.ID, err)
+	}
+}
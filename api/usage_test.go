@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/turbo/ai"
+	"github.com/asim/turbo/cache"
+	"github.com/asim/turbo/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	defer func() {
+		cleanup()
+	}()
+
+	// Initialize the cache
+	cache.Init("")
+
+	// Initialize the database
+	db.Init("")
+
+	// migration
+	db.Migrate(&Chat{}, &ChatUser{}, &Message{}, &Usage{}, &Quota{})
+
+	// no quota set
+	assert.NoError(t, checkQuota("user-1", "group-1"))
+
+	assert.NoError(t, recordUsage(&Usage{
+		UserID:   "user-1",
+		GroupID:  "group-1",
+		Endpoint: "/chat/prompt",
+		LLM:      "gpt-4",
+		Usage:    ai.Usage{PromptTokens: 1000, CompletionTokens: 500},
+	}))
+
+	// last month isn't counted
+	assert.NoError(t, recordUsage(&Usage{
+		UserID: "user-1",
+		LLM:    "gpt-4",
+		Usage:  ai.Usage{PromptTokens: 100000},
+		UsedAt: monthStart(time.Now()).Add(-time.Hour),
+	}))
+
+	used, err := usedQuota("user-1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), used.Requests)
+	assert.Equal(t, int64(1500), used.TotalTokens)
+	assert.InDelta(t, 0.06, used.Cost, 0.0001)
+
+	// under the limit
+	assert.NoError(t, SetQuota(&Quota{UserID: "user-1", Tokens: 2000}))
+	assert.NoError(t, checkQuota("user-1", ""))
+
+	// group over its cost limit
+	assert.NoError(t, SetQuota(&Quota{GroupID: "group-1", Cost: 0.05}))
+	err = checkQuota("user-1", "group-1")
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// user over the token limit
+	assert.NoError(t, SetQuota(&Quota{UserID: "user-1", Tokens: 1500}))
+	err = checkQuota("user-1", "")
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	assert.Error(t, SetQuota(&Quota{UserID: "user-1", GroupID: "group-1"}))
+
+	// totals by model
+	total, totals, err := usageTotals("", nil, monthStart(time.Now()).AddDate(0, -1, 0), time.Now().Add(time.Second), "model")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101500), total.TotalTokens)
+	assert.Equal(t, []UsageTotal{{
+		Name:             "gpt-4",
+		Requests:         2,
+		PromptTokens:     101000,
+		CompletionTokens: 500,
+		TotalTokens:      101500,
+		Cost:             total.Cost,
+	}}, totals)
+
+	// prompts fail once the quota is used
+	chat := Chat{
+		ID:     uuid.New().String(),
+		Name:   "test",
+		LLM:    "mock",
+		UserID: "user-1",
+	}
+	db.Create(&chat)
+
+	form := url.Values{"id": {chat.ID}, "prompt": {"hello"}}
+	r := httptest.NewRequest("POST", "/chat/prompt", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = r.WithContext(context.WithValue(r.Context(), Session{}, &Session{UserID: "user-1"}))
+
+	w := httptest.NewRecorder()
+	ChatPrompt(w, r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func TestProxyUsage(t *testing.T) {
+	model, usage := proxyUsage([]byte(`{"model":"gpt-4o","usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	assert.Equal(t, "gpt-4o", model)
+	assert.Equal(t, &ai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}, usage)
+
+	stream := "data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n" +
+		"data: {\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":1,\"total_tokens\":4}}\n\n" +
+		"data: [DONE]\n\n"
+
+	model, usage = proxyUsage([]byte(stream))
+	assert.Equal(t, "gpt-4o", model)
+	assert.Equal(t, &ai.Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}, usage)
+
+	_, usage = proxyUsage([]byte(`{"data":[]}`))
+	assert.Nil(t, usage)
+
+	// usage is requested for streams only
+	b, ok := withStreamUsage([]byte(`{"model":"gpt-4o"}`))
+	assert.False(t, ok)
+	assert.Equal(t, `{"model":"gpt-4o"}`, string(b))
+
+	b, ok = withStreamUsage([]byte(`{"stream":true}`))
+	assert.True(t, ok)
+	assert.Contains(t, string(b), `"stream_options":{"include_usage":true}`)
+
+	b, ok = withStreamUsage([]byte(`{"stream":true,"stream_options":{}}`))
+	assert.True(t, ok)
+	assert.Contains(t, string(b), `"stream_options":{"include_usage":true}`)
+
+	// the client's choice is kept
+	b, ok = withStreamUsage([]byte(`{"stream":true,"stream_options":{"include_usage":false}}`))
+	assert.False(t, ok)
+	assert.Equal(t, `{"stream":true,"stream_options":{"include_usage":false}}`, string(b))
+
+	// only the usage chunk is dropped
+	assert.True(t, isUsageChunk([]byte("data: {\"choices\":[],\"usage\":{\"total_tokens\":4}}\n")))
+	assert.False(t, isUsageChunk([]byte("data: {\"choices\":[{\"delta\":{}}],\"usage\":{\"total_tokens\":4}}\n")))
+	assert.False(t, isUsageChunk([]byte("data: [DONE]\n")))
+}
@@ -5,46 +5,74 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Value struct {
 	Key   string
 	Value []byte
+	// Expires is zero if the value doesn't expire
+	Expires time.Time
+}
+
+// expired returns whether the value has expired by the time
+func (v Value) expired(t time.Time) bool {
+	return !v.Expires.IsZero() && t.After(v.Expires)
 }
 
 type memoryCache struct {
 	sync.RWMutex
 	Values map[string]Value
+	// last time the expired values were removed
+	swept time.Time
 }
 
 var (
 	Cache cache = newMemoryCache()
+
+	// SweepInterval is how often expired values are removed from the memory cache
+	SweepInterval = time.Minute
 )
 
 type cache interface {
 	Get(key string, val interface{}) error
 	Set(key string, val interface{}) error
+	SetTTL(key string, val interface{}, ttl time.Duration) error
 	Delete(key string) error
 }
 
 func newMemoryCache() *memoryCache {
 	return &memoryCache{
 		Values: make(map[string]Value),
+		swept:  time.Now(),
 	}
 }
 
 func (c *memoryCache) Get(key string, val interface{}) error {
 	c.RLock()
-	defer c.RUnlock()
-
 	v, ok := c.Values[key]
+	c.RUnlock()
+
 	if !ok {
 		return errors.New("not found")
 	}
+	if v.expired(time.Now()) {
+		c.Lock()
+		// it may have been set again since
+		if v, ok := c.Values[key]; ok && v.expired(time.Now()) {
+			delete(c.Values, key)
+		}
+		c.Unlock()
+		return errors.New("not found")
+	}
 	return json.Unmarshal(v.Value, val)
 }
 
 func (c *memoryCache) Set(key string, val interface{}) error {
+	return c.SetTTL(key, val, 0)
+}
+
+func (c *memoryCache) SetTTL(key string, val interface{}, ttl time.Duration) error {
 	c.Lock()
 	defer c.Unlock()
 
@@ -53,11 +81,29 @@ func (c *memoryCache) Set(key string, val interface{}) error {
 		return err
 	}
 
-	c.Values[key] = Value{
+	v := Value{
 		Key:   key,
 		Value: b,
 	}
 
+	t := time.Now()
+
+	if ttl > 0 {
+		v.Expires = t.Add(ttl)
+	}
+
+	// drop the values which expired without being read
+	if t.Sub(c.swept) > SweepInterval {
+		for k, v := range c.Values {
+			if v.expired(t) {
+				delete(c.Values, k)
+			}
+		}
+		c.swept = t
+	}
+
+	c.Values[key] = v
+
 	return nil
 }
 
@@ -76,6 +122,11 @@ func Set(key string, val interface{}) error {
 	return Cache.Set(key, val)
 }
 
+// SetTTL sets a value which expires after the ttl
+func SetTTL(key string, val interface{}, ttl time.Duration) error {
+	return Cache.SetTTL(key, val, ttl)
+}
+
 func Delete(key string) error {
 	return Cache.Delete(key)
 }
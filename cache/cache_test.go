@@ -2,6 +2,7 @@ package cache
 
 import (
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
@@ -130,3 +131,56 @@ func TestMemoryCache_SetGet(t *testing.T) {
 		t.Errorf("Expected %v, but got %v", val, result)
 	}
 }
+
+func TestMemoryCache_SetTTL(t *testing.T) {
+	c := &memoryCache{Values: make(map[string]Value)}
+
+	if err := c.SetTTL("ttl", "value", 50*time.Millisecond); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	var result string
+	if err := c.Get("ttl", &result); err != nil || result != "value" {
+		t.Errorf("Expected value, but got %v %v", result, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := c.Get("ttl", &result); err == nil {
+		t.Errorf("Expected error, but got none")
+	}
+}
+
+func TestMemoryCache_Expired(t *testing.T) {
+	defer func(d time.Duration) {
+		SweepInterval = d
+	}(SweepInterval)
+
+	c := newMemoryCache()
+
+	c.SetTTL("read", "value", time.Millisecond)
+	c.SetTTL("unread", "value", time.Millisecond)
+	c.Set("kept", "value")
+
+	time.Sleep(10 * time.Millisecond)
+
+	// deleted when read
+	var result string
+	if err := c.Get("read", &result); err == nil {
+		t.Errorf("Expected error, but got none")
+	}
+	if _, ok := c.Values["read"]; ok {
+		t.Errorf("Expected expired value to be deleted")
+	}
+
+	// swept on the next set
+	SweepInterval = 0
+	c.Set("other", "value")
+
+	if _, ok := c.Values["unread"]; ok {
+		t.Errorf("Expected expired value to be swept")
+	}
+	if len(c.Values) != 2 {
+		t.Errorf("Expected 2 values, but got %v", len(c.Values))
+	}
+}
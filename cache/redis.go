@@ -36,7 +36,15 @@ func (c *redisCache) Get(key string, val interface{}) error {
 }
 
 func (c *redisCache) Set(key string, val interface{}) error {
-	return c.client.Set(context.TODO(), key, val, time.Duration(0)).Err()
+	return c.SetTTL(key, val, time.Duration(0))
+}
+
+func (c *redisCache) SetTTL(key string, val interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(context.TODO(), key, b, ttl).Err()
 }
 
 func (c *redisCache) Delete(key string) error {
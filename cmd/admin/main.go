@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/asim/turbo/api"
 	"github.com/asim/turbo/db"
@@ -140,6 +141,18 @@ func CreateUser(username, password string) error {
 	return nil
 }
 
+func SetQuota(userID, tokens string) error {
+	n, err := strconv.ParseInt(tokens, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid tokens %s", tokens)
+	}
+
+	return api.SetQuota(&api.Quota{
+		UserID: userID,
+		Tokens: n,
+	})
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
@@ -151,7 +164,7 @@ func main() {
 		return
 	}
 
-	usage := "admin {create|list|reset|user|messages|chatUsers|deleteMessage}"
+	usage := "admin {create|list|reset|user|messages|chatUsers|deleteMessage|quota}"
 
 	// return
 	if len(args) == 0 {
@@ -239,6 +252,20 @@ func main() {
 			fmt.Println(err)
 			return
 		}
+	case "quota":
+		// strip command
+		args = args[1:]
+
+		// check arg length
+		if len(args) != 2 {
+			fmt.Println("Missing user id and tokens")
+			return
+		}
+
+		if err := SetQuota(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			return
+		}
 	default:
 		fmt.Println(usage)
 		return
@@ -38,6 +38,12 @@ func Init(addr string) error {
 
 func Migrate(vals ...interface{}) error {
 	for _, v := range vals {
+		// vectors require pgvector
+		if _, ok := v.(*Vector); ok {
+			if err := migrateVectors(); err != nil {
+				return err
+			}
+		}
 		// TODO: return error
 		if err := DB.AutoMigrate(v); err != nil {
 			return err
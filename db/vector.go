@@ -0,0 +1,233 @@
+package db
+
+import (
+	"container/heap"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Embedding is a vector stored as pgvector on postgres or text on sqlite
+type Embedding []float32
+
+// Vector is an embedding of an app record stored in a collection e.g messages
+type Vector struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	Collection string    `json:"collection" gorm:"primaryKey"`
+	Embedding  Embedding `json:"embedding"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Match is the result of a vector search
+type Match struct {
+	// ID of the record
+	ID string `json:"id"`
+	// Cosine similarity from -1 to 1
+	Score float64 `json:"score"`
+}
+
+// GormDBDataType sets the column type per database
+func (Embedding) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "postgres" {
+		return "vector"
+	}
+	return "text"
+}
+
+// Value encodes the embedding in the pgvector text format [1,2,3]
+func (e Embedding) Value() (driver.Value, error) {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i, f := range e {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatFloat(float64(f), 'g', -1, 32))
+	}
+	sb.WriteByte(']')
+	return sb.String(), nil
+}
+
+// Scan decodes the embedding from the pgvector text format
+func (e *Embedding) Scan(v interface{}) error {
+	var s string
+
+	switch t := v.(type) {
+	case string:
+		s = t
+	case []byte:
+		s = string(t)
+	case nil:
+		*e = nil
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into embedding", v)
+	}
+
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	if len(s) == 0 {
+		*e = Embedding{}
+		return nil
+	}
+
+	parts := strings.Split(s, ",")
+	vec := make(Embedding, len(parts))
+
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 32)
+		if err != nil {
+			return err
+		}
+		vec[i] = float32(f)
+	}
+
+	*e = vec
+	return nil
+}
+
+// migrateVectors enables pgvector before creating the vectors table
+func migrateVectors() error {
+	if DB.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return DB.Exec("CREATE EXTENSION IF NOT EXISTS vector").Error
+}
+
+// PutVector stores the embedding for a record in a collection replacing any existing one
+func PutVector(collection, id string, embedding []float32) error {
+	if len(collection) == 0 || len(id) == 0 {
+		return errors.New("collection and id required")
+	}
+
+	return DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}, {Name: "collection"}},
+		DoUpdates: clause.AssignmentColumns([]string{"embedding", "updated_at"}),
+	}).Create(&Vector{
+		ID:         id,
+		Collection: collection,
+		Embedding:  embedding,
+	}).Error
+}
+
+// DeleteVector removes the embedding for a record
+func DeleteVector(collection, id string) error {
+	return DB.Where("collection = ? AND id = ?", collection, id).Delete(&Vector{}).Error
+}
+
+// SearchVectors returns the k records in the collection most similar to the embedding
+func SearchVectors(collection string, embedding []float32, k int) ([]Match, error) {
+	if k <= 0 || len(embedding) == 0 {
+		return nil, nil
+	}
+
+	if DB.Dialector.Name() == "postgres" {
+		return searchPostgres(collection, embedding, k)
+	}
+
+	return searchBruteForce(collection, embedding, k)
+}
+
+// searchPostgres uses the pgvector cosine distance operator, like
+// the brute force search vectors of other dimensions are skipped
+func searchPostgres(collection string, embedding []float32, k int) ([]Match, error) {
+	vec, _ := Embedding(embedding).Value()
+
+	var matches []Match
+
+	err := DB.Raw(
+		"SELECT id, 1 - (embedding <=> ?::vector) AS score FROM vectors WHERE collection = ? AND vector_dims(embedding) = ? ORDER BY embedding <=> ?::vector LIMIT ?",
+		vec, collection, len(embedding), vec, k,
+	).Scan(&matches).Error
+
+	return matches, err
+}
+
+// searchBruteForce scans the collection keeping the top k in a heap
+func searchBruteForce(collection string, embedding []float32, k int) ([]Match, error) {
+	rows, err := DB.Model(&Vector{}).Select("id", "embedding").Where("collection = ?", collection).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	top := &matchHeap{}
+
+	for rows.Next() {
+		var id string
+		var vec Embedding
+
+		if err := rows.Scan(&id, &vec); err != nil {
+			return nil, err
+		}
+
+		// different dimensions can't be compared
+		if len(vec) != len(embedding) {
+			continue
+		}
+
+		score := Cosine(embedding, vec)
+
+		if top.Len() < k {
+			heap.Push(top, Match{ID: id, Score: score})
+		} else if score > (*top)[0].Score {
+			(*top)[0] = Match{ID: id, Score: score}
+			heap.Fix(top, 0)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// highest score first
+	matches := make([]Match, top.Len())
+	for i := len(matches) - 1; i >= 0; i-- {
+		matches[i] = heap.Pop(top).(Match)
+	}
+
+	return matches, nil
+}
+
+// Cosine returns the cosine similarity of two vectors of the same length
+func Cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// matchHeap is a min heap of matches by score
+type matchHeap []Match
+
+func (h matchHeap) Len() int            { return len(h) }
+func (h matchHeap) Less(i, j int) bool  { return h[i].Score < h[j].Score }
+func (h matchHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *matchHeap) Push(x interface{}) { *h = append(*h, x.(Match)) }
+func (h *matchHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
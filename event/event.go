@@ -56,21 +56,20 @@ func newMemoryBroker() *memBroker {
 }
 
 func (m *memBroker) Publish(topic string, ev interface{}) error {
-	m.Lock()
+	m.RLock()
+	subs := append([]*Subscriber{}, m.subs[topic]...)
+	m.RUnlock()
 
-	subs, ok := m.subs[topic]
-	if !ok {
-		m.Unlock()
+	if len(subs) == 0 {
 		return nil
 	}
-	m.Unlock()
 
 	b, _ := json.Marshal(ev)
 
-	for i, sub := range subs {
+	for _, sub := range subs {
+		// queued in the order published, the channel only signals
 		sub.Lock()
 		sub.Queue = append(sub.Queue, b)
-		m.subs[topic][i] = sub
 		sub.Unlock()
 
 		go func(sub *Subscriber, msg []byte) {
@@ -113,6 +112,7 @@ func (s *Subscriber) Next(ctx context.Context, ev interface{}) error {
 		// pull from the queu
 		s.Lock()
 		if len(s.Queue) == 0 {
+			s.Unlock()
 			return nil
 		}
 		msg := s.Queue[0]
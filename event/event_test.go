@@ -108,3 +108,23 @@ func TestInit(t *testing.T) {
 
 	// TODO: Test the redis broker (not implemented)
 }
+
+func TestMemoryBroker_Order(t *testing.T) {
+	sub, err := Subscribe("test_order")
+	assert.NoError(t, err)
+	defer Unsubscribe(sub)
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, Publish("test_order", map[string]int{"seq": i}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// received in the order published
+	for i := 0; i < 50; i++ {
+		var ev map[string]int
+		assert.NoError(t, sub.Next(ctx, &ev))
+		assert.Equal(t, i, ev["seq"])
+	}
+}
@@ -0,0 +1,256 @@
+// Package ratelimit is token bucket rate limiting in memory or redis
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	Limiter limiter = newMemoryLimiter()
+
+	// now is the time used by the memory limiter
+	now = time.Now
+)
+
+type limiter interface {
+	// Take a token from every bucket if they all have one, otherwise from none
+	Take(buckets ...Bucket) ([]*Result, error)
+}
+
+// Bucket is the key of a bucket and its limit
+type Bucket struct {
+	Key   string
+	Limit Limit
+}
+
+// Limit allows Rate requests every Per, bursts are up to Rate
+type Limit struct {
+	Rate int
+	Per  time.Duration
+}
+
+// Result of taking a token from a bucket
+type Result struct {
+	// Whether the bucket has a token for the request
+	Allowed bool
+	// The limit of the bucket
+	Limit int
+	// Requests left
+	Remaining int
+	// Time until the bucket is full again
+	Reset time.Duration
+	// Time until the next request is allowed
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// when it's full again
+	full time.Time
+}
+
+type memoryLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{
+		buckets: make(map[string]*bucket),
+		swept:   now(),
+	}
+}
+
+// IsZero returns whether there's no limit
+func (l Limit) IsZero() bool {
+	return l.Rate <= 0 || l.Per <= 0
+}
+
+// String returns the limit as rate/unit e.g 60/m
+func (l Limit) String() string {
+	if l.IsZero() {
+		return ""
+	}
+	for _, u := range units {
+		if l.Per == u.per {
+			return strconv.Itoa(l.Rate) + "/" + u.name
+		}
+	}
+	return strconv.Itoa(l.Rate) + "/" + l.Per.String()
+}
+
+// tokens added per second
+func (l Limit) rate() float64 {
+	return float64(l.Rate) / l.Per.Seconds()
+}
+
+var units = []struct {
+	name string
+	per  time.Duration
+}{
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+}
+
+// Parse a limit as rate/unit e.g 60/m or 10/s, the unit may also be a duration e.g 100/10m
+func Parse(v string) (Limit, error) {
+	parts := strings.SplitN(strings.TrimSpace(v), "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, errors.New("limit must be rate/unit e.g 60/m")
+	}
+
+	rate, err := strconv.Atoi(parts[0])
+	if err != nil || rate <= 0 {
+		return Limit{}, errors.New("invalid rate " + parts[0])
+	}
+
+	for _, u := range units {
+		if parts[1] == u.name {
+			return Limit{Rate: rate, Per: u.per}, nil
+		}
+	}
+
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return Limit{}, errors.New("invalid unit " + parts[1])
+	}
+
+	return Limit{Rate: rate, Per: per}, nil
+}
+
+// result works out the remaining requests and timings from the tokens left in the bucket
+func result(l Limit, allowed bool, tokens float64) *Result {
+	rate := l.rate()
+
+	rsp := &Result{
+		Allowed:   allowed,
+		Limit:     l.Rate,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(l.Rate) - tokens) / rate),
+	}
+
+	if !allowed {
+		rsp.RetryAfter = seconds((1 - tokens) / rate)
+	}
+
+	return rsp
+}
+
+func seconds(s float64) time.Duration {
+	if s <= 0 {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+func (m *memoryLimiter) Take(buckets ...Bucket) ([]*Result, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	t := now()
+
+	// drop the buckets which are full again
+	if t.Sub(m.swept) > time.Minute {
+		for k, b := range m.buckets {
+			if t.After(b.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = t
+	}
+
+	list := make([]*bucket, len(buckets))
+	allowed := true
+
+	for i, bk := range buckets {
+		b, ok := m.buckets[bk.Key]
+		if !ok {
+			b = &bucket{tokens: float64(bk.Limit.Rate), last: t}
+			m.buckets[bk.Key] = b
+		}
+
+		// refill since the last request
+		b.tokens = math.Min(float64(bk.Limit.Rate), b.tokens+t.Sub(b.last).Seconds()*bk.Limit.rate())
+		b.last = t
+
+		allowed = allowed && b.tokens >= 1
+		list[i] = b
+	}
+
+	rsps := make([]*Result, len(buckets))
+
+	for i, b := range list {
+		ok := b.tokens >= 1
+		if allowed {
+			b.tokens--
+		}
+
+		rsps[i] = result(buckets[i].Limit, ok, b.tokens)
+		b.full = t.Add(rsps[i].Reset)
+	}
+
+	return rsps, nil
+}
+
+// Take a token from the bucket of the key, no limit is always allowed
+func Take(key string, l Limit) (*Result, error) {
+	rsps, err := TakeAll(Bucket{Key: key, Limit: l})
+	if err != nil {
+		return nil, err
+	}
+	return rsps[0], nil
+}
+
+// TakeAll takes a token from every bucket if they all have one, otherwise none are
+// taken and the buckets without a token aren't allowed. No limit is always allowed.
+func TakeAll(buckets ...Bucket) ([]*Result, error) {
+	rsps := make([]*Result, len(buckets))
+
+	var limited []Bucket
+	for i, b := range buckets {
+		if b.Limit.IsZero() {
+			rsps[i] = &Result{Allowed: true}
+			continue
+		}
+		limited = append(limited, b)
+	}
+
+	if len(limited) == 0 {
+		return rsps, nil
+	}
+
+	taken, err := Limiter.Take(limited...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rsps {
+		if rsps[i] == nil {
+			rsps[i], taken = taken[0], taken[1:]
+		}
+	}
+
+	return rsps, nil
+}
+
+func Init(addr string) error {
+	if strings.HasPrefix(addr, "redis") {
+		if l, err := newRedisLimiter(addr); err != nil {
+			return err
+		} else {
+			Limiter = l
+		}
+		return nil
+	}
+	Limiter = newMemoryLimiter()
+	return nil
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	l, err := Parse("60/m")
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 60, Per: time.Minute}, l)
+	assert.Equal(t, "60/m", l.String())
+
+	l, err = Parse("100/10m")
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 100, Per: 10 * time.Minute}, l)
+
+	for _, v := range []string{"", "60", "0/m", "x/m", "60/x"} {
+		_, err := Parse(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestTake(t *testing.T) {
+	Limiter = newMemoryLimiter()
+
+	start := time.Now()
+	now = func() time.Time { return start }
+	defer func() {
+		now = time.Now
+	}()
+
+	l := Limit{Rate: 2, Per: time.Second}
+
+	// no limit
+	rsp, err := Take("user-1", Limit{})
+	assert.NoError(t, err)
+	assert.True(t, rsp.Allowed)
+
+	// the burst is allowed
+	rsp, err = Take("user-1", l)
+	assert.NoError(t, err)
+	assert.True(t, rsp.Allowed)
+	assert.Equal(t, 2, rsp.Limit)
+	assert.Equal(t, 1, rsp.Remaining)
+
+	rsp, _ = Take("user-1", l)
+	assert.True(t, rsp.Allowed)
+	assert.Equal(t, 0, rsp.Remaining)
+	assert.Equal(t, time.Second, rsp.Reset)
+
+	// then limited
+	rsp, _ = Take("user-1", l)
+	assert.False(t, rsp.Allowed)
+	assert.Equal(t, 500*time.Millisecond, rsp.RetryAfter)
+
+	// other keys have their own bucket
+	rsp, _ = Take("user-2", l)
+	assert.True(t, rsp.Allowed)
+
+	// refilled over time
+	now = func() time.Time { return start.Add(500 * time.Millisecond) }
+
+	rsp, _ = Take("user-1", l)
+	assert.True(t, rsp.Allowed)
+	assert.Equal(t, 0, rsp.Remaining)
+
+	rsp, _ = Take("user-1", l)
+	assert.False(t, rsp.Allowed)
+
+	// full buckets are dropped
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+
+	Take("user-3", l)
+	assert.Len(t, Limiter.(*memoryLimiter).buckets, 1)
+}
+
+func TestTakeAll(t *testing.T) {
+	Limiter = newMemoryLimiter()
+
+	start := time.Now()
+	now = func() time.Time { return start }
+	defer func() {
+		now = time.Now
+	}()
+
+	user := Bucket{Key: "user-1", Limit: Limit{Rate: 1, Per: time.Second}}
+	group := Bucket{Key: "group-1", Limit: Limit{Rate: 3, Per: time.Second}}
+
+	rsps, err := TakeAll(user, group, Bucket{Key: "ip-1"})
+	assert.NoError(t, err)
+	assert.Len(t, rsps, 3)
+	assert.True(t, rsps[0].Allowed)
+	assert.Equal(t, 2, rsps[1].Remaining)
+	assert.True(t, rsps[2].Allowed)
+
+	// none are taken when one is out
+	rsps, _ = TakeAll(user, group)
+	assert.False(t, rsps[0].Allowed)
+	assert.True(t, rsps[1].Allowed)
+	assert.Equal(t, 2, rsps[1].Remaining)
+
+	rsp, _ := Take("group-1", group.Limit)
+	assert.Equal(t, 1, rsp.Remaining)
+}
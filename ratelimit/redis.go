@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// takeScript refills the buckets by the time passed and takes a token from each
+// if they all have one. The redis clock is used so the limits hold across replicas.
+var takeScript = redis.NewScript(`
+redis.replicate_commands()
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local tokens = {}
+local allowed = 1
+
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+
+	local b = redis.call('HMGET', key, 'tokens', 'ts')
+	local n = tonumber(b[1]) or burst
+	local ts = tonumber(b[2]) or now
+
+	tokens[i] = math.min(burst, n + math.max(0, now - ts) * rate)
+	if tokens[i] < 1 then
+		allowed = 0
+	end
+end
+
+local res = {}
+
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[i * 2 - 1])
+	local burst = tonumber(ARGV[i * 2])
+
+	local ok = 0
+	if tokens[i] >= 1 then
+		ok = 1
+	end
+	if allowed == 1 then
+		tokens[i] = tokens[i] - 1
+	end
+
+	redis.call('HSET', key, 'tokens', tostring(tokens[i]), 'ts', tostring(now))
+	redis.call('EXPIRE', key, math.ceil(burst / rate) + 1)
+
+	table.insert(res, ok)
+	table.insert(res, tostring(tokens[i]))
+end
+
+return res
+`)
+
+type redisLimiter struct {
+	client redis.UniversalClient
+}
+
+func newRedisLimiter(addr string) (*redisLimiter, error) {
+	if len(addr) == 0 {
+		addr = "redis://127.0.0.1:6379"
+	}
+	redisOptions, err := redis.ParseURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisLimiter{redis.NewClient(redisOptions)}, nil
+}
+
+func (r *redisLimiter) Take(buckets ...Bucket) ([]*Result, error) {
+	var keys []string
+	var args []interface{}
+
+	for _, b := range buckets {
+		keys = append(keys, b.Key)
+		args = append(args, b.Limit.rate(), b.Limit.Rate)
+	}
+
+	vals, err := takeScript.Run(context.TODO(), r.client, keys, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	var rsps []*Result
+
+	for i, b := range buckets {
+		if len(vals) < i*2+2 {
+			return nil, errors.New("missing rate limit result")
+		}
+
+		allowed, _ := vals[i*2].(int64)
+		str, _ := vals[i*2+1].(string)
+
+		tokens, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		rsps = append(rsps, result(b.Limit, allowed == 1, tokens))
+	}
+
+	return rsps, nil
+}
@@ -45,9 +45,12 @@ RESPONSE=`testApi /user/login "{\"username\": \"$USER\", \"password\": \"$PASS\"
 TOKEN=`jq '.Token' <<< $RESPONSE | cut -f 2 -d \"`
 
 # create a chat
-RESPONSE=`testApi /chat/create '{"name": "Example", "model": "gpt-3"}'`
+RESPONSE=`testApi /chat/create '{"name": "Example", "model": "mock"}'`
 CHATID=`jq '.id' <<< $RESPONSE | cut -f 2 -d \"`
 
+# prompt the mock model
+testApi /chat/prompt "{\"id\": \"$CHATID\", \"prompt\": \"hello\"}"
+
 # delete the chat
 testApi /chat/delete "{\"id\": \"$CHATID\"}"
 
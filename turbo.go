@@ -2,8 +2,12 @@
 package turbo
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/asim/turbo/ai"
 	"github.com/asim/turbo/api"
@@ -11,6 +15,7 @@ import (
 	"github.com/asim/turbo/db"
 	"github.com/asim/turbo/event"
 	"github.com/asim/turbo/log"
+	"github.com/asim/turbo/ratelimit"
 )
 
 var (
@@ -18,6 +23,40 @@ var (
 	Url = os.Getenv("OPENAI_API_URL")
 	// key for the OpenAI API
 	Key = os.Getenv("OPENAI_API_KEY")
+	// Pool of keys for the url e.g sk-1,sk-2|2 weighted by |n
+	Keys = os.Getenv("OPENAI_API_KEYS")
+	// Pool of upstreams e.g https://a.com/v1|sk-1|2,https://b.com/v1|sk-2
+	Upstreams = os.Getenv("OPENAI_API_UPSTREAMS")
+	// Ollama style local server e.g http://localhost:11434
+	OllamaUrl    = os.Getenv("OLLAMA_API_URL")
+	OllamaModels = os.Getenv("OLLAMA_MODELS")
+	// Anthropic style messages API
+	AnthropicUrl    = os.Getenv("ANTHROPIC_API_URL")
+	AnthropicKey    = os.Getenv("ANTHROPIC_API_KEY")
+	AnthropicModels = os.Getenv("ANTHROPIC_MODELS")
+	// Retries for failed upstream requests
+	Retries = os.Getenv("AI_RETRIES")
+	// Fallback models e.g gpt-4=gpt-3,ollama/llama3;gpt-3=ollama/llama3
+	Fallbacks = os.Getenv("AI_FALLBACKS")
+	// Cache deterministic completions for a duration e.g 1h
+	CacheTTL = os.Getenv("AI_CACHE_TTL")
+	// List the models of the providers on an interval e.g 10m
+	DiscoverInterval = os.Getenv("AI_DISCOVER_INTERVAL")
+	// Rate limits as rate/unit e.g 60/m
+	UserRateLimit  = os.Getenv("RATE_LIMIT_USER")
+	GroupRateLimit = os.Getenv("RATE_LIMIT_GROUP")
+	IPRateLimit    = os.Getenv("RATE_LIMIT_IP")
+	// Rate limits per route e.g /chat/prompt=10/m,/v1/*=100/m
+	RouteRateLimits = os.Getenv("RATE_LIMIT_ROUTES")
+	// Proxies whose forwarded headers give the client ip e.g 10.0.0.0/8,127.0.0.1
+	TrustedProxies = os.Getenv("TRUSTED_PROXIES")
+	// Routes which keep no request or response in the event log e.g /v1/*,/chat/prompt
+	RedactMetadataOnly = os.Getenv("REDACT_METADATA_ONLY")
+	// JSON fields masked in the event log e.g messages.*.content,password
+	RedactFields = os.Getenv("REDACT_FIELDS")
+	// Basic auth for the admin api
+	AdminUser = os.Getenv("ADMIN_USER")
+	AdminPass = os.Getenv("ADMIN_PASS")
 	// Address of the http server
 	Address = os.Getenv("ADDRESS")
 	// Infrastructure settings
@@ -58,6 +97,11 @@ func (a *App) Register(path string, ep Endpoint) {
 	}
 }
 
+// Register a tool the AI can call during chats
+func (a *App) RegisterTool(t *ai.Tool) error {
+	return ai.RegisterTool(t)
+}
+
 // Run the app on the given address e.g Run(":8080")
 func (a *App) Run() {
 	// Set address if not specified
@@ -88,15 +132,36 @@ func New() *App {
 	// create a new turbo app
 	app := new(App)
 
+	// setup the pool of upstreams
+	pool, err := newPool()
+	if err != nil {
+		log.Print("Invalid upstreams", err)
+		os.Exit(1)
+	}
+
 	// create a new proxy
 	prx := api.New(&api.Options{
-		Key: Key,
-		Url: Url,
+		Key:  Key,
+		Url:  Url,
+		Pool: pool,
 	})
 
 	// register api routes
 	prx.Register(api.Routes)
 
+	// register admin routes with basic auth
+	if len(AdminUser) > 0 && len(AdminPass) > 0 {
+		admin := api.WithAdmin(AdminUser, AdminPass)
+
+		for path, hdr := range api.AdminRoutes {
+			prx.Register(map[string]http.HandlerFunc{
+				path: admin(hdr).ServeHTTP,
+			})
+			// not a user session
+			api.Excludes = append(api.Excludes, path)
+		}
+	}
+
 	// set the proxy
 	app.Proxy = prx
 
@@ -110,6 +175,8 @@ func New() *App {
 		&api.Event{},
 		// chat messages
 		&api.Message{},
+		// alternative replies
+		&api.Alternative{},
 		// user accounts
 		&api.User{},
 		// user sessions
@@ -118,23 +185,172 @@ func New() *App {
 		&api.Group{},
 		// group members
 		&api.GroupMember{},
+		// chat personas
+		&api.Persona{},
+		// saved prompts
+		&api.Prompt{},
+		// chat summaries
+		&api.Summary{},
+		// knowledge bases
+		&api.KnowledgeBase{},
+		&api.Document{},
+		&api.Chunk{},
+		// uploaded files
+		&api.File{},
+		// embeddings
+		&db.Vector{},
+		// token usage
+		&api.Usage{},
+		// usage quotas
+		&api.Quota{},
+		// model aliases and rules
+		&api.ModelRule{},
 	)
 
 	// setup the cache
 	cache.Init(Redis)
 	// setup events
 	event.Init(Redis)
+	// setup rate limiting
+	ratelimit.Init(Redis)
 
 	// setup openai
-	if err := ai.Set(Key, Url); err != nil {
+	if pool != nil {
+		err = ai.SetPool(pool)
+	} else {
+		err = ai.Set(Key, Url)
+	}
+	if err != nil {
 		log.Print("Failed to setup AI", err)
 		os.Exit(1)
 	}
 
+	// setup additional providers
+	if len(OllamaUrl) > 0 {
+		err := ai.Register(ai.NewOllama(ai.Config{
+			URL:    OllamaUrl,
+			Models: split(OllamaModels),
+		}))
+		if err != nil {
+			log.Print("Failed to setup Ollama", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(AnthropicKey) > 0 {
+		err := ai.Register(ai.NewAnthropic(ai.Config{
+			Key:    AnthropicKey,
+			URL:    AnthropicUrl,
+			Models: split(AnthropicModels),
+		}))
+		if err != nil {
+			log.Print("Failed to setup Anthropic", err)
+			os.Exit(1)
+		}
+	}
+
+	// setup retries
+	if len(Retries) > 0 {
+		n, err := strconv.Atoi(Retries)
+		if err != nil {
+			log.Print("Invalid AI_RETRIES", err)
+			os.Exit(1)
+		}
+		ai.Retries = n
+	}
+
+	// setup the completion cache
+	if len(CacheTTL) > 0 {
+		ttl, err := time.ParseDuration(CacheTTL)
+		if err != nil {
+			log.Print("Invalid AI_CACHE_TTL", err)
+			os.Exit(1)
+		}
+		ai.CacheTTL = ttl
+	}
+
+	// discover the models of the providers
+	if len(DiscoverInterval) > 0 {
+		d, err := time.ParseDuration(DiscoverInterval)
+		if err != nil {
+			log.Print("Invalid AI_DISCOVER_INTERVAL", err)
+			os.Exit(1)
+		}
+		ai.DiscoverInterval = d
+	}
+
+	ai.StartDiscovery()
+
+	// apply the model rules set by the admin
+	if err := api.LoadModelRules(); err != nil {
+		log.Print("Failed to load model rules", err)
+	}
+
+	// reload them when changed on another node
+	if err := api.WatchModelRules(context.Background()); err != nil {
+		log.Print("Failed to watch model rules", err)
+	}
+
+	// setup fallback chains
+	for _, f := range strings.Split(Fallbacks, ";") {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ai.SetFallbacks(strings.TrimSpace(parts[0]), split(parts[1])...)
+	}
+
+	// setup rate limits
+	for _, rl := range []struct {
+		env   string
+		value string
+		limit *ratelimit.Limit
+	}{
+		{"RATE_LIMIT_USER", UserRateLimit, &api.UserRateLimit},
+		{"RATE_LIMIT_GROUP", GroupRateLimit, &api.GroupRateLimit},
+		{"RATE_LIMIT_IP", IPRateLimit, &api.IPRateLimit},
+	} {
+		if len(rl.value) == 0 {
+			continue
+		}
+		l, err := ratelimit.Parse(rl.value)
+		if err != nil {
+			log.Print("Invalid "+rl.env, err)
+			os.Exit(1)
+		}
+		*rl.limit = l
+	}
+
+	for _, r := range split(RouteRateLimits) {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			log.Print("Invalid RATE_LIMIT_ROUTES", r)
+			os.Exit(1)
+		}
+		l, err := ratelimit.Parse(parts[1])
+		if err != nil {
+			log.Print("Invalid RATE_LIMIT_ROUTES", err)
+			os.Exit(1)
+		}
+		api.RouteRateLimits[strings.TrimSpace(parts[0])] = l
+	}
+
+	// client ips are only taken from the forwarded headers of these
+	api.TrustedProxies = append(api.TrustedProxies, split(TrustedProxies)...)
+
+	// setup redaction of the event log
+	api.MetadataOnly = append(api.MetadataOnly, split(RedactMetadataOnly)...)
+
+	if fields := split(RedactFields); len(fields) > 0 {
+		api.Redactors = append(api.Redactors, api.RedactFields(fields...))
+	}
+
 	// add middleware
 
+	// with rate limits
+	hw := api.WithRateLimit(prx)
 	// with event logger
-	hw := api.WithLogger(prx)
+	hw = api.WithLogger(hw)
 	// with auth / admin
 	hw = api.WithAuth(hw)
 	// with cors
@@ -145,3 +361,40 @@ func New() *App {
 
 	return app
 }
+
+// newPool returns the pool of upstreams and keys if set
+func newPool() (*ai.Pool, error) {
+	var ups []ai.Upstream
+
+	// keys for the url
+	for _, k := range split(Keys) {
+		u, err := ai.ParseUpstreams(Url + "|" + k)
+		if err != nil {
+			return nil, err
+		}
+		ups = append(ups, u...)
+	}
+
+	u, err := ai.ParseUpstreams(Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	ups = append(ups, u...)
+
+	if len(ups) == 0 {
+		return nil, nil
+	}
+
+	return ai.NewPool(ups...)
+}
+
+// split a comma separated list
+func split(v string) []string {
+	var vals []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			vals = append(vals, s)
+		}
+	}
+	return vals
+}
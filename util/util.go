@@ -5,7 +5,6 @@ import (
 	"hash/fnv"
 	"math/rand"
 
-	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -30,12 +29,9 @@ func GetHash(pwd string) (string, error) {
 // generate a passworf of i length alphanum string
 func Password(i int) string {
 	bytes := make([]byte, i)
-	for {
-		rand.Read(bytes)
-		for i, b := range bytes {
-			bytes[i] = alphanum[b%byte(len(alphanum))]
-		}
-		return string(bytes)
+	rand.Read(bytes)
+	for i, b := range bytes {
+		bytes[i] = alphanum[b%byte(len(alphanum))]
 	}
-	return uuid.New().String()
+	return string(bytes)
 }